@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// bearerAuthorized reports whether the request carries a bearer token matching one of
+// the comma-separated keys in the given environment variable. Listing several keys
+// lets a producer rotate its token without downtime. An unset variable rejects everything.
+func bearerAuthorized(r *http.Request, envVar string) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return false
+	}
+	for _, key := range strings.Split(os.Getenv(envVar), ",") {
+		key = strings.TrimSpace(key)
+		if key != "" && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// requestEmail returns the address the caller has proven to own: the one the
+// unexpired preference-center token in ?token= was issued for, or, with an
+// ADMIN_API_KEYS bearer token, the claimed address. A token for another address than
+// the claimed one, or no proof at all, returns false. The non-expiring unsubscribe
+// token is not accepted.
+func requestEmail(r *http.Request, claimed string) (string, bool) {
+	if token := r.URL.Query().Get("token"); token != "" {
+		email, err := verifyPreferenceToken(token, time.Now())
+		if err != nil || (claimed != "" && claimed != email) {
+			return "", false
+		}
+		return email, true
+	}
+	if claimed != "" && bearerAuthorized(r, "ADMIN_API_KEYS") {
+		return claimed, true
+	}
+	return "", false
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const marketChartRangeURL = "https://api.coingecko.com/api/v3/coins/%s/market_chart/range?vs_currency=%s&from=%d&to=%d"
+
+// backfillChunk is the widest window requested from CoinGecko at once. Ranges up to
+// 90 days are returned at hourly granularity; anything longer collapses to daily.
+const backfillChunk = 90 * 24 * time.Hour
+
+// backfillDedupWindow treats a historical point as a duplicate when an existing
+// point for the same asset lies this close to it.
+const backfillDedupWindow = 5 * time.Minute
+
+// backfillChunkDelay spaces out CoinGecko requests to stay under the public rate limit.
+var backfillChunkDelay = 2 * time.Second
+
+// backfillStaleAfter is how long a pending or running job may go without progress
+// before it is considered abandoned, e.g. by an instance that was stopped.
+const backfillStaleAfter = 10 * time.Minute
+
+// historyFetcherFunc defines a function type for fetching historical prices.
+type historyFetcherFunc func(assetID, currency string, apiURL string, from, to time.Time) ([]PricePoint, error)
+
+// BackfillJob records the request and progress of a historical backfill.
+type BackfillJob struct {
+	ID            string    `firestore:"-" json:"id"`
+	AssetID       string    `firestore:"assetId" json:"assetId"`
+	Currency      string    `firestore:"currency" json:"currency"`
+	From          time.Time `firestore:"from" json:"from"`
+	To            time.Time `firestore:"to" json:"to"`
+	Status        string    `firestore:"status" json:"status"`
+	ChunksTotal   int       `firestore:"chunksTotal" json:"chunksTotal"`
+	ChunksDone    int       `firestore:"chunksDone" json:"chunksDone"`
+	PointsWritten int       `firestore:"pointsWritten" json:"pointsWritten"`
+	PointsSkipped int       `firestore:"pointsSkipped" json:"pointsSkipped"`
+	Error         string    `firestore:"error" json:"error,omitempty"`
+	CreatedAt     time.Time `firestore:"createdAt" json:"createdAt"`
+	UpdatedAt     time.Time `firestore:"updatedAt" json:"updatedAt"`
+}
+
+// backfillChunks splits [from, to) into consecutive windows no wider than size.
+func backfillChunks(from, to time.Time, size time.Duration) [][2]time.Time {
+	var chunks [][2]time.Time
+	for start := from; start.Before(to); start = start.Add(size) {
+		end := start.Add(size)
+		if end.After(to) {
+			end = to
+		}
+		chunks = append(chunks, [2]time.Time{start, end})
+	}
+	return chunks
+}
+
+// dedupePoints drops fetched points that fall within window of an existing
+// timestamp or of a point already kept. existing must be sorted ascending.
+func dedupePoints(fetched []PricePoint, existing []time.Time, window time.Duration) []PricePoint {
+	sort.Slice(fetched, func(i, j int) bool { return fetched[i].Timestamp.Before(fetched[j].Timestamp) })
+	var kept []PricePoint
+	for _, p := range fetched {
+		i := sort.Search(len(existing), func(i int) bool { return !existing[i].Before(p.Timestamp.Add(-window)) })
+		if i < len(existing) && !existing[i].After(p.Timestamp.Add(window)) {
+			continue
+		}
+		if n := len(kept); n > 0 && p.Timestamp.Sub(kept[n-1].Timestamp) < window {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// existingTimestamps returns the sorted timestamps already stored for an asset and
+// currency in a range.
+func (a *App) existingTimestamps(ctx context.Context, assetID, currency string, from, to time.Time) ([]time.Time, error) {
+	iter := a.db.Collection("price_history").Where("assetId", "==", assetID).
+		Where("timestamp", ">=", from.Add(-backfillDedupWindow)).
+		Where("timestamp", "<=", to.Add(backfillDedupWindow)).Documents(ctx)
+	defer iter.Stop()
+	var timestamps []time.Time
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data := doc.Data()
+		if pointCurrency(data) != currency {
+			continue
+		}
+		if ts, ok := data["timestamp"].(time.Time); ok {
+			timestamps = append(timestamps, ts)
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i].Before(timestamps[j]) })
+	return timestamps, nil
+}
+
+// writeBackfillPoints stores points with IDs derived from asset and timestamp so a
+// rerun of the same range overwrites rather than duplicates.
+func (a *App) writeBackfillPoints(ctx context.Context, points []PricePoint) error {
+	for start := 0; start < len(points); start += maxIngestBatchSize {
+		end := min(start+maxIngestBatchSize, len(points))
+		batch := a.db.Batch()
+		for _, p := range points[start:end] {
+			id := fmt.Sprintf("backfill-%s-%s-%d", p.AssetID, p.Currency, p.Timestamp.UnixMilli())
+			batch.Set(a.db.Collection("price_history").Doc(id), map[string]interface{}{
+				"assetId":   p.AssetID,
+				"price":     p.Price,
+				"currency":  p.Currency,
+				"timestamp": p.Timestamp,
+				"source":    "coingecko-backfill",
+			})
+		}
+		if _, err := batch.Commit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runBackfill fetches and stores history for job chunk by chunk, persisting progress
+// after every chunk and calling progress (if non-nil) with the updated job.
+// Cancelling ctx stops the job before its next chunk and records it as failed.
+func (a *App) runBackfill(ctx context.Context, job *BackfillJob, progress func(BackfillJob)) error {
+	ref := a.db.Collection("backfill_jobs").Doc(job.ID)
+	saveCtx := context.WithoutCancel(ctx)
+	save := func() {
+		job.UpdatedAt = time.Now()
+		if _, err := ref.Set(saveCtx, job); err != nil {
+			log.Printf("ERROR in runBackfill: Failed to save progress for job %s: %v", job.ID, err)
+		}
+		if progress != nil {
+			progress(*job)
+		}
+	}
+	fail := func(err error) error {
+		job.Status = "failed"
+		job.Error = err.Error()
+		save()
+		return err
+	}
+
+	chunks := backfillChunks(job.From, job.To, backfillChunk)
+	job.Status = "running"
+	job.ChunksTotal = len(chunks)
+	save()
+
+	for i, c := range chunks {
+		if i > 0 {
+			if err := sleepContext(ctx, backfillChunkDelay); err != nil {
+				return fail(fmt.Errorf("interrupted after %d of %d chunks: %w", i, len(chunks), err))
+			}
+		}
+		fetched, err := a.historyFetcher(job.AssetID, job.Currency, marketChartRangeURL, c[0], c[1])
+		if err != nil {
+			return fail(fmt.Errorf("fetching %s to %s: %w", c[0].Format(time.RFC3339), c[1].Format(time.RFC3339), err))
+		}
+		existing, err := a.existingTimestamps(ctx, job.AssetID, job.Currency, c[0], c[1])
+		if err != nil {
+			return fail(fmt.Errorf("reading existing history: %w", err))
+		}
+		kept := dedupePoints(fetched, existing, backfillDedupWindow)
+		if err := a.writeBackfillPoints(ctx, kept); err != nil {
+			return fail(fmt.Errorf("writing history: %w", err))
+		}
+		job.ChunksDone++
+		job.PointsWritten += len(kept)
+		job.PointsSkipped += len(fetched) - len(kept)
+		save()
+	}
+
+	job.Status = "completed"
+	save()
+	return nil
+}
+
+// newBackfillJob validates a backfill request and registers it in backfill_jobs.
+func (a *App) newBackfillJob(ctx context.Context, assetID, currency string, from, to time.Time) (*BackfillJob, error) {
+	assetID, err := a.resolveAssetID(ctx, assetID)
+	if err != nil {
+		return nil, err
+	}
+	if !sourceNamePattern.MatchString(assetID) {
+		return nil, fmt.Errorf("invalid assetId %q", assetID)
+	}
+	currency, err = normalizeCurrency(currency)
+	if err != nil {
+		return nil, err
+	}
+	if !from.Before(to) {
+		return nil, fmt.Errorf("from must be before to")
+	}
+	if to.After(time.Now()) {
+		to = time.Now()
+	}
+	now := time.Now()
+	job := &BackfillJob{AssetID: assetID, Currency: currency, From: from, To: to, Status: "pending", CreatedAt: now, UpdatedAt: now}
+	ref, _, err := a.db.Collection("backfill_jobs").Add(ctx, job)
+	if err != nil {
+		return nil, err
+	}
+	job.ID = ref.ID
+	return job, nil
+}
+
+// backfillStale reports whether job was left pending or running without progress
+// for longer than backfillStaleAfter.
+func backfillStale(job BackfillJob, now time.Time) bool {
+	return (job.Status == "pending" || job.Status == "running") && now.Sub(job.UpdatedAt) > backfillStaleAfter
+}
+
+// failStaleBackfills marks abandoned jobs as failed so that they do not report
+// "running" forever, and returns how many it marked.
+func (a *App) failStaleBackfills(ctx context.Context, now time.Time) (int, error) {
+	docs, err := a.db.Collection("backfill_jobs").Where("status", "in", []string{"pending", "running"}).Documents(ctx).GetAll()
+	if err != nil {
+		return 0, err
+	}
+	failed := 0
+	for _, doc := range docs {
+		var job BackfillJob
+		if err := doc.DataTo(&job); err != nil || !backfillStale(job, now) {
+			continue
+		}
+		_, err := doc.Ref.Update(ctx, []firestore.Update{
+			{Path: "status", Value: "failed"},
+			{Path: "error", Value: fmt.Sprintf("no progress since %s; the job was interrupted", job.UpdatedAt.Format(time.RFC3339))},
+			{Path: "updatedAt", Value: now},
+		}, firestore.LastUpdateTime(doc.UpdateTime))
+		if err != nil {
+			log.Printf("ERROR in failStaleBackfills: Failed to mark job %s as failed: %v", doc.Ref.ID, err)
+			continue
+		}
+		failed++
+	}
+	return failed, nil
+}
+
+// startBackfill runs job in the background under a.jobCtx. Shutdown cancels that
+// context and waits on a.jobs, so an interrupted job is recorded as failed.
+func (a *App) startBackfill(job *BackfillJob) {
+	ctx := a.jobCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	a.jobs.Add(1)
+	go func() {
+		defer a.jobs.Done()
+		if err := a.runBackfill(ctx, job, nil); err != nil {
+			log.Printf("ERROR in backfill job %s: %v", job.ID, err)
+		}
+	}()
+}
+
+// backfillHandler starts a backfill job (POST /admin/backfill) and reports job
+// progress (GET /admin/backfill/{id}).
+func (a *App) backfillHandler(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := context.Background()
+
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/backfill"), "/"); id != "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		doc, err := a.db.Collection("backfill_jobs").Doc(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, "Backfill job not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve backfill job", http.StatusInternalServerError)
+			return
+		}
+		var job BackfillJob
+		doc.DataTo(&job)
+		job.ID = doc.Ref.ID
+		if backfillStale(job, time.Now()) {
+			if _, err := a.failStaleBackfills(ctx, time.Now()); err != nil {
+				log.Printf("ERROR in backfillHandler: Failed to mark stale jobs as failed: %v", err)
+			} else if doc, err = doc.Ref.Get(ctx); err == nil {
+				doc.DataTo(&job)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		AssetID  string    `json:"assetId"`
+		Currency string    `json:"currency"`
+		From     time.Time `json:"from"`
+		To       time.Time `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.To.IsZero() {
+		req.To = time.Now()
+	}
+	job, err := a.newBackfillJob(ctx, req.AssetID, req.Currency, req.From, req.To)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The job outlives the request; poll GET /admin/backfill/{id} for progress.
+	a.startBackfill(job)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]string{"status": "backfill started", "id": job.ID})
+}
+
+// runBackfillCommand implements the "backfill" CLI subcommand.
+func runBackfillCommand(ctx context.Context, app *App, assetID, currency, fromStr, toStr string) error {
+	from, err := time.Parse("2006-01-02", fromStr)
+	if err != nil {
+		return fmt.Errorf("invalid -from date: %w", err)
+	}
+	to := time.Now()
+	if toStr != "" {
+		if to, err = time.Parse("2006-01-02", toStr); err != nil {
+			return fmt.Errorf("invalid -to date: %w", err)
+		}
+	}
+	job, err := app.newBackfillJob(ctx, assetID, currency, from, to)
+	if err != nil {
+		return err
+	}
+	log.Printf("Backfill job %s: %s in %s from %s to %s", job.ID, job.AssetID, job.Currency, job.From.Format(time.RFC3339), job.To.Format(time.RFC3339))
+	return app.runBackfill(ctx, job, func(j BackfillJob) {
+		log.Printf("Backfill job %s: %s, chunk %d/%d, %d points written, %d duplicates skipped", j.ID, j.Status, j.ChunksDone, j.ChunksTotal, j.PointsWritten, j.PointsSkipped)
+	})
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const coinListURL = "https://api.coingecko.com/api/v3/coins/list"
+
+// catalogTTL is how long a synced coin list is trusted before it is refreshed.
+const catalogTTL = 24 * time.Hour
+
+// catalogRetryAfter is how long ensureFresh waits after a failed sync before it
+// contacts the provider again.
+const catalogRetryAfter = 5 * time.Minute
+
+// coinListFetcherFunc defines a function type for fetching the provider's coin list.
+type coinListFetcherFunc func(apiURL string) ([]Asset, error)
+
+// Asset is one entry of the provider's coin list.
+type Asset struct {
+	ID     string `json:"id"`
+	Symbol string `json:"symbol"`
+	Name   string `json:"name"`
+}
+
+// UnknownAssetError is returned when an asset cannot be resolved to a single coin ID.
+type UnknownAssetError struct {
+	Input       string
+	Ambiguous   bool
+	Suggestions []Asset
+}
+
+func (e *UnknownAssetError) Error() string {
+	reason := "Unknown asset"
+	if e.Ambiguous {
+		reason = "Ambiguous asset"
+	}
+	if len(e.Suggestions) == 0 {
+		return fmt.Sprintf("%s %q", reason, e.Input)
+	}
+	ids := make([]string, len(e.Suggestions))
+	for i, s := range e.Suggestions {
+		ids[i] = s.ID
+	}
+	return fmt.Sprintf("%s %q. Did you mean: %s?", reason, e.Input, strings.Join(ids, ", "))
+}
+
+// AssetCatalog is a locally cached copy of the provider's coin list, indexed for
+// lookup by ID, ticker symbol and name. The list is kept in memory and mirrored to
+// a JSON file so a restarted instance does not need to hit the provider again.
+type AssetCatalog struct {
+	fetcher   coinListFetcherFunc
+	cachePath string
+
+	// syncMu lets only one sync talk to the provider at a time.
+	syncMu sync.Mutex
+
+	mu       sync.RWMutex
+	assets   []Asset
+	byID     map[string]Asset
+	bySymbol map[string][]Asset
+	byName   map[string][]Asset
+	syncedAt time.Time
+	failedAt time.Time
+}
+
+// NewAssetCatalog creates an empty catalog that syncs through fetcher and caches to cachePath.
+func NewAssetCatalog(fetcher coinListFetcherFunc, cachePath string) *AssetCatalog {
+	return &AssetCatalog{fetcher: fetcher, cachePath: cachePath}
+}
+
+// defaultCatalogCachePath returns ASSET_CATALOG_CACHE or a file in the temp directory.
+func defaultCatalogCachePath() string {
+	if p := os.Getenv("ASSET_CATALOG_CACHE"); p != "" {
+		return p
+	}
+	return filepath.Join(os.TempDir(), "pricepulse-assets.json")
+}
+
+// load replaces the catalog contents and rebuilds the indexes.
+func (c *AssetCatalog) load(assets []Asset, syncedAt time.Time) {
+	byID := make(map[string]Asset, len(assets))
+	bySymbol := map[string][]Asset{}
+	byName := map[string][]Asset{}
+	for _, a := range assets {
+		byID[a.ID] = a
+		sym := strings.ToLower(a.Symbol)
+		bySymbol[sym] = append(bySymbol[sym], a)
+		name := strings.ToLower(a.Name)
+		byName[name] = append(byName[name], a)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.assets = assets
+	c.byID = byID
+	c.bySymbol = bySymbol
+	c.byName = byName
+	c.syncedAt = syncedAt
+}
+
+// Sync downloads the coin list from the provider and refreshes the file cache.
+// It waits for any sync already in progress.
+func (c *AssetCatalog) Sync() error {
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	return c.sync()
+}
+
+// sync does the work of Sync; the caller holds syncMu. A failure is recorded so
+// that ensureFresh backs off.
+func (c *AssetCatalog) sync() error {
+	assets, err := c.fetcher(coinListURL)
+	if err == nil && len(assets) == 0 {
+		err = fmt.Errorf("provider returned an empty coin list")
+	}
+	if err != nil {
+		c.mu.Lock()
+		c.failedAt = time.Now()
+		c.mu.Unlock()
+		return err
+	}
+	c.load(assets, time.Now())
+
+	if c.cachePath != "" {
+		data, err := json.Marshal(assets)
+		if err == nil {
+			err = os.WriteFile(c.cachePath, data, 0o644)
+		}
+		if err != nil {
+			log.Printf("Failed to write asset catalog cache: %v", err)
+		}
+	}
+	return nil
+}
+
+// ensureFresh loads the catalog from the file cache or the provider when it is
+// empty or older than catalogTTL. A stale catalog is kept if the refresh fails, and
+// the provider is not retried until catalogRetryAfter has passed. Concurrent
+// callers wait for a single sync instead of each starting their own.
+func (c *AssetCatalog) ensureFresh() {
+	if !c.needsSync() {
+		return
+	}
+	c.syncMu.Lock()
+	defer c.syncMu.Unlock()
+	// Another caller may have synced, or failed to, while this one waited.
+	if !c.needsSync() {
+		return
+	}
+
+	c.mu.RLock()
+	empty := len(c.assets) == 0
+	c.mu.RUnlock()
+	if empty && c.cachePath != "" {
+		if info, err := os.Stat(c.cachePath); err == nil && time.Since(info.ModTime()) < catalogTTL {
+			if data, err := os.ReadFile(c.cachePath); err == nil {
+				var assets []Asset
+				if json.Unmarshal(data, &assets) == nil && len(assets) > 0 {
+					c.load(assets, info.ModTime())
+					return
+				}
+			}
+		}
+	}
+
+	if err := c.sync(); err != nil {
+		log.Printf("Failed to sync asset catalog, retrying in %s: %v", catalogRetryAfter, err)
+	}
+}
+
+// needsSync reports whether the catalog is empty or expired and the last failed
+// sync, if any, is more than catalogRetryAfter ago.
+func (c *AssetCatalog) needsSync() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fresh := len(c.assets) > 0 && time.Since(c.syncedAt) < catalogTTL
+	return !fresh && time.Since(c.failedAt) >= catalogRetryAfter
+}
+
+// Len returns the number of assets currently in the catalog.
+func (c *AssetCatalog) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.assets)
+}
+
+// Resolve maps a coin ID, ticker ("BTC") or name ("Bitcoin") to a canonical coin ID.
+// It returns an *UnknownAssetError with suggestions when nothing, or more than one
+// coin, matches.
+func (c *AssetCatalog) Resolve(input string) (string, error) {
+	c.ensureFresh()
+	q := strings.ToLower(strings.TrimSpace(input))
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if a, ok := c.byID[q]; ok {
+		return a.ID, nil
+	}
+	for _, matches := range [][]Asset{c.bySymbol[q], c.byName[q]} {
+		if len(matches) == 1 {
+			return matches[0].ID, nil
+		}
+		if len(matches) > 1 {
+			// Tickers are reused by wrapped and bridged tokens; the original coin is
+			// the one whose ID is simply its name.
+			for _, a := range matches {
+				if a.ID == strings.ReplaceAll(strings.ToLower(a.Name), " ", "-") {
+					return a.ID, nil
+				}
+			}
+			return "", &UnknownAssetError{Input: input, Ambiguous: true, Suggestions: matches[:min(len(matches), 5)]}
+		}
+	}
+	return "", &UnknownAssetError{Input: input, Suggestions: c.suggest(q, 5)}
+}
+
+// suggest returns assets whose ID, symbol or name is within a small edit distance of q.
+// Callers must hold c.mu.
+func (c *AssetCatalog) suggest(q string, limit int) []Asset {
+	type scored struct {
+		asset Asset
+		dist  int
+	}
+	maxDist := 1 + len(q)/4
+	var candidates []scored
+	for _, a := range c.assets {
+		best := maxDist + 1
+		for _, field := range []string{a.ID, strings.ToLower(a.Symbol), strings.ToLower(a.Name)} {
+			if d := levenshtein(q, field); d < best {
+				best = d
+			}
+		}
+		if best <= maxDist {
+			candidates = append(candidates, scored{a, best})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].dist < candidates[j].dist })
+	var out []Asset
+	for _, s := range candidates[:min(len(candidates), limit)] {
+		out = append(out, s.asset)
+	}
+	return out
+}
+
+// Search returns up to limit assets for autocomplete, ranking exact symbol matches
+// first, then ID and name prefixes, then substring matches.
+func (c *AssetCatalog) Search(query string, limit int) []Asset {
+	c.ensureFresh()
+	q := strings.ToLower(strings.TrimSpace(query))
+	if q == "" {
+		return []Asset{}
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	type ranked struct {
+		asset Asset
+		rank  int
+	}
+	var hits []ranked
+	for _, a := range c.assets {
+		id, sym, name := a.ID, strings.ToLower(a.Symbol), strings.ToLower(a.Name)
+		switch {
+		case sym == q || id == q:
+			hits = append(hits, ranked{a, 0})
+		case strings.HasPrefix(id, q) || strings.HasPrefix(name, q):
+			hits = append(hits, ranked{a, 1})
+		case strings.HasPrefix(sym, q):
+			hits = append(hits, ranked{a, 2})
+		case strings.Contains(name, q):
+			hits = append(hits, ranked{a, 3})
+		}
+	}
+	sort.SliceStable(hits, func(i, j int) bool {
+		if hits[i].rank != hits[j].rank {
+			return hits[i].rank < hits[j].rank
+		}
+		return len(hits[i].asset.ID) < len(hits[j].asset.ID)
+	})
+	out := []Asset{}
+	for _, h := range hits[:min(len(hits), limit)] {
+		out = append(out, h.asset)
+	}
+	return out
+}
+
+// levenshtein returns the edit distance between two strings.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(rb)]
+}
+
+// resolveAssetID turns user input into the canonical ID used in signals and
+// price_history. Custom source names are accepted as-is; everything else must be
+// in the asset catalog. Without a catalog the input is only normalised.
+func (a *App) resolveAssetID(ctx context.Context, input string) (string, error) {
+	id := strings.ToLower(strings.TrimSpace(input))
+	if id == "" {
+		return "", fmt.Errorf("an asset is required")
+	}
+	if src, err := a.getCustomSource(ctx, id); err == nil && src != nil {
+		return src.Name, nil
+	}
+	if a.catalog == nil {
+		return id, nil
+	}
+	a.catalog.ensureFresh()
+	if a.catalog.Len() == 0 {
+		// The provider is unreachable; the price lookup will still reject bad IDs.
+		return id, nil
+	}
+	return a.catalog.Resolve(input)
+}
+
+// assetSearchHandler serves autocomplete results for the asset field.
+func (a *App) assetSearchHandler(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 50 {
+		limit = 10
+	}
+	results := []Asset{}
+	if a.catalog != nil {
+		results = a.catalog.Search(r.URL.Query().Get("q"), limit)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// syncCatalogHandler forces a refresh of the asset catalog from the provider.
+func (a *App) syncCatalogHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := a.catalog.Sync(); err != nil {
+		log.Printf("ERROR in syncCatalogHandler: %v", err)
+		http.Error(w, "Failed to sync asset catalog", http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "catalog synced", "assets": a.catalog.Len()})
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Embed colours for Discord, matching the status colours on user_page.html.
+const (
+	discordColorUp   = 0x28a745
+	discordColorDown = 0xdc3545
+)
+
+// signalsPageURL links to a user's signals page.
+func signalsPageURL(email string) string {
+	return publicBaseURL() + "/signals/" + url.PathEscape(email)
+}
+
+// formatChange renders a percentage change with an explicit sign, e.g. "+5.25%".
+func formatChange(changePercent float64) string {
+	return fmt.Sprintf("%+.2f%%", changePercent)
+}
+
+// postChatWebhook posts a JSON message to an incoming-webhook URL.
+func postChatWebhook(ctx context.Context, client *http.Client, webhookURL string, message interface{}) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &httpStatusError{resp.StatusCode, fmt.Sprintf("webhook returned status %d: %s", resp.StatusCode, strings.TrimSpace(string(detail)))}
+	}
+	return nil
+}
+
+// validateWebhookTarget checks that target is an https URL on one of the given hosts.
+func validateWebhookTarget(target string, hosts ...string) error {
+	u, err := url.Parse(target)
+	if err != nil || u.Scheme != "https" {
+		return fmt.Errorf("must be an https URL")
+	}
+	for _, h := range hosts {
+		if u.Host == h {
+			return nil
+		}
+	}
+	return fmt.Errorf("must be a webhook URL on %s", strings.Join(hosts, " or "))
+}
+
+// SlackNotifier posts alerts to a Slack incoming webhook as Block Kit messages.
+type SlackNotifier struct {
+	Client    *http.Client
+	Templates *NotificationTemplates
+}
+
+// NewSlackNotifier creates a Slack notifier with a default HTTP client.
+func NewSlackNotifier(templates *NotificationTemplates) *SlackNotifier {
+	return &SlackNotifier{Client: &http.Client{Timeout: 10 * time.Second}, Templates: templates}
+}
+
+// ValidateTarget checks a signal's Slack incoming-webhook URL.
+func (n *SlackNotifier) ValidateTarget(target string) error {
+	return validateWebhookTarget(target, "hooks.slack.com")
+}
+
+// message builds the Block Kit message for an alert.
+func (n *SlackNotifier) message(alert Alert) (map[string]interface{}, error) {
+	text, err := n.Templates.Render("slack.txt", alert)
+	if err != nil {
+		return nil, err
+	}
+	currency := alert.Signal.quoteCurrency()
+	fields := []map[string]string{
+		{"type": "mrkdwn", "text": "*Asset*\n" + alert.Signal.AssetID},
+		{"type": "mrkdwn", "text": "*Change*\n" + formatChange(alert.ChangePercent)},
+		{"type": "mrkdwn", "text": "*Price*\n" + formatPrice(alert.Price, currency)},
+		{"type": "mrkdwn", "text": "*Baseline*\n" + formatPrice(alert.Signal.PriceAtCreation, currency)},
+	}
+	buttons := []interface{}{
+		map[string]interface{}{
+			"type": "button",
+			"text": map[string]string{"type": "plain_text", "text": "View your signals"},
+			"url":  signalsPageURL(alert.Signal.Email),
+		},
+	}
+	if alert.TriggerID != "" {
+		buttons = append(buttons, map[string]interface{}{
+			"type":  "button",
+			"style": "primary",
+			"text":  map[string]string{"type": "plain_text", "text": "Acknowledge"},
+			"url":   ackURL(alert.TriggerID, ackRecipient(alert)),
+		})
+	}
+	return map[string]interface{}{
+		// text is the fallback shown in notifications and by clients without blocks.
+		"text": text,
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "header",
+				"text": map[string]string{"type": "plain_text", "text": n.Templates.Subject(alert)},
+			},
+			map[string]interface{}{
+				"type":   "section",
+				"fields": fields,
+			},
+			map[string]interface{}{
+				"type":     "actions",
+				"elements": buttons,
+			},
+		},
+	}, nil
+}
+
+// Notify posts the alert to the signal's Slack webhook.
+func (n *SlackNotifier) Notify(ctx context.Context, alert Alert) error {
+	target := alert.Signal.Targets["slack"]
+	if target == "" {
+		return fmt.Errorf("signal has no Slack webhook URL")
+	}
+	message, err := n.message(alert)
+	if err != nil {
+		return fmt.Errorf("failed to render Slack message: %w", err)
+	}
+	return postChatWebhook(ctx, n.Client, target, message)
+}
+
+// DiscordNotifier posts alerts to a Discord channel webhook as embeds.
+type DiscordNotifier struct {
+	Client    *http.Client
+	Templates *NotificationTemplates
+}
+
+// NewDiscordNotifier creates a Discord notifier with a default HTTP client.
+func NewDiscordNotifier(templates *NotificationTemplates) *DiscordNotifier {
+	return &DiscordNotifier{Client: &http.Client{Timeout: 10 * time.Second}, Templates: templates}
+}
+
+// ValidateTarget checks a signal's Discord webhook URL.
+func (n *DiscordNotifier) ValidateTarget(target string) error {
+	return validateWebhookTarget(target, "discord.com", "discordapp.com")
+}
+
+// message builds the embed message for an alert.
+func (n *DiscordNotifier) message(alert Alert) (map[string]interface{}, error) {
+	description, err := n.Templates.Render("discord.txt", alert)
+	if err != nil {
+		return nil, err
+	}
+	currency := alert.Signal.quoteCurrency()
+	color := discordColorUp
+	if alert.ChangePercent < 0 {
+		color = discordColorDown
+	}
+	return map[string]interface{}{
+		"username": "PricePulse",
+		"embeds": []interface{}{
+			map[string]interface{}{
+				"title":       n.Templates.Subject(alert),
+				"description": description,
+				"url":         signalsPageURL(alert.Signal.Email),
+				"color":       color,
+				"timestamp":   alert.TriggeredAt.Format(time.RFC3339),
+				"fields": []map[string]interface{}{
+					{"name": "Asset", "value": alert.Signal.AssetID, "inline": true},
+					{"name": "Change", "value": formatChange(alert.ChangePercent), "inline": true},
+					{"name": "Price", "value": formatPrice(alert.Price, currency), "inline": true},
+					{"name": "Baseline", "value": formatPrice(alert.Signal.PriceAtCreation, currency), "inline": true},
+				},
+			},
+		},
+	}, nil
+}
+
+// Notify posts the alert to the signal's Discord webhook.
+func (n *DiscordNotifier) Notify(ctx context.Context, alert Alert) error {
+	target := alert.Signal.Targets["discord"]
+	if target == "" {
+		return fmt.Errorf("signal has no Discord webhook URL")
+	}
+	message, err := n.message(alert)
+	if err != nil {
+		return fmt.Errorf("failed to render Discord message: %w", err)
+	}
+	return postChatWebhook(ctx, n.Client, target, message)
+}
@@ -4,8 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 )
 
+// coinGeckoSimplePriceURL returns the simple/price URL for the given quote currencies.
+// The asset IDs are left as a %s placeholder for the price fetcher to fill in.
+func coinGeckoSimplePriceURL(currencies []string) string {
+	return "https://api.coingecko.com/api/v3/simple/price?ids=%s&vs_currencies=" + strings.Join(currencies, ",")
+}
+
 // getPriceFromCoinGecko fetches the price of an asset from CoinGecko.
 func getPriceFromCoinGecko(assetID string, apiURL string) (map[string]map[string]interface{}, error) {
 	url := fmt.Sprintf(apiURL, assetID)
@@ -23,3 +31,59 @@ func getPriceFromCoinGecko(assetID string, apiURL string) (map[string]map[string
 
 	return data, nil
 }
+
+// getMarketChartRangeFromCoinGecko fetches historical prices for an asset between two
+// times from CoinGecko's market_chart/range endpoint. apiURL takes the asset ID, the
+// quote currency and the from and to Unix timestamps.
+func getMarketChartRangeFromCoinGecko(assetID, currency string, apiURL string, from, to time.Time) ([]PricePoint, error) {
+	url := fmt.Sprintf(apiURL, assetID, currency, from.Unix(), to.Unix())
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("coingecko returned status %d", resp.StatusCode)
+	}
+
+	var data struct {
+		Prices [][2]float64 `json:"prices"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	points := make([]PricePoint, 0, len(data.Prices))
+	for _, p := range data.Prices {
+		points = append(points, PricePoint{
+			AssetID:   assetID,
+			Price:     p[1],
+			Currency:  currency,
+			Timestamp: time.UnixMilli(int64(p[0])).UTC(),
+		})
+	}
+	return points, nil
+}
+
+// coinListClient downloads the coin list, which runs to several megabytes; the
+// timeout keeps a hung provider from stalling the requests waiting on the catalog.
+var coinListClient = &http.Client{Timeout: 30 * time.Second}
+
+// getCoinListFromCoinGecko fetches every coin CoinGecko knows about.
+func getCoinListFromCoinGecko(apiURL string) ([]Asset, error) {
+	resp, err := coinListClient.Get(apiURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("coingecko returned status %d", resp.StatusCode)
+	}
+
+	var assets []Asset
+	if err := json.NewDecoder(resp.Body).Decode(&assets); err != nil {
+		return nil, err
+	}
+	return assets, nil
+}
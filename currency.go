@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// defaultCurrency is assumed for signals and price points stored before quote
+// currencies existed.
+const defaultCurrency = "usd"
+
+// currencyFormat describes how amounts in a quote currency are displayed.
+type currencyFormat struct {
+	Symbol   string
+	Decimals int
+}
+
+// supportedCurrencies lists the quote currencies signals may be denominated in. Keys
+// are CoinGecko vs_currencies codes.
+var supportedCurrencies = map[string]currencyFormat{
+	"usd": {"$", 2},
+	"eur": {"€", 2},
+	"gbp": {"£", 2},
+	"chf": {"CHF ", 2},
+	"cad": {"C$", 2},
+	"aud": {"A$", 2},
+	"jpy": {"¥", 0},
+	"btc": {"₿", 8},
+	"eth": {"Ξ", 6},
+}
+
+// normalizeCurrency lowercases a currency code, defaults it to usd and checks that
+// it is supported.
+func normalizeCurrency(code string) (string, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if code == "" {
+		return defaultCurrency, nil
+	}
+	if _, ok := supportedCurrencies[code]; !ok {
+		return "", fmt.Errorf("unsupported currency %q (supported: %s)", code, strings.Join(currencyCodes(), ", "))
+	}
+	return code, nil
+}
+
+// currencyCodes returns the supported currency codes in sorted order.
+func currencyCodes() []string {
+	codes := make([]string, 0, len(supportedCurrencies))
+	for code := range supportedCurrencies {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// pointCurrency returns the currency of a stored price_history document.
+func pointCurrency(data map[string]interface{}) string {
+	if c, ok := data["currency"].(string); ok && c != "" {
+		return c
+	}
+	return defaultCurrency
+}
+
+// formatPrice renders an amount with the symbol, precision and thousands grouping
+// appropriate for its currency, e.g. "$65,000.50", "€1,234.00" or "₿0.00012345".
+func formatPrice(amount float64, currency string) string {
+	if currency == "" {
+		currency = defaultCurrency
+	}
+	f, ok := supportedCurrencies[strings.ToLower(currency)]
+	if !ok {
+		f = currencyFormat{Symbol: strings.ToUpper(currency) + " ", Decimals: 2}
+	}
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = math.Abs(amount)
+	}
+	s := fmt.Sprintf("%.*f", f.Decimals, amount)
+	whole, frac, _ := strings.Cut(s, ".")
+	var grouped strings.Builder
+	for i, d := range whole {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			grouped.WriteByte(',')
+		}
+		grouped.WriteRune(d)
+	}
+	if frac != "" {
+		return sign + f.Symbol + grouped.String() + "." + frac
+	}
+	return sign + f.Symbol + grouped.String()
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// digestSlack lets a digest go out slightly early so scheduler jitter does not push
+// it to the following run.
+const digestSlack = 5 * time.Minute
+
+// DigestItem is a triggered email alert held in digest_queue until the user's next digest.
+type DigestItem struct {
+	Email         string    `firestore:"email"`
+	SignalID      string    `firestore:"signalId"`
+	TriggerID     string    `firestore:"triggerId"`
+	AssetID       string    `firestore:"assetId"`
+	Currency      string    `firestore:"currency"`
+	Price         float64   `firestore:"price"`
+	Baseline      float64   `firestore:"baseline"`
+	ChangePercent float64   `firestore:"changePercent"`
+	Threshold     float64   `firestore:"threshold"`
+	TriggeredAt   time.Time `firestore:"triggeredAt"`
+}
+
+// newDigestItem records an alert for a digest.
+func newDigestItem(alert Alert, triggerID string) DigestItem {
+	return DigestItem{
+		Email:         alert.Signal.Email,
+		SignalID:      alert.SignalID,
+		TriggerID:     triggerID,
+		AssetID:       alert.Signal.AssetID,
+		Currency:      alert.Signal.quoteCurrency(),
+		Price:         alert.Price,
+		Baseline:      alert.Signal.PriceAtCreation,
+		ChangePercent: alert.ChangePercent,
+		Threshold:     alert.Signal.ChangeThresholdPercentage,
+		TriggeredAt:   alert.TriggeredAt,
+	}
+}
+
+// DigestData is the data model of the digest templates.
+type DigestData struct {
+	Email string
+	// Period is "hourly", "daily" or "weekly", or "immediate" for a summary of
+	// alerts that went over the user's rate limit.
+	Period     string
+	Triggers   []DigestTrigger
+	Assets     []DigestAsset
+	SignalsURL string
+	// PreferencesURL and UnsubscribeURL carry the user's signed token.
+	PreferencesURL string
+	UnsubscribeURL string
+	GeneratedAt    time.Time
+	// Subject is the rendered digest_subject.txt, for use in the bodies.
+	Subject string
+}
+
+// DigestTrigger is one alert in a digest, with prices preformatted.
+type DigestTrigger struct {
+	SignalID      string
+	AssetID       string
+	Currency      string
+	Price         string
+	Baseline      string
+	Change        string
+	ChangePercent float64
+	Threshold     float64
+	TriggeredAt   time.Time
+}
+
+// DigestAsset summarizes one watched asset: its current price and 24h moving average.
+// Price is empty when it could not be fetched and Average when there is no history.
+type DigestAsset struct {
+	AssetID    string
+	Currency   string
+	Price      string
+	Average    string
+	DataPoints int
+}
+
+// digestTrigger formats a queued item for the digest templates.
+func digestTrigger(item DigestItem) DigestTrigger {
+	return DigestTrigger{
+		SignalID:      item.SignalID,
+		AssetID:       item.AssetID,
+		Currency:      strings.ToUpper(item.Currency),
+		Price:         formatPrice(item.Price, item.Currency),
+		Baseline:      formatPrice(item.Baseline, item.Currency),
+		Change:        formatChange(item.ChangePercent),
+		ChangePercent: item.ChangePercent,
+		Threshold:     item.Threshold,
+		TriggeredAt:   item.TriggeredAt,
+	}
+}
+
+// sampleDigest is the digest rendered by the template preview endpoint.
+func sampleDigest(alert Alert) DigestData {
+	currency := alert.Signal.quoteCurrency()
+	return DigestData{
+		Email:    alert.Signal.Email,
+		Period:   deliveryDaily,
+		Triggers: []DigestTrigger{digestTrigger(newDigestItem(alert, ""))},
+		Assets: []DigestAsset{{
+			AssetID:    alert.Signal.AssetID,
+			Currency:   strings.ToUpper(currency),
+			Price:      formatPrice(alert.Price, currency),
+			Average:    formatPrice((alert.Price+alert.Signal.PriceAtCreation)/2, currency),
+			DataPoints: 288,
+		}},
+		SignalsURL:     signalsPageURL(alert.Signal.Email),
+		PreferencesURL: preferenceCenterURL(alert.Signal.Email),
+		UnsubscribeURL: unsubscribeURL(alert.Signal.Email),
+		GeneratedAt:    alert.TriggeredAt,
+	}
+}
+
+// digestDue reports whether a user's next digest should be sent. Users who went back
+// to immediate delivery get whatever is still queued straight away.
+func digestDue(prefs UserPreferences, now time.Time) bool {
+	period, ok := digestPeriods[prefs.delivery()]
+	if !ok || prefs.LastDigestAt.IsZero() {
+		return true
+	}
+	return now.Sub(prefs.LastDigestAt) >= period-digestSlack
+}
+
+// buildDigest assembles a user's digest from their queued triggers plus the current
+// price and 24h analysis of every asset they watch.
+func (a *App) buildDigest(ctx context.Context, prefs UserPreferences, items []DigestItem, now time.Time) (DigestData, error) {
+	sort.Slice(items, func(i, j int) bool { return items[i].TriggeredAt.Before(items[j].TriggeredAt) })
+	data := DigestData{
+		Email:          prefs.Email,
+		Period:         prefs.delivery(),
+		SignalsURL:     signalsPageURL(prefs.Email),
+		PreferencesURL: preferenceCenterURL(prefs.Email),
+		UnsubscribeURL: unsubscribeURL(prefs.Email),
+		GeneratedAt:    now,
+	}
+
+	type pair struct{ assetID, currency string }
+	var watched []pair
+	seen := map[pair]bool{}
+	add := func(p pair) {
+		if !seen[p] {
+			seen[p] = true
+			watched = append(watched, p)
+		}
+	}
+	for _, item := range items {
+		data.Triggers = append(data.Triggers, digestTrigger(item))
+		add(pair{item.AssetID, item.Currency})
+	}
+	iter := a.db.Collection("signals").Where("email", "==", prefs.Email).Where("status", "==", "active").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return DigestData{}, fmt.Errorf("failed to load signals for %s: %w", prefs.Email, err)
+		}
+		var s Signal
+		doc.DataTo(&s)
+		add(pair{s.AssetID, s.quoteCurrency()})
+	}
+
+	for _, p := range watched {
+		asset := DigestAsset{AssetID: p.assetID, Currency: strings.ToUpper(p.currency)}
+		if price, err := a.fetchCurrentPrice(ctx, p.assetID, p.currency); err == nil {
+			asset.Price = formatPrice(price, p.currency)
+		} else {
+			log.Printf("Digest for %s: could not fetch %s price: %v", prefs.Email, p.assetID, err)
+		}
+		analysis, err := a.analyzePrices(ctx, p.assetID, p.currency, 24*time.Hour)
+		if err != nil {
+			log.Printf("Digest for %s: could not analyze %s: %v", prefs.Email, p.assetID, err)
+		} else if analysis.DataPointsUsed > 0 {
+			asset.Average = formatPrice(analysis.SimpleMovingAverage, p.currency)
+			asset.DataPoints = analysis.DataPointsUsed
+		}
+		data.Assets = append(data.Assets, asset)
+	}
+	return data, nil
+}
+
+// sendDigests emails every user whose digest is due and has queued triggers, then
+// clears their queue. A failed send leaves the queue for the next run. The queue of
+// an address that may not be emailed, because it is unsubscribed, suspended or not
+// confirmed, is dropped, as it would otherwise wait forever.
+func (a *App) sendDigests(ctx context.Context, now time.Time) (int, error) {
+	iter := a.db.Collection("preferences").Documents(ctx)
+	defer iter.Stop()
+	sent := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return sent, fmt.Errorf("failed to load preferences: %w", err)
+		}
+		var prefs UserPreferences
+		doc.DataTo(&prefs)
+		prefs.Email = doc.Ref.ID
+		blocked := prefs.emailBlocked() || !prefs.EmailVerified
+		if _, quiet := prefs.quietUntil(now); !blocked && (quiet || !digestDue(prefs, now)) {
+			continue
+		}
+
+		docs, err := a.db.Collection("digest_queue").Where("email", "==", prefs.Email).Documents(ctx).GetAll()
+		if err != nil {
+			return sent, fmt.Errorf("failed to load digest queue for %s: %w", prefs.Email, err)
+		}
+		if len(docs) == 0 {
+			continue
+		}
+		items := make([]DigestItem, 0, len(docs))
+		for _, d := range docs {
+			var item DigestItem
+			d.DataTo(&item)
+			items = append(items, item)
+		}
+		if blocked {
+			batch := a.db.Batch()
+			for _, d := range docs {
+				batch.Delete(d.Ref)
+			}
+			if _, err := batch.Commit(ctx); err != nil {
+				log.Printf("ERROR in sendDigests: Failed to drop digest queue for %s: %v", prefs.Email, err)
+				continue
+			}
+			log.Printf("Dropped %d digest item(s) for %s, who may not be emailed", len(docs), prefs.Email)
+			for _, item := range items {
+				a.recordDeliveryOutcome(ctx, item.TriggerID, "email", DeliveryOutcome{Status: outcomeSuppressed, UpdatedAt: now})
+			}
+			continue
+		}
+
+		data, err := a.buildDigest(ctx, prefs, items, now)
+		if err != nil {
+			log.Printf("ERROR in sendDigests: %v", err)
+			continue
+		}
+		subject, plainTextContent, htmlContent, err := a.templates.RenderDigest(data)
+		if err != nil {
+			log.Printf("ERROR in sendDigests: Failed to render digest for %s: %v", prefs.Email, err)
+			continue
+		}
+		msg := EmailMessage{
+			To:         prefs.Email,
+			Subject:    subject,
+			PlainText:  plainTextContent,
+			HTML:       htmlContent,
+			Headers:    unsubscribeHeaders(prefs.Email),
+			CustomArgs: map[string]string{"kind": "digest"},
+		}
+		if err := a.mailer.SendEmail(ctx, msg); err != nil {
+			log.Printf("ERROR in sendDigests: Failed to send digest to %s: %v", prefs.Email, err)
+			continue
+		}
+
+		batch := a.db.Batch()
+		for _, d := range docs {
+			batch.Delete(d.Ref)
+		}
+		batch.Update(doc.Ref, []firestore.Update{{Path: "lastDigestAt", Value: now}})
+		if _, err := batch.Commit(ctx); err != nil {
+			log.Printf("ERROR in sendDigests: Failed to clear digest queue for %s: %v", prefs.Email, err)
+		}
+		for _, item := range items {
+			a.recordDeliveryOutcome(ctx, item.TriggerID, "email", DeliveryOutcome{Status: outcomeDelivered, Attempts: 1, UpdatedAt: now})
+			a.events.Publish(ctx, NotificationDelivered{TriggerID: item.TriggerID, SignalID: item.SignalID, Email: item.Email, Channel: "email", Digest: true, Attempts: 1, DeliveredAt: now})
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// sendDigestsHandler runs the digest job; schedule it hourly.
+func (a *App) sendDigestsHandler(w http.ResponseWriter, r *http.Request) {
+	sent, err := a.sendDigests(context.Background(), time.Now())
+	if err != nil {
+		log.Printf("ERROR in sendDigestsHandler: %v", err)
+		http.Error(w, "Failed to send digests", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent})
+}
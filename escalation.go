@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Escalation states of a trigger event. Events of signals without a policy have none.
+const (
+	escalationPending      = "pending"
+	escalationAcknowledged = "acknowledged"
+	// escalationExhausted events ran every step without being acknowledged.
+	escalationExhausted = "exhausted"
+)
+
+// maxEscalationSteps caps the steps of one policy.
+const maxEscalationSteps = 5
+
+// EscalationStep notifies one more channel if a trigger is still unacknowledged
+// AfterMinutes after it fired. Target overrides the signal's destination on that
+// channel, e.g. a teammate's email address or another Slack webhook.
+type EscalationStep struct {
+	AfterMinutes int    `firestore:"afterMinutes" json:"afterMinutes"`
+	Channel      string `firestore:"channel" json:"channel"`
+	Target       string `firestore:"target" json:"target,omitempty"`
+}
+
+// after returns the step's delay from the trigger time.
+func (s EscalationStep) after() time.Duration {
+	return time.Duration(s.AfterMinutes) * time.Minute
+}
+
+// validateEscalation checks a signal's escalation policy: at most maxEscalationSteps
+// steps with increasing delays, each on a configured channel with a valid target.
+func (a *App) validateEscalation(signal Signal) error {
+	if len(signal.Escalation) > maxEscalationSteps {
+		return fmt.Errorf("an escalation policy can have at most %d steps", maxEscalationSteps)
+	}
+	last := 0
+	for i, step := range signal.Escalation {
+		if step.AfterMinutes <= last {
+			return fmt.Errorf("escalation step %d must come after %d minutes", i+1, last)
+		}
+		last = step.AfterMinutes
+		if step.Channel == "email" {
+			if step.Target != "" {
+				if _, err := mail.ParseAddress(step.Target); err != nil {
+					return fmt.Errorf("escalation step %d: invalid email address %q", i+1, step.Target)
+				}
+			}
+			continue
+		}
+		if step.Channel == "telegram" && step.Target != "" {
+			return fmt.Errorf("escalation step %d: telegram steps go to the chat linked to the signal's address and take no target", i+1)
+		}
+		target := step.Target
+		if target == "" {
+			target = signal.Targets[step.Channel]
+		}
+		if _, err := a.validateChannels([]string{step.Channel}, map[string]string{step.Channel: target}); err != nil {
+			return fmt.Errorf("escalation step %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
+
+// startEscalation arms a trigger event's escalation timer if its signal has a policy.
+// from is when its notifications are due to be delivered.
+func (e *TriggerEvent) startEscalation(steps []EscalationStep, from time.Time) {
+	if len(steps) == 0 {
+		return
+	}
+	e.Escalation = steps
+	e.EscalationStatus = escalationPending
+	e.EscalationStartedAt = from
+	e.NextEscalationAt = from.Add(steps[0].after())
+}
+
+// escalationSignal returns the signal an escalation step delivers: the original one
+// restricted to the step's channel and pointed at the step's target.
+func escalationSignal(s Signal, step EscalationStep) Signal {
+	s.Channels = []string{step.Channel}
+	if step.Target == "" {
+		return s
+	}
+	if step.Channel == "email" {
+		s.Email = step.Target
+		return s
+	}
+	targets := map[string]string{}
+	for k, v := range s.Targets {
+		targets[k] = v
+	}
+	targets[step.Channel] = step.Target
+	s.Targets = targets
+	return s
+}
+
+// escalate runs the next step of a due trigger event in a transaction, so that
+// concurrent workers run each step once. It returns false when the event was
+// acknowledged or is no longer due.
+func (a *App) escalate(ctx context.Context, ref *firestore.DocumentRef, now time.Time) (bool, error) {
+	escalated := false
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		escalated = false
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		var event TriggerEvent
+		if err := doc.DataTo(&event); err != nil {
+			return err
+		}
+		if event.EscalationStatus != escalationPending || event.NextEscalationAt.After(now) || event.EscalationLevel >= len(event.Escalation) {
+			return nil
+		}
+		level := event.EscalationLevel + 1
+		step := event.Escalation[level-1]
+
+		signal := Signal{Email: event.Email, AssetID: event.AssetID, QuoteCurrency: event.Currency, PriceAtCreation: event.Baseline, ChangeThresholdPercentage: event.Threshold}
+		if signalDoc, err := tx.Get(a.db.Collection("signals").Doc(event.SignalID)); err == nil {
+			signalDoc.DataTo(&signal)
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		signal = escalationSignal(signal, step)
+
+		entry := OutboxEntry{
+			SignalID:      event.SignalID,
+			TriggerID:     ref.ID,
+			Escalation:    level,
+			Channel:       step.Channel,
+			Signal:        signal,
+			Price:         event.Price,
+			ChangePercent: event.ChangePercent,
+			TriggeredAt:   event.TriggeredAt,
+			Status:        outboxPending,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+			UpdatedAt:     now,
+		}
+		outcome := outcomeQueued
+		if step.Channel == "email" {
+			// A teammate gets escalations only once they confirmed their address.
+			var prefs UserPreferences
+			if prefsDoc, err := tx.Get(a.db.Collection("preferences").Doc(signal.Email)); err == nil {
+				prefsDoc.DataTo(&prefs)
+			} else if status.Code(err) != codes.NotFound {
+				return err
+			}
+			if prefs.emailBlocked() || (a.mailer != nil && !prefs.EmailVerified) {
+				outcome = outcomeSuppressed
+			}
+		}
+
+		updates := []firestore.Update{
+			{Path: "escalationLevel", Value: level},
+			{FieldPath: firestore.FieldPath{"deliveries", entry.outcomeKey()}, Value: DeliveryOutcome{Status: outcome, UpdatedAt: now}},
+		}
+		if level < len(event.Escalation) {
+			updates = append(updates, firestore.Update{Path: "nextEscalationAt", Value: event.EscalationStartedAt.Add(event.Escalation[level].after())})
+		} else {
+			updates = append(updates, firestore.Update{Path: "escalationStatus", Value: escalationExhausted})
+		}
+		if outcome == outcomeQueued {
+			if err := tx.Create(a.db.Collection("notification_outbox").NewDoc(), entry); err != nil {
+				return err
+			}
+		}
+		escalated = true
+		return tx.Update(ref, updates)
+	})
+	return escalated, err
+}
+
+// processEscalations runs every due escalation step and returns how many ran.
+func (a *App) processEscalations(ctx context.Context, now time.Time) (int, error) {
+	iter := a.db.Collection("trigger_events").
+		Where("escalationStatus", "==", escalationPending).
+		Where("nextEscalationAt", "<=", now).
+		Limit(outboxBatchSize).
+		Documents(ctx)
+	defer iter.Stop()
+	escalated := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return escalated, fmt.Errorf("failed to query escalations (check for missing index on 'escalationStatus' and 'nextEscalationAt'): %w", err)
+		}
+		ok, err := a.escalate(ctx, doc.Ref, now)
+		if err != nil {
+			log.Printf("ERROR in processEscalations: Failed to escalate trigger %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if ok {
+			escalated++
+			log.Printf("Trigger %s was not acknowledged; escalated", doc.Ref.ID)
+		}
+	}
+	return escalated, nil
+}
+
+// processEscalationsHandler runs the escalation worker; schedule it every minute.
+// Queued escalations go out with the next outbox run.
+func (a *App) processEscalationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	escalated, err := a.processEscalations(ctx, time.Now())
+	if err != nil {
+		log.Printf("ERROR in processEscalationsHandler: %v", err)
+		http.Error(w, "Failed to process escalations", http.StatusInternalServerError)
+		return
+	}
+	if escalated > 0 {
+		if _, _, err := a.processOutbox(ctx); err != nil {
+			log.Printf("ERROR in processEscalationsHandler: %v", err)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"escalated": escalated})
+}
+
+// ackRecipient names who an alert was sent to, for the acknowledgement record.
+func ackRecipient(alert Alert) string {
+	channels := alert.Signal.channels()
+	if len(channels) != 1 {
+		return strings.Join(channels, ",")
+	}
+	if channels[0] == "email" {
+		return alert.Signal.Email
+	}
+	return channels[0]
+}
+
+// ackURL is the acknowledge link in a trigger's notifications.
+func ackURL(triggerID, recipient string) string {
+	return publicBaseURL() + "/ack?token=" + url.QueryEscape(signToken("ack", triggerID+"|"+recipient))
+}
+
+// verifyAckToken checks an acknowledge token and returns its trigger and recipient.
+func verifyAckToken(token string) (triggerID, recipient string, err error) {
+	payload, err := verifyToken("ack", token)
+	if err != nil {
+		return "", "", err
+	}
+	triggerID, recipient, ok := strings.Cut(payload, "|")
+	if !ok || triggerID == "" {
+		return "", "", errors.New("malformed token")
+	}
+	return triggerID, recipient, nil
+}
+
+// acknowledge records the first acknowledgement of a trigger and stops its
+// escalation. Later acknowledgements leave the record unchanged.
+func (a *App) acknowledge(ctx context.Context, triggerID, recipient string) (TriggerEvent, error) {
+	ref := a.db.Collection("trigger_events").Doc(triggerID)
+	var event TriggerEvent
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&event); err != nil {
+			return err
+		}
+		if !event.AcknowledgedAt.IsZero() {
+			return nil
+		}
+		event.AcknowledgedAt = time.Now()
+		event.AcknowledgedBy = recipient
+		updates := []firestore.Update{
+			{Path: "acknowledgedAt", Value: event.AcknowledgedAt},
+			{Path: "acknowledgedBy", Value: recipient},
+		}
+		if event.EscalationStatus != "" {
+			event.EscalationStatus = escalationAcknowledged
+			updates = append(updates, firestore.Update{Path: "escalationStatus", Value: escalationAcknowledged})
+		}
+		return tx.Update(ref, updates)
+	})
+	event.ID = triggerID
+	return event, err
+}
+
+// ackHandler serves the acknowledge link. GET shows the trigger with a button, so
+// that link scanners cannot acknowledge alerts; POST records the acknowledgement.
+func (a *App) ackHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	triggerID, recipient, err := verifyAckToken(token)
+	if err != nil {
+		http.Error(w, "Invalid acknowledge link", http.StatusForbidden)
+		return
+	}
+	ctx := context.Background()
+	var event TriggerEvent
+	switch r.Method {
+	case http.MethodGet:
+		doc, err := a.db.Collection("trigger_events").Doc(triggerID).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, "Alert not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve alert", http.StatusInternalServerError)
+			return
+		}
+		doc.DataTo(&event)
+	case http.MethodPost:
+		event, err = a.acknowledge(ctx, triggerID, recipient)
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, "Alert not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR in ackHandler: Failed to acknowledge trigger %s: %v", triggerID, err)
+			http.Error(w, "Failed to acknowledge alert", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Trigger %s acknowledged by %s", triggerID, recipient)
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tmpl, err := template.New("acknowledge.html").Funcs(template.FuncMap{"formatPrice": formatPrice, "formatChange": formatChange}).ParseFS(templatesFS, "templates/acknowledge.html")
+	if err != nil {
+		http.Error(w, "Could not parse acknowledge template", http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, map[string]interface{}{
+		"Event":     event,
+		"Recipient": recipient,
+		"Token":     token,
+	})
+}
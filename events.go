@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Event types on the event bus. They also name the NATS subjects events are
+// published to.
+const (
+	EventPriceCollected        = "price.collected"
+	EventSignalCreated         = "signal.created"
+	EventSignalTriggered       = "signal.triggered"
+	EventNotificationDelivered = "notification.delivered"
+)
+
+// Event is implemented by every event on the bus.
+type Event interface {
+	EventType() string
+}
+
+// PriceCollected is emitted for each new price stored in price_history. Source is
+// "coingecko", "ingest" or "custom". Backfilled history is not emitted.
+type PriceCollected struct {
+	AssetID   string    `json:"assetId"`
+	Currency  string    `json:"currency"`
+	Price     float64   `json:"price"`
+	Source    string    `json:"source"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// EventType implements Event.
+func (PriceCollected) EventType() string { return EventPriceCollected }
+
+// SignalCreated is emitted when a signal is saved, whether active or waiting for
+// its owner to confirm their email address.
+type SignalCreated struct {
+	SignalID        string    `json:"signalId"`
+	Email           string    `json:"email"`
+	AssetID         string    `json:"assetId"`
+	Currency        string    `json:"currency"`
+	Threshold       float64   `json:"threshold"`
+	Direction       string    `json:"direction,omitempty"`
+	PriceAtCreation float64   `json:"priceAtCreation"`
+	Channels        []string  `json:"channels"`
+	Status          string    `json:"status"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// EventType implements Event.
+func (SignalCreated) EventType() string { return EventSignalCreated }
+
+// newSignalCreated describes a newly saved signal.
+func newSignalCreated(id string, s Signal) SignalCreated {
+	return SignalCreated{
+		SignalID:        id,
+		Email:           s.Email,
+		AssetID:         s.AssetID,
+		Currency:        s.quoteCurrency(),
+		Threshold:       s.ChangeThresholdPercentage,
+		Direction:       s.Direction,
+		PriceAtCreation: s.PriceAtCreation,
+		Channels:        s.channels(),
+		Status:          s.Status,
+		CreatedAt:       s.CreatedAt,
+	}
+}
+
+// SignalTriggered is emitted once per trigger, after its trigger event and
+// notifications are stored.
+type SignalTriggered struct {
+	TriggerID     string    `json:"triggerId"`
+	SignalID      string    `json:"signalId"`
+	Email         string    `json:"email"`
+	AssetID       string    `json:"assetId"`
+	Currency      string    `json:"currency"`
+	Baseline      float64   `json:"baseline"`
+	Price         float64   `json:"price"`
+	ChangePercent float64   `json:"changePercent"`
+	Threshold     float64   `json:"threshold"`
+	Channels      []string  `json:"channels"`
+	TriggeredAt   time.Time `json:"triggeredAt"`
+}
+
+// EventType implements Event.
+func (SignalTriggered) EventType() string { return EventSignalTriggered }
+
+// newSignalTriggered describes a stored trigger event.
+func newSignalTriggered(id string, e TriggerEvent) SignalTriggered {
+	return SignalTriggered{
+		TriggerID:     id,
+		SignalID:      e.SignalID,
+		Email:         e.Email,
+		AssetID:       e.AssetID,
+		Currency:      e.Currency,
+		Baseline:      e.Baseline,
+		Price:         e.Price,
+		ChangePercent: e.ChangePercent,
+		Threshold:     e.Threshold,
+		Channels:      e.Channels,
+		TriggeredAt:   e.TriggeredAt,
+	}
+}
+
+// NotificationDelivered is emitted when a channel accepts a notification for a
+// trigger, from the outbox or as part of a digest email.
+type NotificationDelivered struct {
+	TriggerID  string `json:"triggerId"`
+	SignalID   string `json:"signalId"`
+	Email      string `json:"email"`
+	Channel    string `json:"channel"`
+	Escalation int    `json:"escalation,omitempty"`
+	Digest     bool   `json:"digest,omitempty"`
+	Attempts   int    `json:"attempts"`
+	// DeliveredAt is when the channel accepted the notification.
+	DeliveredAt time.Time `json:"deliveredAt"`
+}
+
+// EventType implements Event.
+func (NotificationDelivered) EventType() string { return EventNotificationDelivered }
+
+// EventHandler receives events from the bus. Handlers run on the publisher's
+// goroutine, so they must not block; sinks hand events off to their own clients.
+type EventHandler func(ctx context.Context, e Event)
+
+// EventBus is the in-process event bus. Integrations subscribe to it instead of
+// polling Firestore. A nil *EventBus drops every event.
+type EventBus struct {
+	mu       sync.RWMutex
+	handlers map[string][]EventHandler
+}
+
+// NewEventBus creates a bus with no subscribers.
+func NewEventBus() *EventBus {
+	return &EventBus{handlers: map[string][]EventHandler{}}
+}
+
+// Subscribe registers a handler for one event type, or for every event with "*".
+func (b *EventBus) Subscribe(eventType string, h EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[eventType] = append(b.handlers[eventType], h)
+}
+
+// Publish passes an event to its subscribers in the order they subscribed, the
+// handlers for its type first.
+func (b *EventBus) Publish(ctx context.Context, e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.RLock()
+	handlers := append(append([]EventHandler(nil), b.handlers[e.EventType()]...), b.handlers["*"]...)
+	b.mu.RUnlock()
+	for _, h := range handlers {
+		h(ctx, e)
+	}
+}
@@ -4,17 +4,22 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"math"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 //go:embed templates/*
@@ -22,18 +27,68 @@ var templatesFS embed.FS
 
 // The structure for the Signal entity
 type Signal struct {
-	UserID                    string    `firestore:"userId"`
-	Email                     string    `firestore:"email"`
-	AssetID                   string    `firestore:"assetId"`
-	ChangeThresholdPercentage float64   `firestore:"changeThresholdPercentage"`
-	PriceAtCreation           float64   `firestore:"priceAtCreation"`
-	Status                    string    `firestore:"status"`
-	CreatedAt                 time.Time `firestore:"createdAt"`
+	UserID                    string            `firestore:"userId"`
+	Email                     string            `firestore:"email"`
+	AssetID                   string            `firestore:"assetId"`
+	ChangeThresholdPercentage float64           `firestore:"changeThresholdPercentage"`
+	Direction                 string            `firestore:"direction"`
+	PriceAtCreation           float64           `firestore:"priceAtCreation"`
+	QuoteCurrency             string            `firestore:"quoteCurrency"`
+	Channels                  []string          `firestore:"channels"`
+	Targets                   map[string]string `firestore:"targets"`
+	Status                    string            `firestore:"status"`
+	// Critical signals bypass their owner's quiet hours and rate limits.
+	Critical bool `firestore:"critical"`
+	// Escalation notifies further channels or teammates while a trigger stays
+	// unacknowledged.
+	Escalation []EscalationStep `firestore:"escalation"`
+	CreatedAt  time.Time        `firestore:"createdAt"`
+}
+
+// quoteCurrency returns the currency the signal is denominated in.
+func (s Signal) quoteCurrency() string {
+	if s.QuoteCurrency == "" {
+		return defaultCurrency
+	}
+	return s.QuoteCurrency
+}
+
+// crossed reports whether a price change meets the signal's threshold in its
+// direction: "up", "down", or either way when Direction is empty.
+func (s Signal) crossed(changePercent float64) bool {
+	switch s.Direction {
+	case "up":
+		return changePercent >= s.ChangeThresholdPercentage
+	case "down":
+		return -changePercent >= s.ChangeThresholdPercentage
+	}
+	return math.Abs(changePercent) >= s.ChangeThresholdPercentage
+}
+
+// thresholdLabel renders the threshold with its direction, e.g. "±5.00%" or "-5.00%".
+func (s Signal) thresholdLabel() string {
+	sign := "±"
+	switch s.Direction {
+	case "up":
+		sign = "+"
+	case "down":
+		sign = "-"
+	}
+	return fmt.Sprintf("%s%.2f%%", sign, s.ChangeThresholdPercentage)
+}
+
+// channels returns the delivery channels selected for the signal.
+func (s Signal) channels() []string {
+	if len(s.Channels) == 0 {
+		return []string{defaultChannel}
+	}
+	return s.Channels
 }
 
 // The struct to hold analysis results
 type AnalysisResult struct {
 	AssetId             string
+	Currency            string
 	TimeWindowHours     int
 	SimpleMovingAverage float64
 	DataPointsUsed      int
@@ -82,6 +137,82 @@ func (a *App) createUserHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{"status": "user created"})
 }
 
+// errPriceUnavailable is returned by createSignal when the baseline price cannot be fetched.
+var errPriceUnavailable = errors.New("current price unavailable")
+
+// inputError marks a signal creation failure caused by the caller's input.
+type inputError struct{ err error }
+
+func (e *inputError) Error() string { return e.err.Error() }
+func (e *inputError) Unwrap() error { return e.err }
+
+// createSignal validates a new signal, resolves its asset, records the current price
+// as its baseline and stores it. It is the single creation path shared by the API,
+// the web form and the chat integrations, and returns the new signal's ID.
+func (a *App) createSignal(ctx context.Context, signal Signal) (string, error) {
+	assetID, err := a.resolveAssetID(ctx, signal.AssetID)
+	if err != nil {
+		return "", &inputError{err}
+	}
+	signal.AssetID = assetID
+	if signal.ChangeThresholdPercentage <= 0 {
+		return "", &inputError{errors.New("changeThresholdPercentage must be greater than zero")}
+	}
+	if signal.Direction != "" && signal.Direction != "up" && signal.Direction != "down" {
+		return "", &inputError{errors.New("direction must be up, down or empty for either")}
+	}
+	if signal.QuoteCurrency, err = normalizeCurrency(signal.QuoteCurrency); err != nil {
+		return "", &inputError{err}
+	}
+	if err := a.fillTelegramTarget(ctx, &signal); err != nil {
+		return "", err
+	}
+	if err := a.requirePushSubscription(ctx, signal); err != nil {
+		return "", err
+	}
+	if signal.Channels, err = a.validateChannels(signal.Channels, signal.Targets); err != nil {
+		return "", &inputError{err}
+	}
+	if err := a.validateEscalation(signal); err != nil {
+		return "", &inputError{err}
+	}
+	currentPrice, err := a.fetchCurrentPrice(ctx, signal.AssetID, signal.QuoteCurrency)
+	if err != nil {
+		log.Printf("ERROR in createSignal: Failed to fetch current price for %s: %v", signal.AssetID, err)
+		return "", fmt.Errorf("%w: %v", errPriceUnavailable, err)
+	}
+	signal.PriceAtCreation = currentPrice
+	signal.Status = "active"
+	if usesEmail(signal) && a.mailer != nil {
+		prefs, err := a.getPreferences(ctx, signal.Email)
+		if err != nil {
+			return "", err
+		}
+		if !prefs.EmailVerified {
+			signal.Status = statusPendingVerification
+		}
+	}
+	signal.CreatedAt = time.Now()
+	ref, _, err := a.db.Collection("signals").Add(ctx, signal)
+	if err != nil {
+		return "", err
+	}
+	a.events.Publish(ctx, newSignalCreated(ref.ID, signal))
+	if signal.Status == statusPendingVerification {
+		if err := a.ensureVerificationSent(ctx, signal.Email); err != nil {
+			log.Printf("ERROR in createSignal: %v", err)
+		}
+	}
+	for _, step := range signal.Escalation {
+		if step.Channel == "email" && step.Target != "" && step.Target != signal.Email {
+			if err := a.ensureVerificationSent(ctx, step.Target); err != nil {
+				log.Printf("ERROR in createSignal: %v", err)
+			}
+		}
+	}
+	return ref.ID, nil
+}
+
 // createSignalHandler handles the creation of a new signal via API.
 func (a *App) createSignalHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
@@ -93,96 +224,322 @@ func (a *App) createSignalHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	priceData, err := a.priceFetcher(signal.AssetID, "https://api.coingecko.com/api/v3/simple/price?ids=%s&vs_currencies=usd")
-	if err != nil {
-		http.Error(w, "Failed to fetch current price for signal creation", http.StatusInternalServerError)
+	if !authorizeTelegram(r, &signal) {
+		http.Error(w, telegramUnauthorizedMessage, http.StatusUnauthorized)
 		return
 	}
-	currentPrice, ok := priceData[signal.AssetID]["usd"].(float64)
-	if !ok {
-		http.Error(w, "Failed to parse current price", http.StatusInternalServerError)
+	id, err := a.createSignal(context.Background(), signal)
+	var inErr *inputError
+	switch {
+	case errors.As(err, &inErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
-	}
-	signal.PriceAtCreation = currentPrice
-	signal.Status = "active"
-	signal.CreatedAt = time.Now()
-	_, _, err = a.db.Collection("signals").Add(context.Background(), signal)
-	if err != nil {
+	case errors.Is(err, errPriceUnavailable):
+		http.Error(w, "Failed to fetch current price for signal creation", http.StatusInternalServerError)
+		return
+	case err != nil:
 		http.Error(w, "Failed to create signal", http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "signal created"})
+	json.NewEncoder(w).Encode(map[string]string{"status": "signal created", "id": id})
 }
 
-// collectDataHandler fetches the current price of an asset and checks active signals.
+// collectDataHandler fetches the current price of every watched asset in every quote
+// currency in use and checks active signals.
 func (a *App) collectDataHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	assetID := "bitcoin"
-	priceData, err := a.priceFetcher(assetID, "https://api.coingecko.com/api/v3/simple/price?ids=%s&vs_currencies=usd")
+	assetIDs, currencies, err := a.watchedAssetIDs(ctx)
+	if err != nil {
+		log.Printf("ERROR in collectDataHandler: Failed to list watched assets: %v", err)
+		http.Error(w, "Failed to query signals", http.StatusInternalServerError)
+		return
+	}
+	priceData, err := a.priceFetcher(strings.Join(assetIDs, ","), coinGeckoSimplePriceURL(currencies))
 	if err != nil {
 		log.Printf("ERROR in collectDataHandler: Failed to fetch price data: %v", err)
 		http.Error(w, "Failed to fetch price data", http.StatusInternalServerError)
 		return
 	}
-	currentPrice, ok := priceData[assetID]["usd"].(float64)
-	if !ok {
-		log.Printf("ERROR in collectDataHandler: Failed to parse price from CoinGecko response: %v", priceData)
+	collected := map[string]map[string]float64{}
+	now := time.Now()
+	for _, assetID := range assetIDs {
+		prices := map[string]float64{}
+		for _, currency := range currencies {
+			currentPrice, ok := priceData[assetID][currency].(float64)
+			if !ok {
+				log.Printf("ERROR in collectDataHandler: Failed to parse %s price for %s from CoinGecko response: %v", currency, assetID, priceData)
+				continue
+			}
+			_, _, err = a.db.Collection("price_history").Add(ctx, map[string]interface{}{"assetId": assetID, "price": currentPrice, "currency": currency, "timestamp": now})
+			if err != nil {
+				log.Printf("ERROR in collectDataHandler: Failed to add document to price_history: %v", err)
+				http.Error(w, "Failed to write to database", http.StatusInternalServerError)
+				return
+			}
+			a.events.Publish(ctx, PriceCollected{AssetID: assetID, Currency: currency, Price: currentPrice, Source: "coingecko", Timestamp: now})
+			prices[currency] = currentPrice
+		}
+		if len(prices) == 0 {
+			continue
+		}
+		if err := a.evaluateSignals(ctx, assetID, prices); err != nil {
+			log.Printf("ERROR in collectDataHandler: %v", err)
+			http.Error(w, "Failed to query signals", http.StatusInternalServerError)
+			return
+		}
+		collected[assetID] = prices
+	}
+	if len(collected) == 0 {
 		http.Error(w, "Could not parse current price from external API", http.StatusInternalServerError)
 		return
 	}
-	_, _, err = a.db.Collection("price_history").Add(ctx, map[string]interface{}{"assetId": assetID, "price": currentPrice, "timestamp": time.Now()})
-	if err != nil {
-		log.Printf("ERROR in collectDataHandler: Failed to add document to price_history: %v", err)
-		http.Error(w, "Failed to write to database", http.StatusInternalServerError)
-		return
+	a.deliverQueued(ctx, "collectDataHandler")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "data collected and signals checked", "price": collected["bitcoin"][defaultCurrency], "prices": collected})
+}
+
+// watchedAssetIDs returns bitcoin plus every CoinGecko asset referenced by an active
+// signal, and usd plus every quote currency those signals use. Custom sources are left
+// out; /collect-sources polls those on their own schedule.
+func (a *App) watchedAssetIDs(ctx context.Context) ([]string, []string, error) {
+	custom := map[string]bool{}
+	srcIter := a.db.Collection("custom_sources").Documents(ctx)
+	defer srcIter.Stop()
+	for {
+		doc, err := srcIter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		custom[doc.Ref.ID] = true
 	}
+
+	seen := map[string]bool{"bitcoin": true}
+	assetIDs := []string{"bitcoin"}
+	seenCurrency := map[string]bool{defaultCurrency: true}
+	currencies := []string{defaultCurrency}
+	iter := a.db.Collection("signals").Where("status", "==", "active").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var s Signal
+		doc.DataTo(&s)
+		if s.AssetID == "" || custom[s.AssetID] {
+			continue
+		}
+		if !seen[s.AssetID] {
+			seen[s.AssetID] = true
+			assetIDs = append(assetIDs, s.AssetID)
+		}
+		if c := s.quoteCurrency(); !seenCurrency[c] {
+			seenCurrency[c] = true
+			currencies = append(currencies, c)
+		}
+	}
+	sort.Strings(assetIDs[1:])
+	sort.Strings(currencies[1:])
+	return assetIDs, currencies, nil
+}
+
+// evaluateSignals checks every active signal on an asset against the current price in
+// the signal's quote currency, notifying the owner and marking the signal "triggered"
+// when its threshold is met. prices is keyed by currency code. Email signals of
+// owners who have not confirmed their address are never evaluated.
+func (a *App) evaluateSignals(ctx context.Context, assetID string, prices map[string]float64) error {
 	iter := a.db.Collection("signals").Where("assetId", "==", assetID).Where("status", "==", "active").Documents(ctx)
 	defer iter.Stop()
+	owners := map[string]UserPreferences{}
 	for {
 		doc, err := iter.Next()
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			log.Printf("ERROR in collectDataHandler: Failed to iterate signals (check for missing index on 'assetId' and 'status'): %v", err)
-			http.Error(w, "Failed to query signals", http.StatusInternalServerError)
-			return
+			return fmt.Errorf("failed to iterate signals (check for missing index on 'assetId' and 'status'): %w", err)
 		}
 		var s Signal
 		doc.DataTo(&s)
+		prefs, ok := owners[s.Email]
+		if !ok {
+			if prefs, err = a.getPreferences(ctx, s.Email); err != nil {
+				log.Printf("Failed to load preferences for %s; skipping signal %s: %v", s.Email, doc.Ref.ID, err)
+				continue
+			}
+			owners[s.Email] = prefs
+		}
+		if prefs.Paused {
+			continue
+		}
+		// Signals created before verification was required are held here.
+		if usesEmail(s) && a.mailer != nil && !prefs.EmailVerified {
+			a.holdForVerification(ctx, doc.Ref, s.Email)
+			continue
+		}
+		currentPrice, ok := prices[s.quoteCurrency()]
+		if !ok {
+			continue
+		}
 		priceChange := ((currentPrice - s.PriceAtCreation) / s.PriceAtCreation) * 100
-		absPriceChange := math.Abs(priceChange)
-		log.Printf("Checking signal for user %s. Asset: %s. Current Change: %.2f%%. Threshold: %.2f%%", s.UserID, s.AssetID, absPriceChange, s.ChangeThresholdPercentage)
-		if absPriceChange >= s.ChangeThresholdPercentage {
+		log.Printf("Checking signal for user %s. Asset: %s. Current Change: %.2f%%. Threshold: %s", s.UserID, s.AssetID, priceChange, s.thresholdLabel())
+		if s.crossed(priceChange) {
 			log.Printf("!!! SIGNAL TRIGGERED for user %s! Price moved by %.2f%% !!!", s.UserID, priceChange)
-			subject := fmt.Sprintf("Price Alert for %s", s.AssetID)
-			sendEmailNotification(s.Email, subject, s.AssetID, priceChange, currentPrice)
-			_, err := doc.Ref.Update(ctx, []firestore.Update{{Path: "status", Value: "triggered"}})
+			alert := Alert{SignalID: doc.Ref.ID, Signal: s, Price: currentPrice, ChangePercent: priceChange, TriggeredAt: time.Now()}
+			won, err := a.triggerSignal(ctx, doc.Ref, alert)
 			if err != nil {
-				log.Printf("Failed to update signal status: %v", err)
+				log.Printf("Failed to record trigger for signal %s: %v", doc.Ref.ID, err)
+			} else if !won {
+				log.Printf("Signal %s was already triggered by a concurrent run; skipping", doc.Ref.ID)
 			}
 		}
 	}
-	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(map[string]interface{}{"status": "data collected and signals checked", "price": currentPrice})
+	return nil
 }
 
-// analysisHandler calculates and returns a simple analysis of the price data.
-func (a *App) analysisHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := context.Background()
-	assetID := "bitcoin"
-	twentyFourHoursAgo := time.Now().Add(-24 * time.Hour)
-	iter := a.db.Collection("price_history").Where("assetId", "==", assetID).Where("timestamp", ">=", twentyFourHoursAgo).Documents(ctx)
+// triggerSignal moves an active signal to "triggered" and queues its notifications
+// in one transaction. Overlapping collection runs can both see the signal as active,
+// but only the one whose transaction commits first wins; the others get false and
+// queue nothing.
+//
+// The owner's preferences are read and updated in the same transaction, so that
+// quiet hours and rate limits see every alert: email for digest users goes to
+// digest_queue, held alerts are queued for the end of quiet hours, and alerts over a
+// rate limit are folded into digest_queue for a summary. Users who unsubscribed or
+// whose address was suspended get no email at all. What happened on each channel is
+// recorded in a trigger event, which later delivery attempts update.
+func (a *App) triggerSignal(ctx context.Context, ref *firestore.DocumentRef, alert Alert) (bool, error) {
+	prefsRef := a.db.Collection("preferences").Doc(alert.Signal.Email)
+	triggerRef := a.db.Collection("trigger_events").NewDoc()
+	won := false
+	var published TriggerEvent
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		won = false
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if state, _ := doc.Data()["status"].(string); state != "active" {
+			return nil
+		}
+		prefs := UserPreferences{Email: alert.Signal.Email}
+		prefsDoc, err := tx.Get(prefsRef)
+		if err == nil {
+			prefsDoc.DataTo(&prefs)
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+
+		plan, at, recent := planDelivery(prefs, alert.Signal.Critical, alert.TriggeredAt)
+		if err := tx.Update(ref, []firestore.Update{{Path: "status", Value: "triggered"}}); err != nil {
+			return err
+		}
+		if prefsDoc != nil && prefsDoc.Exists() {
+			err = tx.Update(prefsRef, []firestore.Update{{Path: "recentAlerts", Value: recent}})
+		} else {
+			err = tx.Set(prefsRef, map[string]interface{}{"email": alert.Signal.Email, "recentAlerts": recent}, firestore.MergeAll)
+		}
+		if err != nil {
+			return err
+		}
+
+		event := newTriggerEvent(alert)
+		queued := false
+		switch plan {
+		case planDrop:
+			log.Printf("Signal %s triggered during quiet hours for %s; notification dropped", ref.ID, alert.Signal.Email)
+			for _, channel := range event.Channels {
+				event.setOutcome(channel, outcomeDropped)
+			}
+		case planFold:
+			// Only email has a summary to fold the alert into, and only when the signal
+			// emails a confirmed address. Other channels skip it.
+			log.Printf("Signal %s is over the rate limit for %s; folded into the next summary", ref.ID, alert.Signal.Email)
+			for _, channel := range event.Channels {
+				event.setOutcome(channel, outcomeDropped)
+			}
+			if !usesEmail(alert.Signal) {
+				break
+			}
+			if prefs.emailBlocked() || !prefs.EmailVerified {
+				event.setOutcome("email", outcomeSuppressed)
+				break
+			}
+			event.setOutcome("email", outcomeFolded)
+			if err := tx.Create(a.db.Collection("digest_queue").NewDoc(), newDigestItem(alert, triggerRef.ID)); err != nil {
+				return err
+			}
+		default:
+			for _, entry := range newOutboxEntries(alert) {
+				if prefs.emailBlocked() && entry.Channel == "email" {
+					event.setOutcome(entry.Channel, outcomeSuppressed)
+					continue
+				}
+				if prefs.wantsDigest() && entry.Channel == "email" {
+					event.setOutcome(entry.Channel, outcomeDigest)
+					if err := tx.Create(a.db.Collection("digest_queue").NewDoc(), newDigestItem(alert, triggerRef.ID)); err != nil {
+						return err
+					}
+					continue
+				}
+				if plan == planHold {
+					event.setOutcome(entry.Channel, outcomeHeld)
+				} else {
+					event.setOutcome(entry.Channel, outcomeQueued)
+				}
+				entry.TriggerID = triggerRef.ID
+				entry.NextAttemptAt = at
+				if err := tx.Create(a.db.Collection("notification_outbox").NewDoc(), entry); err != nil {
+					return err
+				}
+				queued = true
+			}
+		}
+		// Escalation only makes sense once someone has been alerted and could have
+		// acknowledged: not for alerts that were dropped, folded into a summary or only
+		// added to a digest, and for held alerts not before quiet hours end.
+		if queued {
+			event.startEscalation(alert.Signal.Escalation, at)
+		}
+		if err := tx.Create(triggerRef, event); err != nil {
+			return err
+		}
+		published = event
+		won = true
+		return nil
+	})
+	if won && err == nil {
+		a.events.Publish(ctx, newSignalTriggered(triggerRef.ID, published))
+	}
+	return won, err
+}
+
+// analyzePrices computes the simple moving average of an asset's price in one
+// currency over the trailing window.
+func (a *App) analyzePrices(ctx context.Context, assetID, currency string, window time.Duration) (AnalysisResult, error) {
+	iter := a.db.Collection("price_history").Where("assetId", "==", assetID).Where("timestamp", ">=", time.Now().Add(-window)).Documents(ctx)
 	defer iter.Stop()
 	var totalPrice float64
 	var count int
 	for {
 		doc, err := iter.Next()
-		if err != nil {
+		if err == iterator.Done {
 			break
 		}
+		if err != nil {
+			return AnalysisResult{}, err
+		}
 		priceData := doc.Data()
+		if pointCurrency(priceData) != currency {
+			continue
+		}
 		price, ok := priceData["price"].(float64)
 		if !ok {
 			continue
@@ -191,11 +548,40 @@ func (a *App) analysisHandler(w http.ResponseWriter, r *http.Request) {
 		count++
 	}
 	if count == 0 {
+		return AnalysisResult{}, nil
+	}
+	return AnalysisResult{
+		AssetId:             assetID,
+		Currency:            currency,
+		TimeWindowHours:     int(window.Hours()),
+		SimpleMovingAverage: totalPrice / float64(count),
+		DataPointsUsed:      count,
+	}, nil
+}
+
+// analysisHandler calculates and returns a simple analysis of the price data.
+func (a *App) analysisHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	assetID := r.URL.Query().Get("assetId")
+	if assetID == "" {
+		assetID = "bitcoin"
+	}
+	currency, err := normalizeCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	analysis, err := a.analyzePrices(ctx, assetID, currency, 24*time.Hour)
+	if err != nil {
+		log.Printf("ERROR in analysisHandler: Failed to read price history: %v", err)
+		http.Error(w, "Failed to retrieve price history for analysis", http.StatusInternalServerError)
+		return
+	}
+	if analysis.DataPointsUsed == 0 {
 		http.Error(w, "Not enough data for analysis", http.StatusNotFound)
 		return
 	}
-	averagePrice := totalPrice / float64(count)
-	response := map[string]interface{}{"assetId": assetID, "time_window_hours": 24, "simple_moving_average": averagePrice, "data_points_used": count}
+	response := map[string]interface{}{"assetId": assetID, "currency": currency, "time_window_hours": analysis.TimeWindowHours, "simple_moving_average": analysis.SimpleMovingAverage, "data_points_used": analysis.DataPointsUsed}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(response)
@@ -208,7 +594,12 @@ func (a *App) showNewSignalFormHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	tmpl.Execute(w, nil)
+	channels := []string{defaultChannel}
+	if a.channels != nil {
+		channels = a.channels.Channels()
+	}
+	// A preference token from the signals page is passed on, as Telegram signals need it.
+	tmpl.Execute(w, map[string]interface{}{"Currencies": currencyCodes(), "Channels": channels, "Token": r.URL.Query().Get("token")})
 }
 
 // handleCreateSignalForm processes the form submission from the UI.
@@ -223,39 +614,58 @@ func (a *App) handleCreateSignalForm(w http.ResponseWriter, r *http.Request) {
 	}
 
 	email := r.FormValue("email")
-	assetID := r.FormValue("assetId")
 	threshold, _ := strconv.ParseFloat(r.FormValue("threshold"), 64)
-
-	// Fetch current price
-	priceData, err := a.priceFetcher(assetID, "https://api.coingecko.com/api/v3/simple/price?ids=%s&vs_currencies=usd")
-	if err != nil {
-		http.Error(w, "Could not fetch current price", http.StatusInternalServerError)
-		return
-	}
-	currentPrice, ok := priceData[assetID]["usd"].(float64)
-	if !ok {
-		http.Error(w, "Could not parse current price", http.StatusInternalServerError)
-		return
+	targets := map[string]string{}
+	for _, c := range r.Form["channels"] {
+		if t := strings.TrimSpace(r.FormValue("target_" + c)); t != "" {
+			targets[c] = t
+		}
 	}
 
 	// Save signal to Firestore
 	signal := Signal{
 		UserID:                    email,
 		Email:                     email,
-		AssetID:                   assetID,
+		AssetID:                   r.FormValue("assetId"),
 		ChangeThresholdPercentage: threshold,
-		PriceAtCreation:           currentPrice,
-		Status:                    "active",
-		CreatedAt:                 time.Now(),
+		Direction:                 r.FormValue("direction"),
+		QuoteCurrency:             r.FormValue("currency"),
+		Channels:                  r.Form["channels"],
+		Targets:                   targets,
+		Critical:                  r.FormValue("critical") == "on",
 	}
-	_, _, err = a.db.Collection("signals").Add(context.Background(), signal)
-	if err != nil {
+	if channel := r.FormValue("escalate_channel"); channel != "" {
+		minutes, err := strconv.Atoi(r.FormValue("escalate_minutes"))
+		if err != nil {
+			http.Error(w, "Escalation delay must be a whole number of minutes", http.StatusBadRequest)
+			return
+		}
+		signal.Escalation = []EscalationStep{{AfterMinutes: minutes, Channel: channel, Target: strings.TrimSpace(r.FormValue("escalate_target"))}}
+	}
+	if !authorizeTelegram(r, &signal) {
+		http.Error(w, telegramUnauthorizedMessage, http.StatusUnauthorized)
+		return
+	}
+	_, err := a.createSignal(context.Background(), signal)
+	var inErr *inputError
+	switch {
+	case errors.As(err, &inErr):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, errPriceUnavailable):
+		http.Error(w, "Could not fetch current price", http.StatusInternalServerError)
+		return
+	case err != nil:
 		http.Error(w, "Could not save signal to database", http.StatusInternalServerError)
 		return
 	}
 
 	// Redirect user to their signals page after creation
-	http.Redirect(w, r, "/signals/"+email, http.StatusSeeOther)
+	target := "/signals/" + url.PathEscape(email)
+	if token := r.URL.Query().Get("token"); token != "" {
+		target += "?token=" + url.QueryEscape(token)
+	}
+	http.Redirect(w, r, target, http.StatusSeeOther)
 }
 
 // viewUserSignalsHandler fetches and displays all signals for a given user.
@@ -280,52 +690,63 @@ func (a *App) viewUserSignalsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		var s Signal
 		doc.DataTo(&s)
+		s.QuoteCurrency = s.quoteCurrency()
 		activeSignals = append(activeSignals, s)
 	}
 	iterSignals.Stop()
 
-	assetID := "bitcoin"
-	twentyFourHoursAgo := time.Now().Add(-24 * time.Hour)
-	iterAnalysis := a.db.Collection("price_history").Where("assetId", "==", assetID).Where("timestamp", ">=", twentyFourHoursAgo).Documents(ctx)
-	var totalPrice float64
-	var count int
-	for {
-		doc, err := iterAnalysis.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			http.Error(w, "Failed to retrieve price history for analysis", http.StatusInternalServerError)
-			return
-		}
-		priceData := doc.Data()
-		price, ok := priceData["price"].(float64)
-		if !ok {
-			continue
-		}
-		totalPrice += price
-		count++
+	// Show the analysis in the requested currency, or the one the user's signals use.
+	currency, err := normalizeCurrency(r.URL.Query().Get("currency"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.URL.Query().Get("currency") == "" && len(activeSignals) > 0 {
+		currency = activeSignals[0].quoteCurrency()
+	}
+	analysisData, err := a.analyzePrices(ctx, "bitcoin", currency, 24*time.Hour)
+	if err != nil {
+		http.Error(w, "Failed to retrieve price history for analysis", http.StatusInternalServerError)
+		return
 	}
-	iterAnalysis.Stop()
 
-	analysisData := AnalysisResult{}
-	if count > 0 {
-		analysisData = AnalysisResult{
-			AssetId:             assetID,
-			TimeWindowHours:     24,
-			SimpleMovingAverage: totalPrice / float64(count),
-			DataPointsUsed:      count,
-		}
+	prefs, err := a.getPreferences(ctx, email)
+	if err != nil {
+		http.Error(w, "Failed to retrieve preferences", http.StatusInternalServerError)
+		return
+	}
+	triggers, err := a.triggerHistory(ctx, email, "", 20)
+	if err != nil {
+		log.Printf("ERROR in viewUserSignalsHandler: %v", err)
+		http.Error(w, "Failed to retrieve trigger history", http.StatusInternalServerError)
+		return
+	}
+	pending, err := a.db.Collection("signals").Where("email", "==", email).Where("status", "==", statusPendingVerification).Documents(ctx).GetAll()
+	if err != nil {
+		http.Error(w, "Failed to retrieve signals", http.StatusInternalServerError)
+		return
+	}
+	// The settings form is only shown to a visitor who has proven they own the
+	// address, and it carries their token to /preferences.
+	token := ""
+	if _, ok := requestEmail(r, email); ok {
+		token = r.URL.Query().Get("token")
 	}
 
 	// Combine all data for the template
 	pageData := map[string]interface{}{
-		"Email":         email,
-		"ActiveSignals": activeSignals,
-		"Analysis":      analysisData,
+		"Email":          email,
+		"ActiveSignals":  activeSignals,
+		"Analysis":       analysisData,
+		"WebPushEnabled": a.webPush != nil,
+		"Preferences":    prefs,
+		"Delivery":       prefs.delivery(),
+		"PendingSignals": len(pending),
+		"Triggers":       triggers,
+		"Token":          token,
 	}
 
-	tmpl, err := template.ParseFS(templatesFS, "templates/user_page.html")
+	tmpl, err := template.New("user_page.html").Funcs(template.FuncMap{"formatPrice": formatPrice, "formatChange": formatChange}).ParseFS(templatesFS, "templates/user_page.html")
 	if err != nil {
 		http.Error(w, "Could not parse user page template", http.StatusInternalServerError)
 		return
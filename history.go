@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+// Delivery outcomes recorded per channel on a trigger event. Outbox deliveries start
+// as queued or held and end as delivered, failed or suppressed.
+const (
+	outcomeQueued     = "queued"
+	outcomeHeld       = "held"
+	outcomeDigest     = "digest"
+	outcomeFolded     = "folded"
+	outcomeDropped    = "dropped"
+	outcomeSuppressed = "suppressed"
+	outcomeRetrying   = "retrying"
+	outcomeDelivered  = "delivered"
+	outcomeFailed     = "failed"
+)
+
+// outboxOutcomes maps an outbox state after a delivery attempt to its outcome.
+var outboxOutcomes = map[string]string{
+	outboxPending:   outcomeRetrying,
+	outboxDelivered: outcomeDelivered,
+	outboxDead:      outcomeFailed,
+	outboxCancelled: outcomeSuppressed,
+}
+
+// DeliveryOutcome is what happened to a trigger on one channel.
+type DeliveryOutcome struct {
+	Status   string `firestore:"status" json:"status"`
+	Attempts int    `firestore:"attempts" json:"attempts,omitempty"`
+	// LastError is the last failure, redacted by redactDeliveryError.
+	LastError string    `firestore:"lastError" json:"lastError,omitempty"`
+	UpdatedAt time.Time `firestore:"updatedAt" json:"updatedAt"`
+}
+
+// TriggerEvent records one firing of a signal in trigger_events: the prices it fired
+// at and the delivery outcome on each of its channels.
+type TriggerEvent struct {
+	ID            string                     `firestore:"-" json:"id"`
+	SignalID      string                     `firestore:"signalId" json:"signalId"`
+	Email         string                     `firestore:"email" json:"email"`
+	AssetID       string                     `firestore:"assetId" json:"assetId"`
+	Currency      string                     `firestore:"currency" json:"currency"`
+	Baseline      float64                    `firestore:"baseline" json:"baseline"`
+	Price         float64                    `firestore:"price" json:"price"`
+	ChangePercent float64                    `firestore:"changePercent" json:"changePercent"`
+	Threshold     float64                    `firestore:"threshold" json:"threshold"`
+	Channels      []string                   `firestore:"channels" json:"channels"`
+	Deliveries    map[string]DeliveryOutcome `firestore:"deliveries" json:"deliveries"`
+	TriggeredAt   time.Time                  `firestore:"triggeredAt" json:"triggeredAt"`
+	// Escalation is the signal's policy when it fired. Step delays count from
+	// EscalationStartedAt, when the first notification was due to go out, which is
+	// the end of quiet hours for held alerts. EscalationLevel counts the steps run so
+	// far and NextEscalationAt is when the next one is due.
+	Escalation          []EscalationStep `firestore:"escalation" json:"escalation,omitempty"`
+	EscalationStatus    string           `firestore:"escalationStatus" json:"escalationStatus,omitempty"`
+	EscalationStartedAt time.Time        `firestore:"escalationStartedAt" json:"escalationStartedAt,omitempty"`
+	EscalationLevel     int              `firestore:"escalationLevel" json:"escalationLevel,omitempty"`
+	NextEscalationAt    time.Time        `firestore:"nextEscalationAt" json:"nextEscalationAt,omitempty"`
+	AcknowledgedAt      time.Time        `firestore:"acknowledgedAt" json:"acknowledgedAt,omitempty"`
+	AcknowledgedBy      string           `firestore:"acknowledgedBy" json:"acknowledgedBy,omitempty"`
+}
+
+// newTriggerEvent records an alert with no delivery outcomes yet.
+func newTriggerEvent(alert Alert) TriggerEvent {
+	return TriggerEvent{
+		SignalID:      alert.SignalID,
+		Email:         alert.Signal.Email,
+		AssetID:       alert.Signal.AssetID,
+		Currency:      alert.Signal.quoteCurrency(),
+		Baseline:      alert.Signal.PriceAtCreation,
+		Price:         alert.Price,
+		ChangePercent: alert.ChangePercent,
+		Threshold:     alert.Signal.ChangeThresholdPercentage,
+		Channels:      alert.Signal.channels(),
+		Deliveries:    map[string]DeliveryOutcome{},
+		TriggeredAt:   alert.TriggeredAt,
+	}
+}
+
+// setOutcome records the initial outcome on a channel.
+func (e *TriggerEvent) setOutcome(channel, outcome string) {
+	e.Deliveries[channel] = DeliveryOutcome{Status: outcome, UpdatedAt: e.TriggeredAt}
+}
+
+// recordDeliveryOutcome updates one delivery's outcome on a trigger event. Failures
+// are only logged, since the delivery itself has already happened.
+func (a *App) recordDeliveryOutcome(ctx context.Context, triggerID, key string, outcome DeliveryOutcome) {
+	if triggerID == "" {
+		return
+	}
+	_, err := a.db.Collection("trigger_events").Doc(triggerID).Update(ctx, []firestore.Update{
+		{FieldPath: firestore.FieldPath{"deliveries", key}, Value: outcome},
+	})
+	if err != nil {
+		log.Printf("Failed to record %s delivery outcome for trigger %s: %v", key, triggerID, err)
+	}
+}
+
+// triggerHistory returns a user's trigger events, newest first, optionally for one signal.
+func (a *App) triggerHistory(ctx context.Context, email, signalID string, limit int) ([]TriggerEvent, error) {
+	q := a.db.Collection("trigger_events").Where("email", "==", email)
+	if signalID != "" {
+		q = q.Where("signalId", "==", signalID)
+	}
+	iter := q.OrderBy("triggeredAt", firestore.Desc).Limit(limit).Documents(ctx)
+	defer iter.Stop()
+	events := []TriggerEvent{}
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to query trigger history (check for missing index on 'email' and 'triggeredAt'): %w", err)
+		}
+		var e TriggerEvent
+		doc.DataTo(&e)
+		e.ID = doc.Ref.ID
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// triggerHistoryHandler serves GET /triggers?email=&signalId=&limit= with a user's
+// trigger events and their delivery outcomes, newest first. The caller must prove
+// they own the address with requestEmail.
+func (a *App) triggerHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	email, ok := requestEmail(r, q.Get("email"))
+	if !ok {
+		http.Error(w, "Open your trigger history from the preference center linked in any of our emails", http.StatusUnauthorized)
+		return
+	}
+	limit := 50
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > 500 {
+			http.Error(w, "limit must be between 1 and 500", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	events, err := a.triggerHistory(context.Background(), email, q.Get("signalId"), limit)
+	if err != nil {
+		log.Printf("ERROR in triggerHistoryHandler: %v", err)
+		http.Error(w, "Failed to retrieve trigger history", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// emailCommandHelp is the reply to HELP and to unrecognised commands.
+const emailCommandHelp = `Send one command per email, on the first line or in the subject:
+
+bitcoin [up|down] 5% [currency] - create an alert, e.g. "bitcoin down 5%"
+LIST - list your alerts
+PAUSE / RESUME - pause or resume all alerts; reply to an alert email to change only that alert
+STOP / START - stop or restart all email from PricePulse
+HELP - show this message`
+
+// inboundReplyAddress is the Reply-To of alert emails: INBOUND_EMAIL_ADDRESS with the
+// signal ID as a plus tag (alerts+ID@example.com), so that a reply names its signal.
+// It returns "" when inbound email is not configured.
+func inboundReplyAddress(signalID string) string {
+	address := os.Getenv("INBOUND_EMAIL_ADDRESS")
+	local, domain, ok := strings.Cut(address, "@")
+	if !ok {
+		return ""
+	}
+	if signalID == "" {
+		return address
+	}
+	return local + "+" + signalID + "@" + domain
+}
+
+// inboundSignalTag returns the signal ID from the plus-addressed recipient among
+// the "to" addresses, or "" if the email was sent to the plain inbound address.
+func inboundSignalTag(to string) string {
+	local, domain, ok := strings.Cut(os.Getenv("INBOUND_EMAIL_ADDRESS"), "@")
+	if !ok {
+		return ""
+	}
+	addrs, err := mail.ParseAddressList(to)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range addrs {
+		l, d, _ := strings.Cut(addr.Address, "@")
+		tag, ok := strings.CutPrefix(l, local+"+")
+		if ok && strings.EqualFold(d, domain) && tag != "" {
+			return tag
+		}
+	}
+	return ""
+}
+
+// emailCommandLine returns the command in an inbound email: the first line of the
+// body above any quoted text, or the subject without its "Re:" prefixes.
+func emailCommandLine(subject, text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, ">") || (strings.HasPrefix(line, "On ") && strings.HasSuffix(line, "wrote:")) || line == "--" {
+			break
+		}
+		if line != "" {
+			return line
+		}
+	}
+	subject = strings.TrimSpace(subject)
+	for {
+		prefix, rest, ok := strings.Cut(subject, ":")
+		switch strings.ToLower(strings.TrimSpace(prefix)) {
+		case "re", "aw", "fw", "fwd":
+			if ok {
+				subject = strings.TrimSpace(rest)
+				continue
+			}
+		}
+		return subject
+	}
+}
+
+// senderAuthenticated reports whether SendGrid found a passing DKIM signature for the
+// domain of the From address, or a parent of it, as DMARC alignment requires. SPF is
+// not enough: it covers the envelope sender, which need not match From. The dkim
+// field looks like "{@example.com : pass}".
+func senderAuthenticated(dkim, sender string) bool {
+	_, domain, ok := strings.Cut(sender, "@")
+	if !ok || domain == "" {
+		return false
+	}
+	domain = strings.ToLower(domain)
+	for _, result := range strings.Split(strings.Trim(dkim, "{}"), ",") {
+		d, verdict, ok := strings.Cut(result, ":")
+		d = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(d), "@"))
+		if !ok || d == "" || !strings.EqualFold(strings.TrimSpace(verdict), "pass") {
+			continue
+		}
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// inboundAuthorized checks the secret query parameter configured in the Inbound Parse
+// destination URL, as SendGrid does not sign parsed emails.
+func inboundAuthorized(r *http.Request) bool {
+	secret := os.Getenv("INBOUND_PARSE_SECRET")
+	given := r.URL.Query().Get("secret")
+	return secret != "" && subtle.ConstantTimeCompare([]byte(given), []byte(secret)) == 1
+}
+
+// inboundEmailHandler receives emails from SendGrid Inbound Parse and runs the
+// command they contain for a verified sender, replying with the result. Emails that
+// are not acted on are still acknowledged with 200 so that SendGrid does not retry.
+func (a *App) inboundEmailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !inboundAuthorized(r) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err := r.ParseMultipartForm(10 << 20); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+	from, err := mail.ParseAddress(r.FormValue("from"))
+	if err != nil {
+		http.Error(w, "Invalid from address", http.StatusBadRequest)
+		return
+	}
+	email := from.Address
+	if !senderAuthenticated(r.FormValue("dkim"), email) {
+		log.Printf("Ignoring inbound email from %s: no passing DKIM signature for its domain", email)
+		return
+	}
+
+	ctx := context.Background()
+	prefs, err := a.getPreferences(ctx, email)
+	if err != nil {
+		log.Printf("ERROR in inboundEmailHandler: Failed to load preferences for %s: %v", email, err)
+		http.Error(w, "Failed to load preferences", http.StatusInternalServerError)
+		return
+	}
+	if !prefs.EmailVerified {
+		log.Printf("Ignoring inbound email from unverified address %s", email)
+		return
+	}
+
+	subject := r.FormValue("subject")
+	reply := a.runEmailCommand(ctx, email, inboundSignalTag(r.FormValue("to")), emailCommandLine(subject, r.FormValue("text")))
+	if a.mailer == nil {
+		return
+	}
+	if err := a.mailer.SendEmail(ctx, inboundReply(email, subject, r.FormValue("headers"), reply)); err != nil {
+		log.Printf("ERROR in inboundEmailHandler: Failed to reply to %s: %v", email, err)
+	}
+}
+
+// runEmailCommand applies one emailed command for a verified sender and returns the
+// reply text. signalID is set for replies to an alert email.
+func (a *App) runEmailCommand(ctx context.Context, email, signalID, line string) string {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return emailCommandHelp
+	}
+
+	var err error
+	var done string
+	switch command := strings.ToUpper(strings.Trim(fields[0], ".!")); command {
+	case "HELP":
+		return emailCommandHelp
+	case "LIST":
+		lines, err := a.signalSummaries(ctx, email)
+		if err != nil {
+			log.Printf("ERROR in runEmailCommand: Failed to list signals for %s: %v", email, err)
+			return "Could not load your alerts, please try again."
+		}
+		if len(lines) == 0 {
+			return `You have no alerts. Create one by sending "bitcoin 5%".`
+		}
+		return strings.Join(lines, "\n")
+	case "STOP", "UNSUBSCRIBE":
+		err = a.setEmailUnsubscribed(ctx, email, true)
+		done = "You will no longer receive email from PricePulse. Send START to receive it again."
+	case "START":
+		err = a.setEmailUnsubscribed(ctx, email, false)
+		done = "Email alerts are on again."
+	case "PAUSE", "RESUME":
+		paused := command == "PAUSE"
+		if signalID != "" {
+			err = a.setSignalPaused(ctx, email, signalID, paused)
+			if errors.Is(err, errSignalNotFound) || errors.Is(err, errSignalState) {
+				return fmt.Sprintf("Could not update alert %s: %v.", signalID, err)
+			}
+			done = fmt.Sprintf("Alert %s is paused. Reply RESUME to turn it back on.", signalID)
+			if !paused {
+				done = fmt.Sprintf("Alert %s is active again.", signalID)
+			}
+		} else {
+			err = a.setAllPaused(ctx, email, paused)
+			done = "All of your alerts are paused. Send RESUME to turn them back on."
+			if !paused {
+				done = "All of your alerts are active again."
+			}
+		}
+	default:
+		signal, perr := parseAlertArgs(fields)
+		if perr != nil {
+			return fmt.Sprintf("Sorry, I did not understand %q (%v).\n\n%s", line, perr, emailCommandHelp)
+		}
+		signal.UserID = email
+		signal.Email = email
+		signal.Channels = []string{"email"}
+		id, cerr := a.createSignal(ctx, signal)
+		var inErr *inputError
+		if errors.As(cerr, &inErr) {
+			return fmt.Sprintf("Could not create the alert: %v.", cerr)
+		}
+		err = cerr
+		done = fmt.Sprintf("Alert created (%s): we'll email you when %s moves %s.", id, signal.AssetID, signal.thresholdLabel())
+	}
+	if err != nil {
+		log.Printf("ERROR in runEmailCommand: Failed to run %q for %s: %v", line, email, err)
+		return "Something went wrong, please try again."
+	}
+	log.Printf("Ran emailed command %q for %s", line, email)
+	return done
+}
+
+// inboundReply builds the confirmation sent back to the sender, threaded under
+// their email by its Message-ID from the raw headers SendGrid forwards.
+func inboundReply(email, subject, rawHeaders, text string) EmailMessage {
+	headers := unsubscribeHeaders(email)
+	if msg, err := mail.ReadMessage(strings.NewReader(strings.TrimRight(rawHeaders, "\r\n") + "\r\n\r\n")); err == nil {
+		if id := msg.Header.Get("Message-Id"); id != "" {
+			headers["In-Reply-To"] = id
+			headers["References"] = id
+		}
+	}
+	if subject == "" {
+		subject = "PricePulse"
+	}
+	if !strings.HasPrefix(strings.ToLower(subject), "re:") {
+		subject = "Re: " + subject
+	}
+	return EmailMessage{
+		To:         email,
+		Subject:    subject,
+		PlainText:  text,
+		HTML:       "<p>" + strings.ReplaceAll(html.EscapeString(text), "\n", "<br>") + "</p>",
+		Headers:    headers,
+		ReplyTo:    inboundReplyAddress(""),
+		CustomArgs: map[string]string{"kind": "inbound_reply"},
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// maxIngestBatchSize keeps a single push within one Firestore write batch.
+const maxIngestBatchSize = 500
+
+// maxIngestClockSkew is how far into the future a pushed timestamp may be.
+const maxIngestClockSkew = 5 * time.Minute
+
+// PricePoint is one externally produced observation pushed to /api/v1/prices.
+type PricePoint struct {
+	AssetID   string    `json:"assetId"`
+	Price     float64   `json:"price"`
+	Currency  string    `json:"currency"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// validatePricePoints checks a pushed batch and fills in missing timestamps.
+// It returns one message per invalid point, keyed by its index in the batch.
+func validatePricePoints(points []PricePoint, now time.Time) map[int]string {
+	problems := map[int]string{}
+	for i := range points {
+		p := &points[i]
+		switch {
+		case !sourceNamePattern.MatchString(p.AssetID):
+			problems[i] = "assetId must be lowercase letters, digits, '-' or '_'"
+		case math.IsNaN(p.Price) || math.IsInf(p.Price, 0) || p.Price <= 0:
+			problems[i] = "price must be a positive number"
+		case p.Timestamp.After(now.Add(maxIngestClockSkew)):
+			problems[i] = "timestamp is in the future"
+		}
+		if currency, err := normalizeCurrency(p.Currency); err != nil {
+			problems[i] = err.Error()
+		} else {
+			p.Currency = currency
+		}
+		if p.Timestamp.IsZero() {
+			p.Timestamp = now
+		}
+	}
+	return problems
+}
+
+// latestPrices returns the most recent price per asset and currency in a batch,
+// keyed by asset ID and then currency code.
+func latestPrices(points []PricePoint) map[string]map[string]float64 {
+	latest := map[[2]string]PricePoint{}
+	for _, p := range points {
+		key := [2]string{p.AssetID, p.Currency}
+		if cur, ok := latest[key]; !ok || !p.Timestamp.Before(cur.Timestamp) {
+			latest[key] = p
+		}
+	}
+	prices := map[string]map[string]float64{}
+	for key, p := range latest {
+		if prices[key[0]] == nil {
+			prices[key[0]] = map[string]float64{}
+		}
+		prices[key[0]][key[1]] = p.Price
+	}
+	return prices
+}
+
+// ingestPricesHandler accepts a batch of price points from an authenticated producer,
+// writes them to price_history, evaluates signals on each asset's latest price and
+// delivers the resulting alerts.
+func (a *App) ingestPricesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !bearerAuthorized(r, "INGEST_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var body struct {
+		Points []PricePoint `json:"points"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body.Points) == 0 {
+		http.Error(w, "At least one point is required", http.StatusBadRequest)
+		return
+	}
+	if len(body.Points) > maxIngestBatchSize {
+		http.Error(w, fmt.Sprintf("A batch may contain at most %d points", maxIngestBatchSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Reject the whole batch on any invalid point so producers never have to
+	// work out which half of a request was stored.
+	if problems := validatePricePoints(body.Points, time.Now()); len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "invalid points", "errors": problems})
+		return
+	}
+
+	ctx := context.Background()
+	batch := a.db.Batch()
+	for _, p := range body.Points {
+		batch.Create(a.db.Collection("price_history").NewDoc(), map[string]interface{}{"assetId": p.AssetID, "price": p.Price, "currency": p.Currency, "timestamp": p.Timestamp})
+	}
+	if _, err := batch.Commit(ctx); err != nil {
+		log.Printf("ERROR in ingestPricesHandler: Failed to write price batch: %v", err)
+		http.Error(w, "Failed to write to database", http.StatusInternalServerError)
+		return
+	}
+
+	// Emit in time order so that consumers keeping the last value end on the latest price.
+	ordered := append([]PricePoint(nil), body.Points...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Timestamp.Before(ordered[j].Timestamp) })
+	for _, p := range ordered {
+		a.events.Publish(ctx, PriceCollected{AssetID: p.AssetID, Currency: p.Currency, Price: p.Price, Source: "ingest", Timestamp: p.Timestamp})
+	}
+
+	prices := latestPrices(body.Points)
+	assets := make([]string, 0, len(prices))
+	for assetID := range prices {
+		assets = append(assets, assetID)
+	}
+	sort.Strings(assets)
+	for _, assetID := range assets {
+		if err := a.evaluateSignals(ctx, assetID, prices[assetID]); err != nil {
+			log.Printf("ERROR in ingestPricesHandler: %v", err)
+			http.Error(w, "Points stored but failed to check signals", http.StatusInternalServerError)
+			return
+		}
+	}
+	a.deliverQueued(ctx, "ingestPricesHandler")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "prices ingested and signals checked", "accepted": len(body.Points), "assets": assets})
+}
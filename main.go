@@ -2,27 +2,50 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/firestore"
 )
 
+// shutdownTimeout bounds how long in-flight requests may take once the server is
+// asked to stop. Cloud Run allows 10 seconds after SIGTERM, and the event sinks need
+// some of that to flush.
+const shutdownTimeout = 4 * time.Second
+
 // priceFetcherFunc defines a function type for fetching prices.
 type priceFetcherFunc func(assetID string, apiURL string) (map[string]map[string]interface{}, error)
 
-// App struct holds the Firestore client and the price fetching function.
+// App struct holds the Firestore client and the price fetching functions.
 type App struct {
-	db           *firestore.Client
-	priceFetcher priceFetcherFunc
-}
+	db             *firestore.Client
+	priceFetcher   priceFetcherFunc
+	historyFetcher historyFetcherFunc
+	catalog        *AssetCatalog
+	notifier       Notifier
+	channels       *NotifierRegistry
+	telegram       *TelegramBot
+	templates      *NotificationTemplates
+	mailer         EmailNotifier
+	webPush        *WebPushNotifier
+	events         *EventBus
 
-func main() {
-	ctx := context.Background()
-	var client *firestore.Client
-	var err error
+	// jobCtx is cancelled when the server shuts down; background jobs started
+	// from requests run under it and are tracked in jobs.
+	jobCtx context.Context
+	jobs   sync.WaitGroup
+}
 
+// newFirestoreClient connects to live Firestore in production and to the emulator otherwise.
+func newFirestoreClient(ctx context.Context) (*firestore.Client, error) {
 	// Check for a "production" environment flag
 	if os.Getenv("ENV") == "production" {
 		log.Println("Running in PRODUCTION mode. Connecting to live Firestore.")
@@ -30,28 +53,126 @@ func main() {
 		projectID := os.Getenv("GCP_PROJECT")
 		databaseID := os.Getenv("FIRESTORE_DATABASE_ID")
 
-		client, err = firestore.NewClientWithDatabase(ctx, projectID, databaseID)
+		return firestore.NewClientWithDatabase(ctx, projectID, databaseID)
+	}
 
-	} else {
-		log.Println("Running in LOCAL mode. Connecting to Firestore emulator.")
+	log.Println("Running in LOCAL mode. Connecting to Firestore emulator.")
 
-		if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
-			log.Fatal("You are running in local mode but FIRESTORE_EMULATOR_HOST is not set.")
-		}
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		log.Fatal("You are running in local mode but FIRESTORE_EMULATOR_HOST is not set.")
+	}
+
+	projectID := "pricepulse-demo"
+	return firestore.NewClient(ctx, projectID)
+}
 
-		projectID := "pricepulse-demo"
-		client, err = firestore.NewClient(ctx, projectID)
+// publicBaseURL returns the externally reachable base URL used for links in
+// notifications, from PUBLIC_BASE_URL.
+func publicBaseURL() string {
+	if u := os.Getenv("PUBLIC_BASE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+	return "http://localhost:8080"
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "vapid-keys" {
+		if err := printVAPIDKeys(); err != nil {
+			log.Fatalf("Failed to generate VAPID keys: %v", err)
+		}
+		return
 	}
 
+	ctx := context.Background()
+	client, err := newFirestoreClient(ctx)
 	if err != nil {
 		log.Fatalf("Failed to create Firestore client: %v", err)
 	}
 	defer client.Close()
 
-	// Create a new App instance, "injecting" the REAL priceFetcher function.
+	templates, err := LoadNotificationTemplates(os.Getenv("NOTIFICATION_TEMPLATES_DIR"))
+	if err != nil {
+		log.Fatalf("Failed to load notification templates: %v", err)
+	}
+
+	notifiers := NewNotifierRegistry()
+	email := newEmailNotifierFromEnv(templates)
+	notifiers.Register("email", email)
+	webhooks := NewWebhookNotifier(client)
+	// The outbox retries failed deliveries with its own backoff. Retrying inline as
+	// well would multiply the attempts and could outlast the outbox lease.
+	webhooks.MaxAttempts = 1
+	notifiers.Register("webhook", webhooks)
+	notifiers.Register("slack", NewSlackNotifier(templates))
+	notifiers.Register("discord", NewDiscordNotifier(templates))
+	telegram := NewTelegramBotFromEnv()
+	if telegram != nil {
+		notifiers.Register("telegram", &TelegramNotifier{Bot: telegram, Templates: templates})
+	}
+	webPush, err := NewWebPushNotifierFromEnv(client, templates)
+	if err != nil {
+		log.Fatalf("Failed to configure Web Push: %v", err)
+	}
+	if webPush != nil {
+		notifiers.Register("webpush", webPush)
+	}
+
+	mqttPublisher, err := NewMQTTPublisherFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to configure MQTT: %v", err)
+	}
+	defer mqttPublisher.Close()
+	natsSink, err := NewNATSSinkFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to connect to NATS: %v", err)
+	}
+	defer natsSink.Close()
+
+	events := NewEventBus()
+	if mqttPublisher != nil {
+		events.Subscribe(EventPriceCollected, mqttPublisher.Handle)
+		events.Subscribe(EventSignalTriggered, mqttPublisher.Handle)
+	}
+	if natsSink != nil {
+		events.Subscribe("*", natsSink.Handle)
+	}
+
+	// Create a new App instance, "injecting" the REAL fetcher and notifier implementations.
 	app := &App{
-		db:           client,
-		priceFetcher: getPriceFromCoinGecko,
+		db:             client,
+		priceFetcher:   getPriceFromCoinGecko,
+		historyFetcher: getMarketChartRangeFromCoinGecko,
+		catalog:        NewAssetCatalog(getCoinListFromCoinGecko, defaultCatalogCachePath()),
+		notifier:       notifiers,
+		channels:       notifiers,
+		telegram:       telegram,
+		templates:      templates,
+		mailer:         email,
+		webPush:        webPush,
+		events:         events,
+	}
+
+	// Subcommands run a one-off job instead of starting the server.
+	if len(os.Args) > 1 && os.Args[1] == "backfill" {
+		fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+		assetID := fs.String("asset", "bitcoin", "asset ID to backfill")
+		currency := fs.String("currency", "usd", "quote currency to backfill")
+		from := fs.String("from", "", "start date (YYYY-MM-DD)")
+		to := fs.String("to", "", "end date (YYYY-MM-DD), defaults to now")
+		fs.Parse(os.Args[2:])
+		if err := runBackfillCommand(ctx, app, *assetID, *currency, *from, *to); err != nil {
+			log.Fatalf("Backfill failed: %v", err)
+		}
+		return
+	}
+
+	jobCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+	app.jobCtx = jobCtx
+	if n, err := app.failStaleBackfills(ctx, time.Now()); err != nil {
+		log.Printf("ERROR in main: Failed to check for abandoned backfill jobs: %v", err)
+	} else if n > 0 {
+		log.Printf("Marked %d abandoned backfill jobs as failed", n)
 	}
 
 	http.HandleFunc("/", app.rootHandler)
@@ -63,13 +184,71 @@ func main() {
 	http.HandleFunc("/new-signal", app.showNewSignalFormHandler)
 	http.HandleFunc("/create-signal", app.handleCreateSignalForm)
 	http.HandleFunc("/signals/", app.viewUserSignalsHandler)
+	http.HandleFunc("/sources", app.sourcesHandler)
+	http.HandleFunc("/sources/", app.deleteSourceHandler)
+	http.HandleFunc("/collect-sources", app.collectSourcesHandler)
+	http.HandleFunc("/api/v1/prices", app.ingestPricesHandler)
+	http.HandleFunc("/admin/backfill", app.backfillHandler)
+	http.HandleFunc("/admin/backfill/", app.backfillHandler)
+	http.HandleFunc("/assets/search", app.assetSearchHandler)
+	http.HandleFunc("/webhooks", app.webhooksHandler)
+	http.HandleFunc("/webhooks/", app.webhookHandler)
+	http.HandleFunc("/admin/assets/sync", app.syncCatalogHandler)
+	http.HandleFunc("/process-outbox", app.processOutboxHandler)
+	http.HandleFunc("/send-digests", app.sendDigestsHandler)
+	http.HandleFunc("/preferences", app.preferencesHandler)
+	http.HandleFunc("/triggers", app.triggerHistoryHandler)
+	http.HandleFunc("/ack", app.ackHandler)
+	http.HandleFunc("/process-escalations", app.processEscalationsHandler)
+	http.HandleFunc("/unsubscribe", app.unsubscribeHandler)
+	http.HandleFunc("/email-preferences", app.emailPreferencesHandler)
+	http.HandleFunc("/verify", app.verifyEmailHandler)
+	http.HandleFunc("/sendgrid/events", app.sendGridEventsHandler)
+	http.HandleFunc("/inbound-email", app.inboundEmailHandler)
+	http.HandleFunc("/admin/outbox", app.outboxAdminHandler)
+	http.HandleFunc("/admin/outbox/", app.outboxAdminHandler)
+	http.HandleFunc("/admin/templates/preview", app.templatePreviewHandler)
+	http.HandleFunc("/telegram/webhook", app.telegramWebhookHandler)
+	http.HandleFunc("/telegram/link", app.telegramLinkHandler)
+	http.HandleFunc("/slack/commands", app.slackCommandsHandler)
+	http.HandleFunc("/slack/link", app.slackLinkHandler)
+	http.HandleFunc("/sw.js", app.serviceWorkerHandler)
+	http.HandleFunc("/push/vapid-public-key", app.vapidPublicKeyHandler)
+	http.HandleFunc("/push/subscriptions", app.pushSubscriptionsHandler)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("Server starting on port %s...", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatal(err)
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("Server starting on port %s...", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Cloud Run sends SIGTERM before stopping an instance. Finish in-flight requests,
+	// then return so that the deferred closes flush the MQTT and NATS sinks.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	<-stop
+	log.Println("Shutting down...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	stopJobs()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("ERROR in main: Failed to shut down the server: %v", err)
+	}
+	// Cancelled backfills record themselves as failed before they return.
+	drained := make(chan struct{})
+	go func() {
+		app.jobs.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-shutdownCtx.Done():
+		log.Println("Background jobs did not stop in time; they will be marked as failed on the next start")
 	}
 }
@@ -1,16 +1,52 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"cloud.google.com/go/firestore"
+	paho "github.com/eclipse/paho.mqtt.golang"
+	mqttserver "github.com/mochi-mqtt/server/v2"
+	mqttauth "github.com/mochi-mqtt/server/v2/hooks/auth"
+	mqttlisteners "github.com/mochi-mqtt/server/v2/listeners"
+	mqttpackets "github.com/mochi-mqtt/server/v2/packets"
+	natsserver "github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
 	"google.golang.org/api/iterator"
 )
 
@@ -73,10 +109,17 @@ func TestCollectDataHandler(t *testing.T) {
 
 	clearCollection(ctx, client, "signals")
 	clearCollection(ctx, client, "price_history")
+	clearCollection(ctx, client, "notification_outbox")
 
+	var notified []Alert
 	// Create our App instance for testing.
 	app := &App{
 		db: client,
+		// Inject a FAKE notifier that records alerts instead of sending them
+		notifier: NotifierFunc(func(ctx context.Context, alert Alert) error {
+			notified = append(notified, alert)
+			return nil
+		}),
 		// Inject a FAKE priceFetcher function
 		priceFetcher: func(assetID string, apiURL string) (map[string]map[string]interface{}, error) {
 			return map[string]map[string]interface{}{
@@ -118,6 +161,9 @@ func TestCollectDataHandler(t *testing.T) {
 	if updatedSignal.Status != "triggered" {
 		t.Errorf("expected signal status to be 'triggered', but got '%s'", updatedSignal.Status)
 	}
+	if len(notified) != 1 || notified[0].SignalID != docRef.ID {
+		t.Errorf("expected one notification for signal %s, got %+v", docRef.ID, notified)
+	}
 }
 
 // Integration Test for the /analysis endpoint
@@ -174,3 +220,2349 @@ func TestAnalysisHandler(t *testing.T) {
 		t.Errorf("expected 'simple_moving_average' to be %f, got %v", expectedAverage, response["simple_moving_average"])
 	}
 }
+
+// Unit Test for extractJSONPath
+func TestExtractJSONPath(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"data":[{"value":"42.5"},{"value":7}],"nav":{"usd":101.25}}`), &doc)
+
+	cases := map[string]float64{
+		"nav.usd":       101.25,
+		"$.nav.usd":     101.25,
+		"data[0].value": 42.5,
+		"data.1.value":  7,
+	}
+	for path, want := range cases {
+		got, err := extractJSONPath(doc, path)
+		if err != nil {
+			t.Errorf("extractJSONPath(%q) returned error: %v", path, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("extractJSONPath(%q) = %f, want %f", path, got, want)
+		}
+	}
+
+	for _, path := range []string{"nav.eur", "data[5].value", "data"} {
+		if _, err := extractJSONPath(doc, path); err == nil {
+			t.Errorf("expected error for path %q", path)
+		}
+	}
+}
+
+// Unit Test for fetchCustomSourceValue
+func TestFetchCustomSourceValue(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"data":[{"value":"71","value_classification":"Greed"}]}`)
+	}))
+	defer server.Close()
+
+	src := CustomSource{
+		Name:      "fear-greed",
+		URL:       server.URL,
+		Headers:   map[string]string{"Authorization": "Bearer secret"},
+		ValuePath: "data[0].value",
+	}
+	value, err := fetchCustomSourceValue(src)
+	if err != nil {
+		t.Fatalf("fetchCustomSourceValue failed: %v", err)
+	}
+	if value != 71 {
+		t.Errorf("expected value 71, got %f", value)
+	}
+
+	src.Headers = nil
+	if _, err := fetchCustomSourceValue(src); err == nil {
+		t.Error("expected error when the source rejects the request")
+	}
+}
+
+// Unit Test for the authentication and name checks of the custom source handlers
+func TestSourcesHandlerRejectsBadRequests(t *testing.T) {
+	t.Setenv("ADMIN_API_KEYS", "admin-key")
+	fetcher := func(apiURL string) ([]Asset, error) {
+		return []Asset{{ID: "bitcoin", Symbol: "btc", Name: "Bitcoin"}}, nil
+	}
+	app := &App{catalog: NewAssetCatalog(fetcher, filepath.Join(t.TempDir(), "assets.json"))}
+
+	for _, tc := range []struct {
+		method, path string
+		handler      http.HandlerFunc
+	}{
+		{"GET", "/sources", app.sourcesHandler},
+		{"POST", "/sources", app.sourcesHandler},
+		{"DELETE", "/sources/nav", app.deleteSourceHandler},
+		{"POST", "/collect-sources", app.collectSourcesHandler},
+	} {
+		rr := httptest.NewRecorder()
+		tc.handler(rr, httptest.NewRequest(tc.method, tc.path, strings.NewReader(`{}`)))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401 without a token, got %d", tc.method, tc.path, rr.Code)
+		}
+	}
+
+	// Sources must not shadow a coin, whether by its ID or its ticker.
+	for _, name := range []string{"bitcoin", "btc"} {
+		req := httptest.NewRequest("POST", "/sources", strings.NewReader(`{"name":"`+name+`","url":"http://127.0.0.1:1/","valuePath":"value"}`))
+		req.Header.Set("Authorization", "Bearer admin-key")
+		rr := httptest.NewRecorder()
+		app.sourcesHandler(rr, req)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected 409 for source name %q, got %d: %s", name, rr.Code, rr.Body.String())
+		}
+	}
+}
+
+// Unit Test for validatePricePoints
+func TestValidatePricePoints(t *testing.T) {
+	now := time.Now()
+	points := []PricePoint{
+		{AssetID: "internal-nav", Price: 101.5},
+		{AssetID: "Bitcoin", Price: 1},
+		{AssetID: "gas-gwei", Price: -3},
+		{AssetID: "gas-gwei", Price: 12, Timestamp: now.Add(time.Hour)},
+	}
+	problems := validatePricePoints(points, now)
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 invalid points, got %d: %v", len(problems), problems)
+	}
+	if _, ok := problems[0]; ok {
+		t.Errorf("expected point 0 to be valid, got %q", problems[0])
+	}
+	if !points[0].Timestamp.Equal(now) {
+		t.Errorf("expected missing timestamp to default to now, got %v", points[0].Timestamp)
+	}
+}
+
+// Unit Test for the authentication and validation paths of ingestPricesHandler
+func TestIngestPricesHandlerRejectsBadRequests(t *testing.T) {
+	t.Setenv("INGEST_API_KEYS", "old-key, new-key")
+	app := &App{}
+
+	req := httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`{"points":[{"assetId":"nav","price":1}]}`))
+	rr := httptest.NewRecorder()
+	app.ingestPricesHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without a token, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`{"points":[{"assetId":"nav","price":0}]}`))
+	req.Header.Set("Authorization", "Bearer new-key")
+	rr = httptest.NewRecorder()
+	app.ingestPricesHandler(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid point, got %d", rr.Code)
+	}
+}
+
+// Integration Test for ingestPricesHandler: triggered alerts are delivered in the same request
+func TestIngestPricesHandlerDelivers(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	t.Setenv("INGEST_API_KEYS", "key")
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "signals")
+	clearCollection(ctx, client, "price_history")
+	clearCollection(ctx, client, "notification_outbox")
+
+	var notified []Alert
+	app := &App{db: client, notifier: NotifierFunc(func(ctx context.Context, alert Alert) error {
+		notified = append(notified, alert)
+		return nil
+	})}
+	ref, _, err := client.Collection("signals").Add(ctx, Signal{UserID: "u", AssetID: "nav", ChangeThresholdPercentage: 2, PriceAtCreation: 100, Status: "active", CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Failed to add test signal: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/v1/prices", strings.NewReader(`{"points":[{"assetId":"nav","price":105}]}`))
+	req.Header.Set("Authorization", "Bearer key")
+	rr := httptest.NewRecorder()
+	app.ingestPricesHandler(rr, req)
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if len(notified) != 1 || notified[0].SignalID != ref.ID {
+		t.Errorf("expected the alert to be delivered without waiting for the outbox job, got %+v", notified)
+	}
+}
+
+// Unit Test for getMarketChartRangeFromCoinGecko
+func TestGetMarketChartRangeFromCoinGecko(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("vs_currency") != "eur" || r.URL.Query().Get("from") != "1700000000" || r.URL.Query().Get("to") != "1700007200" {
+			t.Errorf("unexpected range in query: %s", r.URL.RawQuery)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintln(w, `{"prices":[[1700000000000,37000.5],[1700003600000,37100.25]]}`)
+	}))
+	defer server.Close()
+
+	from, to := time.Unix(1700000000, 0), time.Unix(1700007200, 0)
+	points, err := getMarketChartRangeFromCoinGecko("bitcoin", "eur", server.URL+"/coins/%s/market_chart/range?vs_currency=%s&from=%d&to=%d", from, to)
+	if err != nil {
+		t.Fatalf("getMarketChartRangeFromCoinGecko failed: %v", err)
+	}
+	if len(points) != 2 {
+		t.Fatalf("expected 2 points, got %d", len(points))
+	}
+	if points[1].Price != 37100.25 || points[1].Currency != "eur" || !points[1].Timestamp.Equal(time.Unix(1700003600, 0)) {
+		t.Errorf("unexpected second point: %+v", points[1])
+	}
+}
+
+// Unit Test for dedupePoints and backfillChunks
+func TestBackfillDedupeAndChunks(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	fetched := []PricePoint{
+		{AssetID: "bitcoin", Price: 3, Timestamp: base.Add(2 * time.Hour)},
+		{AssetID: "bitcoin", Price: 1, Timestamp: base},
+		{AssetID: "bitcoin", Price: 2, Timestamp: base.Add(time.Hour)},
+	}
+	// A live-collected point two minutes after the one-hour mark duplicates it.
+	existing := []time.Time{base.Add(time.Hour + 2*time.Minute)}
+
+	kept := dedupePoints(fetched, existing, 5*time.Minute)
+	if len(kept) != 2 || kept[0].Price != 1 || kept[1].Price != 3 {
+		t.Errorf("unexpected points after dedupe: %+v", kept)
+	}
+
+	chunks := backfillChunks(base, base.Add(200*24*time.Hour), 90*24*time.Hour)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if !chunks[2][1].Equal(base.Add(200 * 24 * time.Hour)) {
+		t.Errorf("expected last chunk to end at the range end, got %v", chunks[2][1])
+	}
+
+	now := time.Now()
+	for _, tc := range []struct {
+		job  BackfillJob
+		want bool
+	}{
+		{BackfillJob{Status: "running", UpdatedAt: now.Add(-time.Minute)}, false},
+		{BackfillJob{Status: "running", UpdatedAt: now.Add(-time.Hour)}, true},
+		{BackfillJob{Status: "pending", UpdatedAt: now.Add(-time.Hour)}, true},
+		{BackfillJob{Status: "completed", UpdatedAt: now.Add(-time.Hour)}, false},
+	} {
+		if got := backfillStale(tc.job, now); got != tc.want {
+			t.Errorf("backfillStale(%s, updated %v ago) = %v, want %v", tc.job.Status, now.Sub(tc.job.UpdatedAt), got, tc.want)
+		}
+	}
+}
+
+// Integration Test for backfill jobs: catalog resolution, cancellation and abandoned jobs
+func TestBackfillJobs(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "backfill_jobs")
+	clearCollection(ctx, client, "price_history")
+
+	jobCtx, cancel := context.WithCancel(ctx)
+	fetches := 0
+	app := &App{
+		db: client,
+		catalog: NewAssetCatalog(func(apiURL string) ([]Asset, error) {
+			return []Asset{{ID: "bitcoin", Symbol: "btc", Name: "Bitcoin"}}, nil
+		}, filepath.Join(t.TempDir(), "assets.json")),
+		historyFetcher: func(assetID, currency, apiURL string, from, to time.Time) ([]PricePoint, error) {
+			fetches++
+			cancel() // Shutdown begins while the first chunk is being fetched.
+			return []PricePoint{{AssetID: assetID, Currency: currency, Price: 1, Timestamp: from}}, nil
+		},
+		jobCtx: jobCtx,
+	}
+
+	if _, err := app.newBackfillJob(ctx, "bitcoinn", "usd", time.Now().Add(-time.Hour), time.Now()); err == nil {
+		t.Error("expected an asset missing from the catalog to be rejected")
+	}
+	job, err := app.newBackfillJob(ctx, "BTC", "usd", time.Now().Add(-200*24*time.Hour), time.Now())
+	if err != nil {
+		t.Fatalf("newBackfillJob failed: %v", err)
+	}
+	if job.AssetID != "bitcoin" {
+		t.Errorf("expected the ticker to resolve to bitcoin, got %q", job.AssetID)
+	}
+
+	app.startBackfill(job)
+	app.jobs.Wait()
+	doc, err := client.Collection("backfill_jobs").Doc(job.ID).Get(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read job: %v", err)
+	}
+	var saved BackfillJob
+	doc.DataTo(&saved)
+	if fetches != 1 || saved.Status != "failed" || saved.ChunksDone != 1 || !strings.Contains(saved.Error, "interrupted") {
+		t.Errorf("expected a cancelled job to stop after one chunk and be marked failed, got %d fetches and %+v", fetches, saved)
+	}
+
+	// A job left running by a stopped instance is failed on the next check.
+	stale := BackfillJob{AssetID: "bitcoin", Currency: "usd", Status: "running", UpdatedAt: time.Now().Add(-time.Hour)}
+	staleRef, _, err := client.Collection("backfill_jobs").Add(ctx, stale)
+	if err != nil {
+		t.Fatalf("Failed to add job: %v", err)
+	}
+	if n, err := app.failStaleBackfills(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one abandoned job to be failed, got %d, %v", n, err)
+	}
+	doc, _ = staleRef.Get(ctx)
+	if doc.Data()["status"] != "failed" {
+		t.Errorf("expected the abandoned job to be failed, got %v", doc.Data()["status"])
+	}
+}
+
+// Unit Test for AssetCatalog resolution, suggestions and search
+func TestAssetCatalog(t *testing.T) {
+	fetches := 0
+	fetcher := func(apiURL string) ([]Asset, error) {
+		fetches++
+		return []Asset{
+			{ID: "bitcoin", Symbol: "btc", Name: "Bitcoin"},
+			{ID: "bitcoin-avalanche-bridged-btc-b", Symbol: "btc.b", Name: "Bitcoin Avalanche Bridged (BTC.b)"},
+			{ID: "osmosis-allbtc", Symbol: "btc", Name: "Osmosis allBTC"},
+			{ID: "ethereum", Symbol: "eth", Name: "Ethereum"},
+			{ID: "solana", Symbol: "sol", Name: "Solana"},
+		}, nil
+	}
+	cachePath := filepath.Join(t.TempDir(), "assets.json")
+	catalog := NewAssetCatalog(fetcher, cachePath)
+
+	for input, want := range map[string]string{"bitcoin": "bitcoin", "BTC": "bitcoin", "Ethereum": "ethereum", " sol ": "solana"} {
+		got, err := catalog.Resolve(input)
+		if err != nil || got != want {
+			t.Errorf("Resolve(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+
+	_, err := catalog.Resolve("etherium")
+	unknown, ok := err.(*UnknownAssetError)
+	if !ok {
+		t.Fatalf("expected *UnknownAssetError, got %v", err)
+	}
+	if len(unknown.Suggestions) == 0 || unknown.Suggestions[0].ID != "ethereum" {
+		t.Errorf("expected 'ethereum' to be suggested, got %+v", unknown.Suggestions)
+	}
+
+	results := catalog.Search("bit", 10)
+	if len(results) != 2 || results[0].ID != "bitcoin" {
+		t.Errorf("unexpected search results: %+v", results)
+	}
+
+	// A second catalog on the same cache file must not hit the provider.
+	cached := NewAssetCatalog(fetcher, cachePath)
+	if got, err := cached.Resolve("eth"); err != nil || got != "ethereum" {
+		t.Errorf("cached Resolve(\"eth\") = %q, %v", got, err)
+	}
+	if fetches != 1 {
+		t.Errorf("expected the coin list to be fetched once, got %d", fetches)
+	}
+
+	// After a failed sync the provider is left alone until catalogRetryAfter passes,
+	// and concurrent callers share one sync.
+	failures := 0
+	release := make(chan struct{})
+	down := NewAssetCatalog(func(apiURL string) ([]Asset, error) {
+		failures++
+		<-release
+		return nil, errors.New("provider unavailable")
+	}, "")
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			down.ensureFresh()
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	down.ensureFresh()
+	if failures != 1 || down.Len() != 0 {
+		t.Errorf("expected a single failed fetch while backing off, got %d", failures)
+	}
+	down.mu.Lock()
+	down.failedAt = time.Now().Add(-catalogRetryAfter)
+	down.mu.Unlock()
+	down.ensureFresh()
+	if failures != 2 {
+		t.Errorf("expected a retry once the backoff has passed, got %d fetches", failures)
+	}
+
+	// A forced sync through the admin endpoint reports the provider's failure.
+	t.Setenv("ADMIN_API_KEYS", "admin-key")
+	req := httptest.NewRequest(http.MethodPost, "/admin/assets/sync", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rr := httptest.NewRecorder()
+	(&App{catalog: down}).syncCatalogHandler(rr, req)
+	if rr.Code != http.StatusBadGateway || failures != 3 {
+		t.Errorf("expected 502 from a forced sync, got %d after %d fetches", rr.Code, failures)
+	}
+}
+
+// Unit Test for formatPrice and normalizeCurrency
+func TestFormatPrice(t *testing.T) {
+	cases := []struct {
+		amount   float64
+		currency string
+		want     string
+	}{
+		{65000.5, "usd", "$65,000.50"},
+		{1234, "EUR", "€1,234.00"},
+		{999.999, "gbp", "£1,000.00"},
+		{10500000, "jpy", "¥10,500,000"},
+		{0.00012345, "btc", "₿0.00012345"},
+		{-42, "usd", "-$42.00"},
+	}
+	for _, c := range cases {
+		if got := formatPrice(c.amount, c.currency); got != c.want {
+			t.Errorf("formatPrice(%v, %q) = %q, want %q", c.amount, c.currency, got, c.want)
+		}
+	}
+
+	if c, err := normalizeCurrency(" EUR "); err != nil || c != "eur" {
+		t.Errorf("normalizeCurrency(\" EUR \") = %q, %v", c, err)
+	}
+	if c, _ := normalizeCurrency(""); c != "usd" {
+		t.Errorf("expected empty currency to default to usd, got %q", c)
+	}
+	if _, err := normalizeCurrency("doge"); err == nil {
+		t.Error("expected an error for an unsupported currency")
+	}
+}
+
+// Unit Test for NotifierRegistry fan-out and channel validation
+func TestNotifierRegistry(t *testing.T) {
+	var delivered []string
+	registry := NewNotifierRegistry()
+	registry.Register("email", NotifierFunc(func(ctx context.Context, alert Alert) error {
+		delivered = append(delivered, "email:"+alert.Signal.Email)
+		return nil
+	}))
+	registry.Register("webhook", NotifierFunc(func(ctx context.Context, alert Alert) error {
+		return fmt.Errorf("endpoint unreachable")
+	}))
+
+	if channels, err := registry.ValidateChannels(nil, nil); err != nil || len(channels) != 1 || channels[0] != "email" {
+		t.Errorf("expected default channel email, got %v, %v", channels, err)
+	}
+	if _, err := registry.ValidateChannels([]string{"email", "pager"}, nil); err == nil {
+		t.Error("expected an error for an unregistered channel")
+	}
+
+	alert := Alert{Signal: Signal{Email: "a@example.com", Channels: []string{"webhook", "email"}}}
+	err := registry.Notify(context.Background(), alert)
+	if err == nil || !strings.Contains(err.Error(), "webhook: endpoint unreachable") {
+		t.Errorf("expected the webhook failure to be reported, got %v", err)
+	}
+	if len(delivered) != 1 || delivered[0] != "email:a@example.com" {
+		t.Errorf("expected email to be delivered despite the webhook failure, got %v", delivered)
+	}
+}
+
+// smtpSink is a minimal in-process SMTP server that records delivered messages.
+type smtpSink struct {
+	addr     string
+	auth     chan string
+	messages chan string
+}
+
+// startSMTPSink listens on a local port and serves SMTP sessions until the test ends.
+// With a TLS config the sink speaks implicit TLS, like a server on port 465.
+func startSMTPSink(t *testing.T, tlsConfig *tls.Config) *smtpSink {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start SMTP sink: %v", err)
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	t.Cleanup(func() { ln.Close() })
+	sink := &smtpSink{addr: ln.Addr().String(), auth: make(chan string, 10), messages: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tp := textproto.NewConn(conn)
+				tp.PrintfLine("220 sink ready")
+				for {
+					line, err := tp.ReadLine()
+					if err != nil {
+						return
+					}
+					cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+					switch cmd {
+					case "EHLO":
+						tp.PrintfLine("250-sink")
+						tp.PrintfLine("250 AUTH PLAIN")
+					case "AUTH":
+						sink.auth <- line
+						tp.PrintfLine("235 authenticated")
+					case "DATA":
+						tp.PrintfLine("354 go ahead")
+						data, _ := tp.ReadDotBytes()
+						sink.messages <- string(data)
+						tp.PrintfLine("250 queued")
+					case "QUIT":
+						tp.PrintfLine("221 bye")
+						return
+					default:
+						tp.PrintfLine("250 ok")
+					}
+				}
+			}()
+		}
+	}()
+	return sink
+}
+
+// Unit Test for SMTPNotifier against the in-process sink
+func TestSMTPNotifier(t *testing.T) {
+	sink := startSMTPSink(t, nil)
+	host, port, _ := net.SplitHostPort(sink.addr)
+	notifier := &SMTPNotifier{
+		Host:     host,
+		Port:     port,
+		Username: "alerts",
+		Password: "hunter2",
+		From:     "PricePulse <alerts@example.com>",
+		Security: smtpSecurityNone,
+	}
+	alert := Alert{
+		Signal:        Signal{Email: "trader@example.com", AssetID: "bitcoin", QuoteCurrency: "eur"},
+		Price:         61234.5,
+		ChangePercent: -5.25,
+	}
+
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if auth := <-sink.auth; !strings.HasPrefix(auth, "AUTH PLAIN ") {
+		t.Errorf("expected AUTH PLAIN, got %q", auth)
+	}
+
+	msg, err := mail.ReadMessage(strings.NewReader(<-sink.messages))
+	if err != nil {
+		t.Fatalf("Failed to parse delivered message: %v", err)
+	}
+	if got := msg.Header.Get("Subject"); got != "Price Alert for bitcoin" {
+		t.Errorf("unexpected subject %q", got)
+	}
+	_, params, _ := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	plainText, htmlContent, err := notifier.Templates.EmailBodies(alert)
+	if err != nil {
+		t.Fatalf("Failed to render email bodies: %v", err)
+	}
+	for _, want := range []string{plainText, htmlContent} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("Missing message part: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		if string(body) != want {
+			t.Errorf("unexpected part body %q, want %q", body, want)
+		}
+	}
+
+	// STARTTLS is required by default and the sink does not offer it.
+	notifier.Security = smtpSecurityStartTLS
+	if err := notifier.Notify(context.Background(), alert); err == nil {
+		t.Error("expected an error when the server does not support STARTTLS")
+	}
+
+	// Implicit TLS, with the certificate of an httptest TLS server.
+	certServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer certServer.Close()
+	tlsSink := startSMTPSink(t, &tls.Config{Certificates: certServer.TLS.Certificates})
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	notifier.Host, notifier.Port, _ = net.SplitHostPort(tlsSink.addr)
+	notifier.Security = smtpSecurityTLS
+	notifier.TLSConfig = &tls.Config{RootCAs: roots, ServerName: notifier.Host}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify over implicit TLS failed: %v", err)
+	}
+	if msg := <-tlsSink.messages; !strings.Contains(msg, "Subject: Price Alert for bitcoin") {
+		t.Errorf("unexpected message over implicit TLS:\n%s", msg)
+	}
+	notifier.TLSConfig = nil
+	if err := notifier.Notify(context.Background(), alert); err == nil {
+		t.Error("expected an untrusted certificate to be rejected")
+	}
+}
+
+// verifyWebhookSignature is what a receiver does with a delivery: it accepts it if
+// any v1 signature matches secret and the timestamp is within tolerance of now,
+// which stops captured requests from being replayed later.
+func verifyWebhookSignature(secret, signatureHeader, timestampHeader string, body []byte, tolerance time.Duration, now time.Time) error {
+	ts, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp header")
+	}
+	if d := now.Sub(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+		return fmt.Errorf("timestamp outside tolerance")
+	}
+	expected := signWebhook([]string{secret}, ts, body)
+	for _, sig := range strings.Split(signatureHeader, ",") {
+		if hmac.Equal([]byte(strings.TrimSpace(sig)), []byte(expected)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("no matching signature")
+}
+
+// Unit Test for WebhookNotifier signing, rotation overlap and retries
+func TestWebhookNotifier(t *testing.T) {
+	now := time.Now()
+	endpointSecrets := []WebhookSecret{
+		{Secret: "old-secret", CreatedAt: now.Add(-48 * time.Hour), ExpiresAt: now.Add(time.Hour)},
+		{Secret: "new-secret", CreatedAt: now},
+		{Secret: "expired-secret", CreatedAt: now.Add(-72 * time.Hour), ExpiresAt: now.Add(-time.Hour)},
+	}
+
+	attempts := 0
+	var received WebhookPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sig, ts := r.Header.Get(webhookSignatureHeader), r.Header.Get(webhookTimestampHeader)
+		for _, secret := range []string{"old-secret", "new-secret"} {
+			if err := verifyWebhookSignature(secret, sig, ts, body, 5*time.Minute, time.Now()); err != nil {
+				t.Errorf("signature did not verify with %s: %v", secret, err)
+			}
+		}
+		if err := verifyWebhookSignature("expired-secret", sig, ts, body, 5*time.Minute, time.Now()); err == nil {
+			t.Error("expected the expired secret not to sign the delivery")
+		}
+		if err := verifyWebhookSignature("new-secret", sig, ts, body, 5*time.Minute, time.Now().Add(time.Hour)); err == nil {
+			t.Error("expected a stale timestamp to be rejected")
+		}
+		json.Unmarshal(body, &received)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	var delays []time.Duration
+	notifier := &WebhookNotifier{
+		Endpoints: func(ctx context.Context, email string) ([]WebhookEndpoint, error) {
+			return []WebhookEndpoint{{Email: email, URL: server.URL, Secrets: endpointSecrets}}, nil
+		},
+		Client:      server.Client(),
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		Sleep: func(ctx context.Context, d time.Duration) error {
+			delays = append(delays, d)
+			return nil
+		},
+	}
+	alert := Alert{
+		SignalID:      "sig-1",
+		Signal:        Signal{Email: "bot@example.com", AssetID: "bitcoin", PriceAtCreation: 60000, ChangeThresholdPercentage: 5},
+		Price:         63000,
+		ChangePercent: 5,
+		TriggeredAt:   now,
+	}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if attempts != 3 || len(delays) != 2 || delays[0] != time.Second || delays[1] != 2*time.Second {
+		t.Errorf("expected 3 attempts with 1s and 2s backoff, got %d attempts and delays %v", attempts, delays)
+	}
+	if received.Version != "1" || received.Signal.ID != "sig-1" || received.BaselinePrice != 60000 || received.CurrentPrice != 63000 {
+		t.Errorf("unexpected payload: %+v", received)
+	}
+
+	// Under the outbox a failure is returned after one attempt, for the outbox to retry.
+	attempts, delays = 0, nil
+	notifier.MaxAttempts = 1
+	if err := notifier.Notify(context.Background(), alert); err == nil || attempts != 1 || len(delays) != 0 {
+		t.Errorf("expected one failed attempt without backoff, got %d attempts, delays %v, error %v", attempts, delays, err)
+	}
+
+	// A retry skips endpoints that already received the alert.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	attempts = 2
+	notifier.Endpoints = func(ctx context.Context, email string) ([]WebhookEndpoint, error) {
+		return []WebhookEndpoint{
+			{ID: "ok", Email: email, URL: server.URL, Secrets: endpointSecrets},
+			{ID: "down", Email: email, URL: failing.URL, Secrets: endpointSecrets},
+		}, nil
+	}
+	var partial *partialDeliveryError
+	if err := notifier.Notify(context.Background(), alert); !errors.As(err, &partial) || !slices.Equal(partial.Delivered, []string{"ok"}) {
+		t.Fatalf("expected a partial delivery to the ok endpoint, got %v", err)
+	}
+	alert.Delivered = partial.Delivered
+	attempts = 2
+	if err := notifier.Notify(context.Background(), alert); err == nil || errors.As(err, &partial) || attempts != 2 {
+		t.Errorf("expected the retry to post only to the failing endpoint, got %d attempts and error %v", attempts, err)
+	}
+}
+
+// Unit Test for requestEmail and the ownership checks of webhooksHandler
+func TestWebhookOwnership(t *testing.T) {
+	t.Setenv("ADMIN_API_KEYS", "admin-key")
+	token := url.QueryEscape(signPreferenceToken("a@example.com", time.Now().Add(time.Hour)))
+	expired := url.QueryEscape(signPreferenceToken("a@example.com", time.Now().Add(-time.Minute)))
+	unsubscribe := url.QueryEscape(signUnsubscribeToken("a@example.com"))
+
+	for _, tc := range []struct {
+		target, claimed, bearer, want string
+		ok                            bool
+	}{
+		{"/webhooks?token=" + token, "", "", "a@example.com", true},
+		{"/webhooks?token=" + token, "a@example.com", "", "a@example.com", true},
+		{"/webhooks?token=" + token, "b@example.com", "", "", false},
+		{"/webhooks?token=garbage", "a@example.com", "admin-key", "", false},
+		{"/webhooks?token=" + expired, "a@example.com", "", "", false},
+		{"/webhooks?token=" + unsubscribe, "a@example.com", "", "", false},
+		{"/webhooks", "b@example.com", "admin-key", "b@example.com", true},
+		{"/webhooks", "b@example.com", "wrong-key", "", false},
+		{"/webhooks", "b@example.com", "", "", false},
+	} {
+		req := httptest.NewRequest(http.MethodGet, tc.target, nil)
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		if got, ok := requestEmail(req, tc.claimed); got != tc.want || ok != tc.ok {
+			t.Errorf("requestEmail(%s, %q) = %q, %v; want %q, %v", tc.target, tc.claimed, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	app := &App{}
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/webhooks?email=a@example.com", nil),
+		httptest.NewRequest(http.MethodPost, "/webhooks", strings.NewReader(`{"email":"a@example.com","url":"https://example.com/hook"}`)),
+		httptest.NewRequest(http.MethodPost, "/webhooks?token="+url.QueryEscape(signPreferenceToken("b@example.com", time.Now().Add(time.Hour))), strings.NewReader(`{"email":"a@example.com","url":"https://example.com/hook"}`)),
+	} {
+		rr := httptest.NewRecorder()
+		app.webhooksHandler(rr, req)
+		if rr.Code != http.StatusUnauthorized || strings.Contains(rr.Body.String(), "secret") {
+			t.Errorf("%s %s: expected 401 without proof of ownership, got %d %s", req.Method, req.URL, rr.Code, rr.Body.String())
+		}
+	}
+
+	// Webhook URLs must not reach internal services.
+	for raw, valid := range map[string]bool{
+		"https://example.com/hook":                true,
+		"http://203.0.113.7:8080/hook":            true,
+		"ftp://example.com/hook":                  false,
+		"https:///hook":                           false,
+		"http://localhost:8080/hook":              false,
+		"http://api.localhost/hook":               false,
+		"http://127.0.0.1/hook":                   false,
+		"http://10.0.0.5/hook":                    false,
+		"http://192.168.1.1/hook":                 false,
+		"http://169.254.169.254/computeMetadata/": false,
+		"http://100.64.0.1/hook":                  false,
+		"http://[::1]/hook":                       false,
+		"http://[::ffff:127.0.0.1]/hook":          false,
+		"http://[fd00::1]/hook":                   false,
+		"http://0.0.0.0/hook":                     false,
+	} {
+		if err := validateWebhookURL(raw); (err == nil) != valid {
+			t.Errorf("validateWebhookURL(%q) = %v, want valid %v", raw, err, valid)
+		}
+	}
+	rr := httptest.NewRecorder()
+	app.webhooksHandler(rr, httptest.NewRequest(http.MethodPost, "/webhooks?token="+token, strings.NewReader(`{"url":"http://169.254.169.254/latest/meta-data/"}`)))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a metadata-server URL, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	// A hostname that resolves to an internal address is refused when dialling.
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("expected the public-only client not to reach a loopback server")
+	}))
+	defer internal.Close()
+	_, err := newPublicOnlyClient(time.Second).Get(strings.Replace(internal.URL, "127.0.0.1", "localhost", 1))
+	var perm *permanentError
+	if !errors.As(err, &perm) {
+		t.Errorf("expected a permanent error dialling a loopback address, got %v", err)
+	}
+}
+
+// Unit Test for the Slack and Discord notifiers
+func TestChatNotifiers(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://pricepulse.example.com/")
+	var bodies []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		bodies = append(bodies, body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	alert := Alert{
+		Signal: Signal{
+			Email:           "team@example.com",
+			AssetID:         "ethereum",
+			PriceAtCreation: 3000,
+			Targets:         map[string]string{"slack": server.URL + "/slack", "discord": server.URL + "/discord"},
+		},
+		Price:         2850,
+		ChangePercent: -5,
+		TriggeredAt:   time.Now(),
+	}
+	if err := (&SlackNotifier{Client: server.Client()}).Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Slack Notify failed: %v", err)
+	}
+	if err := (&DiscordNotifier{Client: server.Client()}).Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Discord Notify failed: %v", err)
+	}
+	if len(bodies) != 2 {
+		t.Fatalf("expected 2 posts, got %d", len(bodies))
+	}
+
+	slack, _ := json.Marshal(bodies[0])
+	for _, want := range []string{`"type":"header"`, `*Change*\n-5.00%`, `$2,850.00`, `https://pricepulse.example.com/signals/team@example.com`} {
+		if !strings.Contains(string(slack), want) {
+			t.Errorf("Slack message missing %q: %s", want, slack)
+		}
+	}
+	embed := bodies[1]["embeds"].([]interface{})[0].(map[string]interface{})
+	if embed["color"].(float64) != discordColorDown || embed["title"] != "Price Alert for ethereum" {
+		t.Errorf("unexpected Discord embed: %v", embed)
+	}
+
+	if err := NewSlackNotifier(nil).ValidateTarget("https://hooks.slack.com/services/T0/B0/x"); err != nil {
+		t.Errorf("expected a Slack webhook URL to be valid: %v", err)
+	}
+	if err := NewDiscordNotifier(nil).ValidateTarget("http://discord.com/api/webhooks/1/x"); err == nil {
+		t.Error("expected a non-https Discord URL to be rejected")
+	}
+}
+
+// Unit Test for parseAlertArgs
+func TestParseAlertArgs(t *testing.T) {
+	signal, err := parseAlertArgs([]string{"bitcoin", "5%", "eur"})
+	if err != nil || signal.AssetID != "bitcoin" || signal.ChangeThresholdPercentage != 5 || signal.QuoteCurrency != "eur" || signal.Direction != "" {
+		t.Errorf("unexpected result: %+v %v", signal, err)
+	}
+	if signal, err := parseAlertArgs([]string{"ethereum", "2.5"}); err != nil || signal.QuoteCurrency != "" {
+		t.Errorf("expected currency to be optional: %q %v", signal.QuoteCurrency, err)
+	}
+	if signal, err := parseAlertArgs([]string{"bitcoin", "DOWN", "5%"}); err != nil || signal.Direction != "down" || signal.thresholdLabel() != "-5.00%" {
+		t.Errorf("expected a direction: %+v %v", signal, err)
+	}
+	if signal, err := parseAlertArgs([]string{"eth", "3%", "up"}); err != nil || signal.Direction != "up" || signal.ChangeThresholdPercentage != 3 {
+		t.Errorf("expected a trailing direction: %+v %v", signal, err)
+	}
+	for _, args := range [][]string{{"bitcoin"}, {"bitcoin", "abc%"}, {"bitcoin", "-3%"}, {"bitcoin", "5%", "eur", "x"}, {"bitcoin", "up"}, {"bitcoin", "up", "down", "5%"}} {
+		if _, err := parseAlertArgs(args); err == nil {
+			t.Errorf("expected %v to be rejected", args)
+		}
+	}
+
+	down := Signal{ChangeThresholdPercentage: 5, Direction: "down"}
+	either := Signal{ChangeThresholdPercentage: 5}
+	if down.crossed(6) || !down.crossed(-6) || !either.crossed(6) || !either.crossed(-5) || either.crossed(4.9) {
+		t.Error("unexpected threshold crossing")
+	}
+}
+
+// Unit Test for the Telegram notifier, webhook and link handlers
+func TestTelegramBot(t *testing.T) {
+	var sent []map[string]interface{}
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/bottest-token/sendMessage" {
+			t.Errorf("unexpected Bot API path %s", r.URL.Path)
+		}
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		sent = append(sent, body)
+		w.Write([]byte(`{"ok":true,"result":{}}`))
+	}))
+	defer api.Close()
+	bot := &TelegramBot{Token: "test-token", APIBase: api.URL, WebhookSecret: "s3cret", Client: api.Client()}
+
+	notifier := &TelegramNotifier{Bot: bot}
+	if err := notifier.ValidateTarget("not-a-chat"); err == nil {
+		t.Error("expected a non-numeric chat ID to be rejected")
+	}
+	alert := Alert{
+		Signal: Signal{Email: "a@example.com", AssetID: "bitcoin", PriceAtCreation: 60000, Targets: map[string]string{"telegram": "42"}},
+		Price:  63000, ChangePercent: 5, TriggeredAt: time.Now(),
+	}
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(sent) != 1 || sent[0]["chat_id"].(float64) != 42 || !strings.Contains(sent[0]["text"].(string), "+5.00%") {
+		t.Fatalf("unexpected message: %v", sent)
+	}
+
+	app := &App{telegram: bot}
+	update := `{"update_id":1,"message":{"text":"/help","chat":{"id":7}}}`
+
+	req := httptest.NewRequest(http.MethodPost, "/telegram/webhook", strings.NewReader(update))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "wrong")
+	rr := httptest.NewRecorder()
+	app.telegramWebhookHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a bad secret, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/telegram/webhook", strings.NewReader(update))
+	req.Header.Set("X-Telegram-Bot-Api-Secret-Token", "s3cret")
+	rr = httptest.NewRecorder()
+	app.telegramWebhookHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if len(sent) != 2 || sent[1]["chat_id"].(float64) != 7 || !strings.Contains(sent[1]["text"].(string), "/alert") {
+		t.Errorf("expected help reply to chat 7, got %v", sent)
+	}
+
+	// Link codes are only issued to the owner of the address.
+	bot.Username = "pricepulse_bot"
+	for _, target := range []string{"/telegram/link?email=a@example.com", "/telegram/link?token=garbage"} {
+		rr = httptest.NewRecorder()
+		app.telegramLinkHandler(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", target, rr.Code)
+		}
+	}
+
+	// Chat IDs from HTTP callers are ignored, and the linked chat needs proof of ownership.
+	token := url.QueryEscape(signPreferenceToken("a@example.com", time.Now().Add(time.Hour)))
+	signal := Signal{Email: "a@example.com", Channels: []string{"email"}, Targets: map[string]string{"telegram": "42"}}
+	if !authorizeTelegram(httptest.NewRequest(http.MethodPost, "/signals", nil), &signal) || signal.Targets["telegram"] != "" {
+		t.Errorf("expected a caller-supplied chat ID to be dropped, got %v", signal.Targets)
+	}
+	for target, want := range map[string]bool{"/signals": false, "/signals?token=" + token: true} {
+		signal := Signal{Email: "a@example.com", Channels: []string{"telegram"}, Targets: map[string]string{"telegram": "42"}}
+		if got := authorizeTelegram(httptest.NewRequest(http.MethodPost, target, nil), &signal); got != want || signal.Targets["telegram"] != "" {
+			t.Errorf("authorizeTelegram(%s) = %v with targets %v, want %v without a chat ID", target, got, signal.Targets, want)
+		}
+	}
+	escalating := Signal{Email: "a@example.com", Escalation: []EscalationStep{{AfterMinutes: 5, Channel: "telegram"}}}
+	if authorizeTelegram(httptest.NewRequest(http.MethodPost, "/signals", nil), &escalating) {
+		t.Error("expected escalating to Telegram to need proof of ownership")
+	}
+	rr = httptest.NewRecorder()
+	app.createSignalHandler(rr, httptest.NewRequest(http.MethodPost, "/signals", strings.NewReader(`{"email":"victim@example.com","assetId":"bitcoin","changeThresholdPercentage":5,"channels":["telegram"],"targets":{"telegram":"42"}}`)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a Telegram signal without proof of ownership, got %d", rr.Code)
+	}
+	app.channels = NewNotifierRegistry()
+	app.channels.Register("telegram", notifier)
+	if err := app.validateEscalation(Signal{Targets: map[string]string{"telegram": "42"}, Escalation: []EscalationStep{{AfterMinutes: 5, Channel: "telegram", Target: "43"}}}); err == nil {
+		t.Error("expected a chat ID in a telegram escalation step to be rejected")
+	}
+}
+
+// Unit Test for newOutboxEntries and nextOutboxState
+func TestOutboxEntries(t *testing.T) {
+	now := time.Now()
+	alert := Alert{
+		SignalID:      "sig-1",
+		Signal:        Signal{Email: "a@example.com", AssetID: "bitcoin", Channels: []string{"email", "slack"}},
+		Price:         70000,
+		ChangePercent: 6,
+		TriggeredAt:   now,
+	}
+	entries := newOutboxEntries(alert)
+	if len(entries) != 2 || entries[0].Channel != "email" || entries[1].Channel != "slack" {
+		t.Fatalf("expected one entry per channel, got %+v", entries)
+	}
+	if entries[1].Status != outboxPending || !entries[1].NextAttemptAt.Equal(now) {
+		t.Errorf("expected a pending entry due now, got %+v", entries[1])
+	}
+	if got := entries[1].alert(); got.SignalID != "sig-1" || len(got.Signal.Channels) != 1 || got.Signal.Channels[0] != "slack" {
+		t.Errorf("expected the rebuilt alert to target only slack, got %+v", got)
+	}
+
+	tests := []struct {
+		name     string
+		attempts int
+		err      error
+		want     string
+	}{
+		{"success", 1, nil, outboxDelivered},
+		{"transient failure", 1, errors.New("timeout"), outboxPending},
+		{"last attempt", 5, errors.New("timeout"), outboxDead},
+		{"permanent failure", 1, &permanentError{errors.New("410 Gone")}, outboxDead},
+	}
+	for _, tt := range tests {
+		state, next := nextOutboxState(tt.attempts, 5, tt.err, now)
+		if state != tt.want {
+			t.Errorf("%s: expected %s, got %s", tt.name, tt.want, state)
+		}
+		if state == outboxPending && !next.Equal(now.Add(outboxBaseDelay)) {
+			t.Errorf("%s: expected retry after %v, got %v", tt.name, outboxBaseDelay, next.Sub(now))
+		}
+	}
+}
+
+// Integration Test for triggerSignal: concurrent triggers of one signal queue its notifications once
+func TestTriggerSignalExactlyOnce(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "signals")
+	clearCollection(ctx, client, "notification_outbox")
+	clearCollection(ctx, client, "trigger_events")
+
+	app := &App{db: client}
+	signal := Signal{UserID: "u", Email: "u@example.com", AssetID: "bitcoin", ChangeThresholdPercentage: 1, PriceAtCreation: 100, Status: "active", CreatedAt: time.Now()}
+	ref, _, err := client.Collection("signals").Add(ctx, signal)
+	if err != nil {
+		t.Fatalf("Failed to add test signal: %v", err)
+	}
+
+	const runs = 5
+	results := make(chan bool, runs)
+	for i := 0; i < runs; i++ {
+		go func() {
+			won, err := app.triggerSignal(ctx, ref, Alert{SignalID: ref.ID, Signal: signal, Price: 110, ChangePercent: 10, TriggeredAt: time.Now()})
+			if err != nil {
+				t.Errorf("triggerSignal failed: %v", err)
+			}
+			results <- won
+		}()
+	}
+	winners := 0
+	for i := 0; i < runs; i++ {
+		if <-results {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Errorf("expected exactly one winning trigger, got %d", winners)
+	}
+	docs, err := client.Collection("notification_outbox").Where("signalId", "==", ref.ID).Documents(ctx).GetAll()
+	if err != nil {
+		t.Fatalf("Failed to query outbox: %v", err)
+	}
+	if len(docs) != 1 {
+		t.Errorf("expected one queued notification, got %d", len(docs))
+	}
+	events, err := app.triggerHistory(ctx, "u@example.com", ref.ID, 10)
+	if err != nil {
+		t.Fatalf("triggerHistory failed: %v", err)
+	}
+	if len(events) != 1 || events[0].Deliveries["email"].Status != outcomeQueued {
+		t.Errorf("expected one trigger event with a queued email delivery, got %+v", events)
+	}
+}
+
+// Unit Test for NotificationTemplates overrides and the template preview
+func TestNotificationTemplates(t *testing.T) {
+	alert := sampleAlert()
+	alert.Signal.AssetID = "<b>eth</b>"
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "subject.txt"), []byte("[{{.Direction}}] {{.AssetID}} {{.Change}}\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "email.html"), []byte("<p>{{.Subject}}: {{.Price}} ({{.Currency}})</p>"), 0o644)
+	templates, err := LoadNotificationTemplates(dir)
+	if err != nil {
+		t.Fatalf("LoadNotificationTemplates failed: %v", err)
+	}
+	if got := templates.Subject(alert); got != "[up] <b>eth</b> +5.00%" {
+		t.Errorf("unexpected subject %q", got)
+	}
+	text, html, err := templates.EmailBodies(alert)
+	if err != nil {
+		t.Fatalf("EmailBodies failed: %v", err)
+	}
+	if !strings.Contains(text, "The new price is $63,000.00") {
+		t.Errorf("expected the embedded text template, got %q", text)
+	}
+	if html != "<p>[up] &lt;b&gt;eth&lt;/b&gt; &#43;5.00%: $63,000.00 (USD)</p>" {
+		t.Errorf("expected an escaped HTML override, got %q", html)
+	}
+
+	os.WriteFile(filepath.Join(dir, "slack.txt"), []byte("{{.Nope"), 0o644)
+	if _, err := LoadNotificationTemplates(dir); err == nil {
+		t.Error("expected a broken override to fail loading")
+	}
+
+	t.Setenv("ADMIN_API_KEYS", "admin-key")
+	app := &App{}
+	req := httptest.NewRequest(http.MethodGet, "/admin/templates/preview?name=discord.txt&currency=eur&price=57000&baseline=60000", nil)
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rr := httptest.NewRecorder()
+	app.templatePreviewHandler(rr, req)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "-5.00%") || !strings.Contains(rr.Body.String(), "€57,000.00") {
+		t.Errorf("unexpected preview %d %q", rr.Code, rr.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/templates/preview?name=telegram.txt", strings.NewReader("{{.Subject}} / {{.Missing}}"))
+	req.Header.Set("Authorization", "Bearer admin-key")
+	rr = httptest.NewRecorder()
+	app.templatePreviewHandler(rr, req)
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a draft referencing an unknown field, got %d", rr.Code)
+	}
+}
+
+// Unit Test for digestDue, validateDelivery and digest rendering
+func TestDigest(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		prefs UserPreferences
+		want  bool
+	}{
+		{UserPreferences{Delivery: deliveryDaily}, true},
+		{UserPreferences{Delivery: deliveryDaily, LastDigestAt: now.Add(-23 * time.Hour)}, false},
+		{UserPreferences{Delivery: deliveryDaily, LastDigestAt: now.Add(-24*time.Hour + time.Minute)}, true},
+		{UserPreferences{Delivery: deliveryWeekly, LastDigestAt: now.Add(-48 * time.Hour)}, false},
+		{UserPreferences{Delivery: deliveryImmediate, LastDigestAt: now}, true},
+	}
+	for _, tt := range tests {
+		if got := digestDue(tt.prefs, now); got != tt.want {
+			t.Errorf("digestDue(%s, last %v ago) = %v, want %v", tt.prefs.Delivery, now.Sub(tt.prefs.LastDigestAt), got, tt.want)
+		}
+	}
+	if err := validateDelivery("monthly"); err == nil {
+		t.Error("expected an unknown delivery mode to be rejected")
+	}
+	if (UserPreferences{}).wantsDigest() {
+		t.Error("expected immediate delivery by default")
+	}
+
+	alert := sampleAlert()
+	data := sampleDigest(alert)
+	second := newDigestItem(alert, "")
+	second.AssetID, second.ChangePercent, second.Price = "ethereum", -7.5, 2775
+	data.Triggers = append(data.Triggers, digestTrigger(second))
+	subject, text, html, err := (*NotificationTemplates)(nil).RenderDigest(data)
+	if err != nil {
+		t.Fatalf("RenderDigest failed: %v", err)
+	}
+	if subject != "Your daily PricePulse digest: 2 alerts" {
+		t.Errorf("unexpected subject %q", subject)
+	}
+	for _, want := range []string{"bitcoin moved +5.00%", "ethereum moved -7.50%", "24h average $61,500.00 over 288 data points"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("digest text missing %q:\n%s", want, text)
+		}
+	}
+	if !strings.Contains(html, "<strong>$2,775.00</strong>") {
+		t.Errorf("unexpected digest HTML:\n%s", html)
+	}
+}
+
+// Unit Test for planDelivery and quiet hours
+func TestPlanDelivery(t *testing.T) {
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	prefs := UserPreferences{TimeZone: "Europe/Berlin", QuietStart: "22:00", QuietEnd: "07:00"}
+
+	night := time.Date(2024, 3, 10, 23, 30, 0, 0, berlin)
+	until, quiet := prefs.quietUntil(night)
+	if !quiet || !until.Equal(time.Date(2024, 3, 11, 7, 0, 0, 0, berlin)) {
+		t.Errorf("expected quiet until 07:00 the next morning, got %v %v", until, quiet)
+	}
+	if until, quiet := prefs.quietUntil(time.Date(2024, 3, 11, 3, 0, 0, 0, berlin)); !quiet || until.Day() != 11 {
+		t.Errorf("expected 03:00 to be quiet until the same morning, got %v %v", until, quiet)
+	}
+	if _, quiet := prefs.quietUntil(time.Date(2024, 3, 11, 12, 0, 0, 0, berlin)); quiet {
+		t.Error("expected noon not to be quiet")
+	}
+
+	plan, at, recent := planDelivery(prefs, false, night)
+	if plan != planHold || !at.Equal(until) || len(recent) != 1 {
+		t.Errorf("expected a held alert, got %s %v %d", plan, at, len(recent))
+	}
+	if plan, _, _ := planDelivery(prefs, true, night); plan != planDeliver {
+		t.Errorf("expected a critical alert to go out during quiet hours, got %s", plan)
+	}
+	prefs.QuietMode = quietDrop
+	if plan, _, _ := planDelivery(prefs, false, night); plan != planDrop {
+		t.Errorf("expected the alert to be dropped, got %s", plan)
+	}
+
+	noon := time.Date(2024, 3, 11, 12, 0, 0, 0, berlin)
+	limited := UserPreferences{MaxPerHour: 2, MaxPerDay: 3, RecentAlerts: []time.Time{
+		noon.Add(-25 * time.Hour), noon.Add(-5 * time.Hour), noon.Add(-30 * time.Minute),
+	}}
+	plan, _, recent = planDelivery(limited, false, noon)
+	if plan != planDeliver || len(recent) != 3 {
+		t.Errorf("expected delivery with the expired entry pruned, got %s %d", plan, len(recent))
+	}
+	limited.RecentAlerts = recent
+	if plan, _, _ := planDelivery(limited, false, noon.Add(time.Minute)); plan != planFold {
+		t.Errorf("expected the daily limit to fold the alert, got %s", plan)
+	}
+
+	if err := (UserPreferences{Delivery: deliveryImmediate, TimeZone: "Mars/Olympus"}).validate(); err == nil {
+		t.Error("expected an unknown time zone to be rejected")
+	}
+	if err := (UserPreferences{Delivery: deliveryImmediate, QuietStart: "22:00"}).validate(); err == nil {
+		t.Error("expected quiet hours without an end to be rejected")
+	}
+
+	app := &App{}
+	other := url.QueryEscape(signPreferenceToken("b@example.com", time.Now().Add(time.Hour)))
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/preferences?email=a@example.com", nil),
+		httptest.NewRequest(http.MethodGet, "/preferences?email=a@example.com&token="+other, nil),
+		httptest.NewRequest(http.MethodPost, "/preferences", strings.NewReader("email=a@example.com&delivery=immediate&quietMode=drop")),
+		httptest.NewRequest(http.MethodPost, "/preferences?token="+other, strings.NewReader("email=a@example.com&delivery=immediate&quietMode=drop")),
+	} {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		app.preferencesHandler(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s %s: expected 401 without proof of ownership, got %d", req.Method, req.URL, rr.Code)
+		}
+	}
+}
+
+// Integration Test for triggerSignal and sendDigests: only email alerts to confirmed addresses fold into a summary
+func TestRateLimitFold(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	for _, c := range []string{"signals", "preferences", "digest_queue", "trigger_events", "notification_outbox"} {
+		clearCollection(ctx, client, c)
+	}
+
+	mailer := &recordingMailer{}
+	app := &App{
+		db:     client,
+		mailer: mailer,
+		priceFetcher: func(assetID string, apiURL string) (map[string]map[string]interface{}, error) {
+			return map[string]map[string]interface{}{"bitcoin": {"usd": 110.0}}, nil
+		},
+	}
+	now := time.Now()
+	for email, verified := range map[string]bool{"verified@example.com": true, "unverified@example.com": false} {
+		client.Collection("preferences").Doc(email).Set(ctx, map[string]interface{}{
+			"email": email, "emailVerified": verified, "maxPerHour": 1, "recentAlerts": []time.Time{now.Add(-time.Minute)},
+		})
+	}
+	trigger := func(email string, channels []string) TriggerEvent {
+		signal := Signal{Email: email, AssetID: "bitcoin", ChangeThresholdPercentage: 1, PriceAtCreation: 100, Status: "active", Channels: channels, Targets: map[string]string{"slack": "https://hooks.slack.com/services/x"}}
+		ref, _, err := client.Collection("signals").Add(ctx, signal)
+		if err != nil {
+			t.Fatalf("Failed to add test signal: %v", err)
+		}
+		if _, err := app.triggerSignal(ctx, ref, Alert{SignalID: ref.ID, Signal: signal, Price: 110, ChangePercent: 10, TriggeredAt: now}); err != nil {
+			t.Fatalf("triggerSignal failed: %v", err)
+		}
+		events, err := app.triggerHistory(ctx, email, ref.ID, 1)
+		if err != nil || len(events) != 1 {
+			t.Fatalf("expected one trigger event, got %v %v", events, err)
+		}
+		return events[0]
+	}
+
+	if e := trigger("verified@example.com", []string{"slack"}); e.Deliveries["slack"].Status != outcomeDropped || len(e.Deliveries) != 1 {
+		t.Errorf("expected a Slack-only alert over the limit to be skipped without a summary, got %+v", e.Deliveries)
+	}
+	if e := trigger("unverified@example.com", []string{"email"}); e.Deliveries["email"].Status != outcomeSuppressed {
+		t.Errorf("expected no summary for an unconfirmed address, got %+v", e.Deliveries)
+	}
+	if e := trigger("verified@example.com", []string{"email", "slack"}); e.Deliveries["email"].Status != outcomeFolded || e.Deliveries["slack"].Status != outcomeDropped {
+		t.Errorf("expected only the email delivery to fold, got %+v", e.Deliveries)
+	}
+	docs, _ := client.Collection("digest_queue").Documents(ctx).GetAll()
+	if len(docs) != 1 || docs[0].Data()["email"] != "verified@example.com" {
+		t.Fatalf("expected one summary item for the confirmed address, got %d", len(docs))
+	}
+
+	// An item queued for an address that may not be emailed is dropped, not kept forever.
+	client.Collection("digest_queue").Add(ctx, DigestItem{Email: "unverified@example.com", AssetID: "bitcoin", TriggeredAt: now})
+	if sent, err := app.sendDigests(ctx, now); err != nil || sent != 1 {
+		t.Fatalf("expected one digest to be sent, got %d %v", sent, err)
+	}
+	if len(mailer.sent) != 1 || mailer.sent[0].To != "verified@example.com" {
+		t.Errorf("expected only the confirmed address to be emailed, got %+v", mailer.sent)
+	}
+	if docs, _ := client.Collection("digest_queue").Documents(ctx).GetAll(); len(docs) != 0 {
+		t.Errorf("expected the digest queue to be empty, got %d items", len(docs))
+	}
+}
+
+// Unit Test for unsubscribe tokens, List-Unsubscribe headers and unsubscribeHandler
+func TestUnsubscribeTokens(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://pricepulse.example.com")
+	token := signUnsubscribeToken("a@example.com")
+	if email, err := verifyUnsubscribeToken(token); err != nil || email != "a@example.com" {
+		t.Fatalf("expected the token to verify, got %q %v", email, err)
+	}
+	other := signUnsubscribeToken("b@example.com")
+	forged := strings.SplitN(other, ".", 2)[0] + "." + strings.SplitN(token, ".", 2)[1]
+	for _, bad := range []string{"", "garbage", forged} {
+		if _, err := verifyUnsubscribeToken(bad); err == nil {
+			t.Errorf("expected token %q to be rejected", bad)
+		}
+	}
+
+	msg, err := alertEmail(nil, sampleAlert())
+	if err != nil {
+		t.Fatalf("alertEmail failed: %v", err)
+	}
+	if !strings.Contains(msg.PlainText, "Unsubscribe: https://pricepulse.example.com/unsubscribe?token=") {
+		t.Errorf("expected an unsubscribe link in the body:\n%s", msg.PlainText)
+	}
+	raw, err := buildAlertMessage("alerts@example.com", msg)
+	if err != nil {
+		t.Fatalf("buildAlertMessage failed: %v", err)
+	}
+	parsed, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Failed to parse message: %v", err)
+	}
+	if got := parsed.Header.Get("List-Unsubscribe-Post"); got != "List-Unsubscribe=One-Click" {
+		t.Errorf("unexpected List-Unsubscribe-Post %q", got)
+	}
+	if got := parsed.Header.Get("List-Unsubscribe"); got != "<"+unsubscribeURL("you@example.com")+">" {
+		t.Errorf("unexpected List-Unsubscribe %q", got)
+	}
+
+	app := &App{}
+	rr := httptest.NewRecorder()
+	app.unsubscribeHandler(rr, httptest.NewRequest(http.MethodPost, "/unsubscribe?token="+url.QueryEscape(forged), strings.NewReader("List-Unsubscribe=One-Click")))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a forged token, got %d", rr.Code)
+	}
+	rr = httptest.NewRecorder()
+	app.unsubscribeHandler(rr, httptest.NewRequest(http.MethodGet, "/unsubscribe?token="+url.QueryEscape(token), nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `method="post"`) {
+		t.Errorf("expected GET to show an unsubscribe button, got %d %s", rr.Code, rr.Body.String())
+	}
+
+	now := time.Now()
+	preferences := signPreferenceToken("a@example.com", now.Add(time.Hour))
+	if email, err := verifyPreferenceToken(preferences, now); err != nil || email != "a@example.com" {
+		t.Errorf("expected the preference token to verify, got %q %v", email, err)
+	}
+	if _, err := verifyPreferenceToken(preferences, now.Add(2*time.Hour)); err == nil {
+		t.Error("expected an expired preference token to be rejected")
+	}
+	if _, err := verifyPreferenceToken(token, now); err == nil {
+		t.Error("expected an unsubscribe token to be rejected as a preference token")
+	}
+	if !strings.Contains(preferenceCenterURL("a@example.com"), "/email-preferences?token=") {
+		t.Errorf("unexpected preference center URL %q", preferenceCenterURL("a@example.com"))
+	}
+	for _, bad := range []string{token, signPreferenceToken("a@example.com", now.Add(-time.Minute))} {
+		rr = httptest.NewRecorder()
+		app.emailPreferencesHandler(rr, httptest.NewRequest(http.MethodGet, "/email-preferences?token="+url.QueryEscape(bad), nil))
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected 403 from the preference center for token %q, got %d", bad, rr.Code)
+		}
+	}
+}
+
+// Unit Test for verification tokens, the confirmation email and verifyEmailHandler
+func TestVerificationTokens(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://pricepulse.example.com")
+	now := time.Now()
+	token := signVerificationToken("a|b@example.com", now.Add(time.Hour))
+	if email, err := verifyVerificationToken(token, now); err != nil || email != "a|b@example.com" {
+		t.Fatalf("expected the token to verify, got %q %v", email, err)
+	}
+	if _, err := verifyVerificationToken(token, now.Add(2*time.Hour)); err == nil {
+		t.Error("expected an expired token to be rejected")
+	}
+	if _, err := verifyVerificationToken(signUnsubscribeToken("a@example.com"), now); err == nil {
+		t.Error("expected an unsubscribe token to be rejected as a confirmation token")
+	}
+	if _, err := verifyUnsubscribeToken(token); err == nil {
+		t.Error("expected a confirmation token to be rejected as an unsubscribe token")
+	}
+
+	if usesEmail(Signal{Channels: []string{"telegram"}}) || !usesEmail(Signal{}) {
+		t.Error("expected only signals delivering by email to need verification")
+	}
+
+	subject, text, html, err := (*NotificationTemplates)(nil).RenderVerification(sampleVerification("you@example.com"))
+	if err != nil {
+		t.Fatalf("RenderVerification failed: %v", err)
+	}
+	if subject == "" || !strings.Contains(text, "https://pricepulse.example.com/verify?token=") || !strings.Contains(html, "you@example.com") {
+		t.Errorf("unexpected confirmation email %q\n%s\n%s", subject, text, html)
+	}
+
+	app := &App{}
+	rr := httptest.NewRecorder()
+	expired := signVerificationToken("a@example.com", now.Add(-time.Minute))
+	app.verifyEmailHandler(rr, httptest.NewRequest(http.MethodGet, "/verify?token="+url.QueryEscape(expired), nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for an expired link, got %d", rr.Code)
+	}
+	// Opening the link only shows a button; the address is confirmed by the POST.
+	valid := url.QueryEscape(signVerificationToken("a@example.com", now.Add(time.Hour)))
+	rr = httptest.NewRecorder()
+	app.verifyEmailHandler(rr, httptest.NewRequest(http.MethodGet, "/verify?token="+valid, nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `<form method="post" action="/verify?token=`) {
+		t.Errorf("expected GET to render a confirmation form, got %d:\n%s", rr.Code, rr.Body.String())
+	}
+}
+
+// Unit Test for sendGridEventsHandler signatures and suspension rules
+func TestSendGridEvents(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	sign := func(timestamp string, body []byte) string {
+		digest := sha256.Sum256(append([]byte(timestamp), body...))
+		sig, _ := ecdsa.SignASN1(rand.Reader, key, digest[:])
+		return base64.StdEncoding.EncodeToString(sig)
+	}
+	body := []byte(`[{"email":"bounced@example.com","event":"bounce","type":"bounce","reason":"550 no such user","timestamp":1700000000,"sg_message_id":"msg1.filter0001","sg_event_id":"e1","signal_id":"s1","kind":"alert"},` +
+		`{"email":"bounced@example.com","event":"delivered","timestamp":1699999990,"sg_message_id":"msg1.filter0001","sg_event_id":"e2"}]`)
+
+	app := &App{}
+	rr := httptest.NewRecorder()
+	app.sendGridEventsHandler(rr, httptest.NewRequest(http.MethodPost, "/sendgrid/events", bytes.NewReader(body)))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 without a public key, got %d", rr.Code)
+	}
+
+	t.Setenv("SENDGRID_WEBHOOK_PUBLIC_KEY", base64.StdEncoding.EncodeToString(der))
+	req := httptest.NewRequest(http.MethodPost, "/sendgrid/events", bytes.NewReader(body))
+	req.Header.Set(sendGridTimestampHeader, "1700000001")
+	req.Header.Set(sendGridSignatureHeader, sign("1700000002", body))
+	rr = httptest.NewRecorder()
+	app.sendGridEventsHandler(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a signature over another timestamp, got %d", rr.Code)
+	}
+	now := time.Unix(1700000000, 0)
+	for name, tc := range map[string]struct {
+		timestamp string
+		ok        bool
+	}{
+		"fresh":   {"1699999900", true},
+		"stale":   {"1699999000", false},
+		"future":  {"1700001000", false},
+		"missing": {"", false},
+	} {
+		if got := verifySendGridSignature(&key.PublicKey, sign(tc.timestamp, body), tc.timestamp, body, now); got != tc.ok {
+			t.Errorf("%s timestamp: expected ok=%v, got %v", name, tc.ok, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		event   SendGridEvent
+		suspend bool
+	}{
+		{SendGridEvent{Event: "bounce", Type: "bounce"}, true},
+		{SendGridEvent{Event: "bounce", Type: "blocked"}, false},
+		{SendGridEvent{Event: "spamreport"}, true},
+		{SendGridEvent{Event: "dropped", Reason: "Bounced Address"}, true},
+		{SendGridEvent{Event: "dropped", Reason: "Invalid SMTPAPI header"}, false},
+		{SendGridEvent{Event: "deferred"}, false},
+	} {
+		if got := tc.event.suspensionReason() != ""; got != tc.suspend {
+			t.Errorf("%s/%s/%s: expected suspend=%v", tc.event.Event, tc.event.Type, tc.event.Reason, tc.suspend)
+		}
+	}
+
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "email_messages")
+	clearCollection(ctx, client, "preferences")
+
+	app = &App{db: client}
+	req = httptest.NewRequest(http.MethodPost, "/sendgrid/events", bytes.NewReader(body))
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(sendGridTimestampHeader, ts)
+	req.Header.Set(sendGridSignatureHeader, sign(ts, body))
+	rr = httptest.NewRecorder()
+	app.sendGridEventsHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	doc, err := client.Collection("email_messages").Doc("msg1").Get(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read message record: %v", err)
+	}
+	if got := doc.Data()["status"]; got != "bounce" {
+		t.Errorf("expected a late delivered event not to hide the bounce, got status %v", got)
+	}
+	prefs, err := app.getPreferences(ctx, "bounced@example.com")
+	if err != nil {
+		t.Fatalf("getPreferences failed: %v", err)
+	}
+	if !prefs.EmailSuspended || !prefs.emailBlocked() {
+		t.Error("expected a hard bounce to suspend email delivery")
+	}
+}
+
+// Unit Test for trigger events on the signals page
+func TestTriggerEvents(t *testing.T) {
+	alert := sampleAlert()
+	alert.Signal.Channels = []string{"email", "slack"}
+	event := newTriggerEvent(alert)
+	event.setOutcome("email", outcomeDigest)
+	event.Deliveries["slack"] = DeliveryOutcome{Status: outboxOutcomes[outboxDead], Attempts: 5, LastError: "HTTP 500"}
+	if event.Baseline != 60000 || event.Price != 63000 || len(event.Channels) != 2 {
+		t.Errorf("unexpected trigger event %+v", event)
+	}
+
+	tmpl, err := template.New("user_page.html").Funcs(template.FuncMap{"formatPrice": formatPrice, "formatChange": formatChange}).ParseFS(templatesFS, "templates/user_page.html")
+	if err != nil {
+		t.Fatalf("Failed to parse user page: %v", err)
+	}
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, map[string]interface{}{
+		"Email":       "you@example.com",
+		"Analysis":    AnalysisResult{},
+		"Preferences": UserPreferences{},
+		"Delivery":    deliveryImmediate,
+		"Triggers":    []TriggerEvent{event},
+	})
+	if err != nil {
+		t.Fatalf("Failed to render user page: %v", err)
+	}
+	for _, want := range []string{"$63,000.00", "&#43;5.00%", "email: digest", `title="HTTP 500">slack: failed`} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected the Triggered section to contain %q", want)
+		}
+	}
+
+	// Stored errors never quote the request URL, which can hold a secret.
+	bot := &TelegramBot{Token: "123:secret-token", APIBase: "http://127.0.0.1:1", Client: &http.Client{Timeout: time.Second}}
+	transportErr := bot.SendMessage(context.Background(), 42, "hi")
+	if transportErr == nil || !strings.Contains(transportErr.Error(), "secret-token") {
+		t.Fatalf("expected a transport error quoting the URL, got %v", transportErr)
+	}
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{transportErr, "connection failed"},
+		{fmt.Errorf("slack: %w", &httpStatusError{404, "webhook returned status 404: no_service https://hooks.slack.com/services/T0/B0/secret"}), "status 404"},
+		{&permanentError{&httpStatusError{410, "endpoint returned status 410"}}, "status 410"},
+		{&url.Error{Op: "Post", URL: "https://discord.com/api/webhooks/1/secret", Err: context.DeadlineExceeded}, "timeout"},
+		{&textproto.Error{Code: 550, Msg: "mailbox unavailable"}, "SMTP status 550"},
+		{&permanentError{errors.New("no browsers subscribed to push for you@example.com")}, "not deliverable"},
+		{errors.New("something else"), "delivery failed"},
+	} {
+		if got := redactDeliveryError(tc.err); got != tc.want {
+			t.Errorf("redactDeliveryError(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	(&App{}).triggerHistoryHandler(rr, httptest.NewRequest(http.MethodGet, "/triggers?email=you@example.com", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for /triggers without proof of ownership, got %d", rr.Code)
+	}
+}
+
+// Unit Test for escalation policies and acknowledge links
+func TestEscalation(t *testing.T) {
+	t.Setenv("PUBLIC_BASE_URL", "https://pricepulse.example.com")
+	app := &App{}
+	for _, tc := range []struct {
+		steps []EscalationStep
+		ok    bool
+	}{
+		{[]EscalationStep{{AfterMinutes: 10, Channel: "email", Target: "cfo@example.com"}, {AfterMinutes: 30, Channel: "email"}}, true},
+		{[]EscalationStep{{AfterMinutes: 10, Channel: "email"}, {AfterMinutes: 10, Channel: "email"}}, false},
+		{[]EscalationStep{{AfterMinutes: 0, Channel: "email"}}, false},
+		{[]EscalationStep{{AfterMinutes: 10, Channel: "email", Target: "not an address"}}, false},
+		{[]EscalationStep{{AfterMinutes: 10, Channel: "slack"}}, false},
+	} {
+		if err := app.validateEscalation(Signal{Escalation: tc.steps}); (err == nil) != tc.ok {
+			t.Errorf("validateEscalation(%+v) = %v, expected ok=%v", tc.steps, err, tc.ok)
+		}
+	}
+
+	original := Signal{Email: "me@example.com", Channels: []string{"email", "slack"}, Targets: map[string]string{"slack": "https://hooks.slack.com/a"}}
+	teammate := escalationSignal(original, EscalationStep{Channel: "email", Target: "cfo@example.com"})
+	if teammate.Email != "cfo@example.com" || len(teammate.Channels) != 1 {
+		t.Errorf("expected the escalation to email the teammate, got %+v", teammate)
+	}
+	other := escalationSignal(original, EscalationStep{Channel: "slack", Target: "https://hooks.slack.com/b"})
+	if other.Targets["slack"] != "https://hooks.slack.com/b" || original.Targets["slack"] != "https://hooks.slack.com/a" {
+		t.Error("expected the escalation target to override a copy of the signal's targets")
+	}
+
+	alert := sampleAlert()
+	event := newTriggerEvent(alert)
+	from := alert.TriggeredAt.Add(8 * time.Hour)
+	event.startEscalation([]EscalationStep{{AfterMinutes: 10, Channel: "email"}}, from)
+	if event.EscalationStatus != escalationPending || !event.EscalationStartedAt.Equal(from) || !event.NextEscalationAt.Equal(from.Add(10*time.Minute)) {
+		t.Errorf("unexpected escalation state %+v", event)
+	}
+
+	if text, _ := (*NotificationTemplates)(nil).Render("email.txt", alert); strings.Contains(text, "Acknowledge") {
+		t.Error("expected no acknowledge link without a trigger event")
+	}
+	alert.TriggerID = "trigger1"
+	text, err := (*NotificationTemplates)(nil).Render("email.txt", alert)
+	if err != nil || !strings.Contains(text, "Acknowledge: https://pricepulse.example.com/ack?token=") {
+		t.Fatalf("expected an acknowledge link, got %q %v", text, err)
+	}
+	token, _ := url.QueryUnescape(text[strings.Index(text, "token=")+len("token=") : strings.Index(text, "\n\n--")])
+	if triggerID, recipient, err := verifyAckToken(token); err != nil || triggerID != "trigger1" || recipient != "you@example.com" {
+		t.Errorf("unexpected acknowledge token %q %q %v", triggerID, recipient, err)
+	}
+	rr := httptest.NewRecorder()
+	app.ackHandler(rr, httptest.NewRequest(http.MethodPost, "/ack?token="+url.QueryEscape(signUnsubscribeToken("trigger1|x")), nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected 403 for a token signed for another purpose, got %d", rr.Code)
+	}
+
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "trigger_events")
+	clearCollection(ctx, client, "notification_outbox")
+
+	app = &App{db: client}
+	event = newTriggerEvent(sampleAlert())
+	event.TriggeredAt = time.Now().Add(-15 * time.Minute)
+	event.startEscalation([]EscalationStep{{AfterMinutes: 10, Channel: "slack", Target: "https://hooks.slack.com/b"}, {AfterMinutes: 20, Channel: "email"}}, event.TriggeredAt)
+	ref, _, err := client.Collection("trigger_events").Add(ctx, event)
+	if err != nil {
+		t.Fatalf("Failed to add trigger event: %v", err)
+	}
+	if n, err := app.processEscalations(ctx, time.Now()); err != nil || n != 1 {
+		t.Fatalf("expected one escalation, got %d %v", n, err)
+	}
+	if n, _ := app.processEscalations(ctx, time.Now()); n != 0 {
+		t.Errorf("expected the second step not to be due yet, got %d escalations", n)
+	}
+	entries, err := client.Collection("notification_outbox").Where("triggerId", "==", ref.ID).Documents(ctx).GetAll()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one escalation in the outbox, got %d %v", len(entries), err)
+	}
+	var entry OutboxEntry
+	entries[0].DataTo(&entry)
+	if entry.Escalation != 1 || entry.Signal.Targets["slack"] != "https://hooks.slack.com/b" {
+		t.Errorf("unexpected escalation entry %+v", entry)
+	}
+
+	acked, err := app.acknowledge(ctx, ref.ID, "slack")
+	if err != nil || acked.EscalationStatus != escalationAcknowledged || acked.AcknowledgedBy != "slack" {
+		t.Fatalf("unexpected acknowledgement %+v %v", acked, err)
+	}
+	if n, _ := app.processEscalations(ctx, time.Now().Add(time.Hour)); n != 0 {
+		t.Errorf("expected no escalation after acknowledgement, got %d", n)
+	}
+
+	// A trigger held by quiet hours escalates only after they end, and one whose email
+	// only goes to a digest does not escalate at all.
+	clearCollection(ctx, client, "signals")
+	clearCollection(ctx, client, "preferences")
+	triggeredAt := time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC)
+	client.Collection("preferences").Doc("quiet@example.com").Set(ctx, UserPreferences{Email: "quiet@example.com", QuietStart: "22:00", QuietEnd: "07:00", QuietMode: quietHold})
+	client.Collection("preferences").Doc("digest@example.com").Set(ctx, UserPreferences{Email: "digest@example.com", Delivery: deliveryDaily})
+	for email, wantNext := range map[string]time.Time{
+		"quiet@example.com":  time.Date(2024, 1, 2, 7, 10, 0, 0, time.UTC),
+		"digest@example.com": {},
+	} {
+		signal := Signal{UserID: email, Email: email, AssetID: "bitcoin", Channels: []string{"email"}, ChangeThresholdPercentage: 1, PriceAtCreation: 100, Status: "active",
+			Escalation: []EscalationStep{{AfterMinutes: 10, Channel: "email", Target: "cfo@example.com"}}}
+		signalRef, _, err := client.Collection("signals").Add(ctx, signal)
+		if err != nil {
+			t.Fatalf("Failed to add test signal: %v", err)
+		}
+		if _, err := app.triggerSignal(ctx, signalRef, Alert{SignalID: signalRef.ID, Signal: signal, Price: 110, ChangePercent: 10, TriggeredAt: triggeredAt}); err != nil {
+			t.Fatalf("triggerSignal failed: %v", err)
+		}
+		events, err := app.triggerHistory(ctx, email, signalRef.ID, 1)
+		if err != nil || len(events) != 1 {
+			t.Fatalf("expected one trigger event for %s, got %d %v", email, len(events), err)
+		}
+		if wantNext.IsZero() {
+			if events[0].EscalationStatus != "" {
+				t.Errorf("expected no escalation for %s, got %+v", email, events[0])
+			}
+		} else if events[0].EscalationStatus != escalationPending || !events[0].NextEscalationAt.Equal(wantNext) {
+			t.Errorf("expected %s to escalate at %v, got %s at %v", email, wantNext, events[0].EscalationStatus, events[0].NextEscalationAt)
+		}
+	}
+}
+
+// decryptWebPush reverses encryptWebPush as a browser would, for the push-service
+// stand-in.
+func decryptWebPush(t *testing.T, body []byte, uaKey *ecdh.PrivateKey, authSecret []byte) []byte {
+	t.Helper()
+	if len(body) < 21 {
+		t.Fatalf("push body too short: %d bytes", len(body))
+	}
+	salt, idLen := body[:16], int(body[20])
+	asPublic, ciphertext := body[21:21+idLen], body[21+idLen:]
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		t.Fatalf("invalid sender key: %v", err)
+	}
+	secret, err := uaKey.ECDH(asKey)
+	if err != nil {
+		t.Fatalf("ECDH failed: %v", err)
+	}
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaKey.PublicKey().Bytes()...), asPublic...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+	block, _ := aes.NewCipher(hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16))
+	gcm, _ := cipher.NewGCM(block)
+	plaintext, err := gcm.Open(nil, hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12), ciphertext, nil)
+	if err != nil {
+		t.Fatalf("failed to decrypt push message: %v", err)
+	}
+	return bytes.TrimRight(plaintext[:len(plaintext)-1], "\x00")
+}
+
+// Unit Test for Web Push encryption, VAPID signing and WebPushNotifier
+func TestWebPush(t *testing.T) {
+	b64 := func(s string) []byte {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			t.Fatalf("bad test vector %q: %v", s, err)
+		}
+		return b
+	}
+	// The example from RFC 8291, Section 5.
+	asKey, err := ecdh.P256().NewPrivateKey(b64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatalf("bad RFC key: %v", err)
+	}
+	got, err := encryptWebPush([]byte("When I grow up, I want to be a watermelon"),
+		b64("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		b64("BTBZMqHH6r4Tts7J_aSIgg"), asKey, b64("DGv6ra1nlYgDCS1FRnbzlw"))
+	if err != nil {
+		t.Fatalf("encryptWebPush failed: %v", err)
+	}
+	want := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if enc := base64.RawURLEncoding.EncodeToString(got); enc != want {
+		t.Errorf("RFC 8291 example mismatch:\n got %s\nwant %s", enc, want)
+	}
+	// The largest payload fills the 4096 bytes push services must accept.
+	uaPublic := b64("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4")
+	largest, err := encryptWebPush(bytes.Repeat([]byte("x"), webPushMaxPayload), uaPublic, b64("BTBZMqHH6r4Tts7J_aSIgg"), asKey, b64("DGv6ra1nlYgDCS1FRnbzlw"))
+	if err != nil || len(largest) != 4096 {
+		t.Errorf("expected a %d-byte payload to encrypt to 4096 bytes, got %d %v", webPushMaxPayload, len(largest), err)
+	}
+	if _, err := encryptWebPush(bytes.Repeat([]byte("x"), webPushMaxPayload+1), uaPublic, b64("BTBZMqHH6r4Tts7J_aSIgg"), asKey, b64("DGv6ra1nlYgDCS1FRnbzlw")); err == nil {
+		t.Error("expected a payload over the limit to be rejected")
+	}
+
+	// A local push service stand-in that checks the VAPID JWT and decrypts messages
+	// with the browser's keys.
+	t.Setenv("PUBLIC_BASE_URL", "https://pricepulse.example.com")
+	keys, _, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatalf("GenerateVAPIDKeys failed: %v", err)
+	}
+	uaKey, _ := ecdh.P256().GenerateKey(rand.Reader)
+	authSecret := make([]byte, 16)
+	rand.Read(authSecret)
+	var received []WebPushPayload
+	var service *httptest.Server
+	service = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/gone" {
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" || r.Header.Get("Urgency") != "high" {
+			t.Errorf("unexpected push headers %v", r.Header)
+		}
+		jwt, k, ok := strings.Cut(strings.TrimPrefix(r.Header.Get("Authorization"), "vapid t="), ", k=")
+		if !ok || k != keys.Public {
+			t.Errorf("unexpected Authorization %q", r.Header.Get("Authorization"))
+		}
+		parts := strings.Split(jwt, ".")
+		var claims map[string]interface{}
+		json.Unmarshal(b64(parts[1]), &claims)
+		if claims["aud"] != service.URL {
+			t.Errorf("expected the JWT audience to be the push service origin, got %v", claims["aud"])
+		}
+		pub, _ := ecdh.P256().NewPublicKey(b64(k))
+		x, y := new(big.Int).SetBytes(pub.Bytes()[1:33]), new(big.Int).SetBytes(pub.Bytes()[33:])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		sig := b64(parts[2])
+		if !ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			t.Error("VAPID JWT signature does not verify")
+		}
+		body, _ := io.ReadAll(r.Body)
+		var payload WebPushPayload
+		if err := json.Unmarshal(decryptWebPush(t, body, uaKey, authSecret), &payload); err != nil {
+			t.Errorf("push payload is not JSON: %v", err)
+		}
+		received = append(received, payload)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer service.Close()
+
+	subscription := func(endpoint string) PushSubscription {
+		return PushSubscription{
+			Email:    "you@example.com",
+			Endpoint: endpoint,
+			P256dh:   base64.RawURLEncoding.EncodeToString(uaKey.PublicKey().Bytes()),
+			Auth:     base64.RawURLEncoding.EncodeToString(authSecret),
+		}
+	}
+	var expired []string
+	notifier := &WebPushNotifier{
+		Keys:    keys,
+		Subject: "mailto:ops@example.com",
+		Subscriptions: func(ctx context.Context, email string) ([]PushSubscription, error) {
+			return []PushSubscription{subscription(service.URL + "/push/1"), subscription(service.URL + "/gone")}, nil
+		},
+		Expired: func(ctx context.Context, sub PushSubscription) { expired = append(expired, sub.Endpoint) },
+		Client:  service.Client(),
+	}
+	alert := sampleAlert()
+	alert.TriggerID = "trigger1"
+	alert.Signal.Critical = true
+	if err := notifier.Notify(context.Background(), alert); err != nil {
+		t.Fatalf("Notify failed: %v", err)
+	}
+	if len(received) != 1 || received[0].Title != "Price Alert for bitcoin" || !strings.Contains(received[0].Body, "$63,000.00") || received[0].AckURL == "" {
+		t.Errorf("unexpected push payloads %+v", received)
+	}
+	if len(expired) != 1 || !strings.HasSuffix(expired[0], "/gone") {
+		t.Errorf("expected the gone subscription to be removed, got %v", expired)
+	}
+
+	notifier.Subscriptions = func(ctx context.Context, email string) ([]PushSubscription, error) { return nil, nil }
+	var perm *permanentError
+	if err := notifier.Notify(context.Background(), alert); !errors.As(err, &perm) {
+		t.Errorf("expected a permanent error without subscriptions, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	(&App{}).serviceWorkerHandler(rr, httptest.NewRequest(http.MethodGet, "/sw.js", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "showNotification") {
+		t.Errorf("unexpected service worker response %d", rr.Code)
+	}
+
+	for endpoint, want := range map[string]bool{
+		"https://fcm.googleapis.com/fcm/send/abc":               true,
+		"https://updates.push.services.mozilla.com/wpush/v2/x":  true,
+		"https://wns2-by3p.notify.windows.com/w/?token=x":       true,
+		"https://web.push.apple.com/QG":                         true,
+		"http://fcm.googleapis.com/fcm/send/abc":                false,
+		"https://fcm.googleapis.com:8443/fcm/send/abc":          false,
+		"https://169.254.169.254/computeMetadata/v1/":           false,
+		"https://evilnotify.windows.com.attacker.example/push":  false,
+		"https://fcm.googleapis.com.attacker.example/fcm/send/": false,
+	} {
+		if got := isPushServiceEndpoint(endpoint); got != want {
+			t.Errorf("isPushServiceEndpoint(%q) = %v, want %v", endpoint, got, want)
+		}
+	}
+	app := &App{webPush: notifier}
+	body := fmt.Sprintf(`{"email":"you@example.com","subscription":{"endpoint":%q,"keys":{"p256dh":%q,"auth":%q}}}`,
+		"https://fcm.googleapis.com/fcm/send/abc", subscription("").P256dh, subscription("").Auth)
+	for target, want := range map[string]int{
+		"/push/subscriptions": http.StatusUnauthorized,
+		"/push/subscriptions?token=" + url.QueryEscape(signPreferenceToken("other@example.com", time.Now().Add(time.Hour))): http.StatusUnauthorized,
+	} {
+		rr = httptest.NewRecorder()
+		app.pushSubscriptionsHandler(rr, httptest.NewRequest(http.MethodPost, target, strings.NewReader(body)))
+		if rr.Code != want {
+			t.Errorf("POST %s: expected %d, got %d %s", target, want, rr.Code, rr.Body.String())
+		}
+	}
+	rr = httptest.NewRecorder()
+	app.pushSubscriptionsHandler(rr, httptest.NewRequest(http.MethodPost, "/push/subscriptions", strings.NewReader(strings.Replace(body, "https://fcm.googleapis.com", "https://10.0.0.1", 1))))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected an endpoint outside the push services to be rejected, got %d", rr.Code)
+	}
+}
+
+// recordingMailer is an EmailNotifier that keeps the emails it is asked to send.
+type recordingMailer struct {
+	sent []EmailMessage
+}
+
+func (m *recordingMailer) Notify(ctx context.Context, alert Alert) error { return nil }
+
+func (m *recordingMailer) SendEmail(ctx context.Context, msg EmailMessage) error {
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+// Unit Test for inbound email parsing, sender checks and inboundEmailHandler
+func TestInboundEmail(t *testing.T) {
+	t.Setenv("INBOUND_EMAIL_ADDRESS", "alerts@parse.example.com")
+	if got := inboundReplyAddress("sig1"); got != "alerts+sig1@parse.example.com" {
+		t.Errorf("unexpected reply address %q", got)
+	}
+	if got := inboundSignalTag(`"PricePulse" <alerts+sig1@Parse.example.com>, other@example.com`); got != "sig1" {
+		t.Errorf("expected the signal tag, got %q", got)
+	}
+	if got := inboundSignalTag("alerts@parse.example.com"); got != "" {
+		t.Errorf("expected no tag on the plain address, got %q", got)
+	}
+
+	for _, tc := range []struct{ subject, text, want string }{
+		{"Re: Re: Alert for bitcoin", "PAUSE\n\nOn Mon, Jan 1, 2024 PricePulse wrote:\n> Alert for bitcoin!", "PAUSE"},
+		{"RE: Alert for bitcoin", "\n> STOP quoted\n", "Alert for bitcoin"},
+		{"bitcoin down 5%", "", "bitcoin down 5%"},
+		{"Fwd: x", "  ethereum up 3% eur  \n--\nsignature", "ethereum up 3% eur"},
+	} {
+		if got := emailCommandLine(tc.subject, tc.text); got != tc.want {
+			t.Errorf("emailCommandLine(%q, %q) = %q, want %q", tc.subject, tc.text, got, tc.want)
+		}
+	}
+
+	for dkim, want := range map[string]bool{
+		"{@other.com : fail, @example.com : pass}": true,
+		"{@example.com : pass}":                    true,
+		"{@EXAMPLE.com : pass}":                    true,
+		"{@example.com : fail}":                    false,
+		"{@other.com : pass}":                      false,
+		"{@ample.com : pass}":                      false,
+		"":                                         false,
+	} {
+		if got := senderAuthenticated(dkim, "a@example.com"); got != want {
+			t.Errorf("senderAuthenticated(%q) = %v, want %v", dkim, got, want)
+		}
+	}
+	if !senderAuthenticated("{@example.com : pass}", "a@mail.example.com") {
+		t.Error("expected a signature for the parent domain to align")
+	}
+
+	reply := inboundReply("a@example.com", "bitcoin 5%", "Message-ID: <abc@mail.example.com>\nFrom: a@example.com\n", "done <ok>")
+	if reply.Subject != "Re: bitcoin 5%" || reply.Headers["In-Reply-To"] != "<abc@mail.example.com>" || !strings.Contains(reply.HTML, "done &lt;ok&gt;") {
+		t.Errorf("unexpected reply %+v", reply)
+	}
+
+	form := url.Values{"from": {"User <user@example.com>"}, "to": {"alerts@parse.example.com"}, "dkim": {"{@example.com : pass}"}, "subject": {"bitcoin down 5%"}}
+	app := &App{}
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/inbound-email?secret=", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	app.inboundEmailHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without INBOUND_PARSE_SECRET, got %d", rr.Code)
+	}
+	t.Setenv("INBOUND_PARSE_SECRET", "s3cret")
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/inbound-email?secret=wrong", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	app.inboundEmailHandler(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 for a wrong secret, got %d", rr.Code)
+	}
+
+	// A forged From passes SPF for the attacker's own envelope domain but carries no
+	// DKIM signature from example.com, so it must be ignored before any lookup.
+	forged := url.Values{"from": {"user@example.com"}, "to": {"alerts@parse.example.com"}, "SPF": {"pass"}, "dkim": {"{@attacker.example.net : pass}"}, "subject": {"STOP"}}
+	forgedMailer := &recordingMailer{}
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPost, "/inbound-email?secret=s3cret", strings.NewReader(forged.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	(&App{mailer: forgedMailer}).inboundEmailHandler(rr, req)
+	if rr.Code != http.StatusOK || len(forgedMailer.sent) != 0 {
+		t.Errorf("expected a forged sender to be acknowledged and ignored, got %d and %d replies", rr.Code, len(forgedMailer.sent))
+	}
+
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "signals")
+	clearCollection(ctx, client, "preferences")
+
+	mailer := &recordingMailer{}
+	app = &App{
+		db:     client,
+		mailer: mailer,
+		priceFetcher: func(assetID string, apiURL string) (map[string]map[string]interface{}, error) {
+			return map[string]map[string]interface{}{"bitcoin": {"usd": 68000.00}}, nil
+		},
+	}
+	post := func(form url.Values) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/inbound-email?secret=s3cret", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		app.inboundEmailHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+		}
+	}
+
+	post(form)
+	if len(mailer.sent) != 0 {
+		t.Fatal("expected an unverified sender to be ignored")
+	}
+	client.Collection("preferences").Doc("user@example.com").Set(ctx, map[string]interface{}{"email": "user@example.com", "emailVerified": true})
+
+	post(form)
+	docs, err := client.Collection("signals").Where("email", "==", "user@example.com").Documents(ctx).GetAll()
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("expected one signal to be created, got %d (%v)", len(docs), err)
+	}
+	var s Signal
+	docs[0].DataTo(&s)
+	if s.Direction != "down" || s.ChangeThresholdPercentage != 5 || s.Status != "active" {
+		t.Errorf("unexpected signal %+v", s)
+	}
+	if len(mailer.sent) != 1 || !strings.Contains(mailer.sent[0].PlainText, docs[0].Ref.ID) {
+		t.Fatalf("expected a confirmation reply, got %+v", mailer.sent)
+	}
+
+	post(url.Values{"from": {"user@example.com"}, "to": {"alerts+" + docs[0].Ref.ID + "@parse.example.com"}, "dkim": {"{@example.com : pass}"}, "subject": {"Re: Alert for bitcoin"}, "text": {"pause\n> quoted"}})
+	doc, _ := docs[0].Ref.Get(ctx)
+	if got := doc.Data()["status"]; got != "paused" {
+		t.Errorf("expected a PAUSE reply to pause its signal, got %v", got)
+	}
+
+	post(url.Values{"from": {"user@example.com"}, "to": {"alerts@parse.example.com"}, "dkim": {"{@example.com : pass}"}, "subject": {"STOP"}})
+	prefs, err := app.getPreferences(ctx, "user@example.com")
+	if err != nil || !prefs.EmailUnsubscribed {
+		t.Errorf("expected STOP to unsubscribe, got %+v %v", prefs, err)
+	}
+}
+
+// Unit Test for Slack request signatures and slash commands
+func TestSlackCommands(t *testing.T) {
+	body := []byte("team_id=T1&user_id=U1&command=%2Fpricepulse&text=list")
+	now := time.Unix(1700000000, 0)
+	sign := func(secret, timestamp string, body []byte) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte("v0:" + timestamp + ":"))
+		mac.Write(body)
+		return "v0=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	if !verifySlackSignature("s3cret", "1700000000", sign("s3cret", "1700000000", body), body, now) {
+		t.Error("expected a valid signature to verify")
+	}
+	for name, ok := range map[string]bool{
+		"wrong secret":  verifySlackSignature("s3cret", "1700000000", sign("other", "1700000000", body), body, now),
+		"stale":         verifySlackSignature("s3cret", "1699999000", sign("s3cret", "1699999000", body), body, now),
+		"tampered":      verifySlackSignature("s3cret", "1700000000", sign("s3cret", "1700000000", body), append(body, '!'), now),
+		"no secret":     verifySlackSignature("", "1700000000", sign("", "1700000000", body), body, now),
+		"bad timestamp": verifySlackSignature("s3cret", "soon", sign("s3cret", "soon", body), body, now),
+	} {
+		if ok {
+			t.Errorf("%s: expected the signature to be rejected", name)
+		}
+	}
+
+	app := &App{}
+	rr := httptest.NewRecorder()
+	app.slackCommandsHandler(rr, httptest.NewRequest(http.MethodPost, "/slack/commands", bytes.NewReader(body)))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 without SLACK_SIGNING_SECRET, got %d", rr.Code)
+	}
+
+	t.Setenv("SLACK_SIGNING_SECRET", "s3cret")
+	rr = httptest.NewRecorder()
+	help := []byte("team_id=T1&user_id=U1&text=help")
+	req := httptest.NewRequest(http.MethodPost, "/slack/commands", bytes.NewReader(help))
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Slack-Request-Timestamp", ts)
+	req.Header.Set("X-Slack-Signature", sign("s3cret", ts, help))
+	app.slackCommandsHandler(rr, req)
+	var response struct {
+		ResponseType string                   `json:"response_type"`
+		Blocks       []map[string]interface{} `json:"blocks"`
+	}
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil || rr.Code != http.StatusOK {
+		t.Fatalf("expected a JSON response, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if response.ResponseType != "ephemeral" || len(response.Blocks) != 1 {
+		t.Errorf("expected an ephemeral help message, got %+v", response)
+	}
+
+	// Link codes are only issued to the owner of the address.
+	for _, target := range []string{"/slack/link?email=slack@example.com", "/slack/link?token=garbage"} {
+		rr = httptest.NewRecorder()
+		app.slackLinkHandler(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", target, rr.Code)
+		}
+	}
+
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("Skipping integration test: FIRESTORE_EMULATOR_HOST not set.")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "testing-project")
+	if err != nil {
+		t.Fatalf("Failed to create Firestore client for emulator: %v", err)
+	}
+	defer client.Close()
+	clearCollection(ctx, client, "signals")
+	clearCollection(ctx, client, "slack_links")
+	clearCollection(ctx, client, "slack_link_codes")
+
+	app = &App{
+		db: client,
+		priceFetcher: func(assetID string, apiURL string) (map[string]map[string]interface{}, error) {
+			return map[string]map[string]interface{}{"ethereum": {"usd": 3000.00}}, nil
+		},
+	}
+	if reply, email := app.handleSlackCommand(ctx, "T1", "U1", "list"); email != "" || !strings.Contains(reply, "not linked") {
+		t.Errorf("expected an unlinked user to be told to link, got %q", reply)
+	}
+
+	rr = httptest.NewRecorder()
+	app.slackLinkHandler(rr, httptest.NewRequest(http.MethodGet, "/slack/link?token="+url.QueryEscape(signPreferenceToken("slack@example.com", time.Now().Add(time.Hour))), nil))
+	_, code, ok := strings.Cut(strings.TrimSpace(rr.Body.String()), "/pricepulse link ")
+	if rr.Code != http.StatusOK || !ok {
+		t.Fatalf("expected a link command, got %d: %s", rr.Code, rr.Body.String())
+	}
+	if _, email := app.handleSlackCommand(ctx, "T1", "U1", "link "+code); email != "slack@example.com" {
+		t.Fatalf("expected the code to link slack@example.com, got %q", email)
+	}
+	if _, email := app.handleSlackCommand(ctx, "T2", "U2", "link "+code); email != "" {
+		t.Error("expected a link code to be single-use")
+	}
+
+	if reply, _ := app.handleSlackCommand(ctx, "T1", "U1", "webhook https://example.com/x"); !strings.Contains(reply, "hooks.slack.com") {
+		t.Errorf("expected a non-Slack webhook to be rejected, got %q", reply)
+	}
+	app.handleSlackCommand(ctx, "T1", "U1", "webhook https://hooks.slack.com/services/T/B/X")
+	reply, _ := app.handleSlackCommand(ctx, "T1", "U1", "alert ethereum 3% up")
+	if !strings.Contains(reply, "Alert created") {
+		t.Fatalf("expected the alert to be created, got %q", reply)
+	}
+	docs, err := client.Collection("signals").Where("email", "==", "slack@example.com").Documents(ctx).GetAll()
+	if err != nil || len(docs) != 1 {
+		t.Fatalf("expected one signal, got %d (%v)", len(docs), err)
+	}
+	var s Signal
+	docs[0].DataTo(&s)
+	if s.Direction != "up" || s.Targets["slack"] != "https://hooks.slack.com/services/T/B/X" {
+		t.Errorf("unexpected signal %+v", s)
+	}
+	if reply, _ := app.handleSlackCommand(ctx, "T1", "U1", "list"); !strings.Contains(reply, docs[0].Ref.ID) || !strings.Contains(reply, "+3.00%") {
+		t.Errorf("expected the alert to be listed, got %q", reply)
+	}
+}
+
+// startMQTTBroker runs an embedded broker on addr with an inline client for
+// subscribing from the test.
+func startMQTTBroker(t *testing.T, addr string) *mqttserver.Server {
+	t.Helper()
+	server := mqttserver.New(&mqttserver.Options{InlineClient: true, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	server.AddHook(new(mqttauth.AllowHook), nil)
+	if err := server.AddListener(mqttlisteners.NewTCP(mqttlisteners.Config{ID: "tcp", Address: addr})); err != nil {
+		t.Fatalf("Failed to add MQTT listener: %v", err)
+	}
+	if err := server.Serve(); err != nil {
+		t.Fatalf("Failed to start MQTT broker: %v", err)
+	}
+	return server
+}
+
+// waitForMQTT subscribes to filter on the broker and returns the first message.
+func waitForMQTT(t *testing.T, server *mqttserver.Server, filter string) mqttpackets.Packet {
+	t.Helper()
+	received := make(chan mqttpackets.Packet, 1)
+	server.Subscribe(filter, 1, func(cl *mqttserver.Client, sub mqttpackets.Subscription, pk mqttpackets.Packet) {
+		select {
+		case received <- pk:
+		default:
+		}
+	})
+	defer server.Unsubscribe(filter, 1)
+	select {
+	case pk := <-received:
+		return pk
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out waiting for a message on %s", filter)
+	}
+	return mqttpackets.Packet{}
+}
+
+// Unit Test for MQTTPublisher against an in-process broker
+func TestMQTTPublisher(t *testing.T) {
+	var none *MQTTPublisher
+	none.PublishPrice("bitcoin", "usd", 1, time.Now())
+	none.PublishTrigger(SignalTriggered{})
+	none.Close()
+
+	p := &MQTTPublisher{PriceTopic: defaultMQTTPriceTopic}
+	if got := p.topic(p.PriceTopic, "my/feed+#", "usd"); got != "pricepulse/prices/my_feed__/usd" {
+		t.Errorf("unexpected topic %q", got)
+	}
+
+	t.Setenv("MQTT_BROKER_URL", "tcp://127.0.0.1:1")
+	t.Setenv("MQTT_QOS", "3")
+	if _, err := NewMQTTPublisherFromEnv(); err == nil {
+		t.Error("expected an invalid QoS to be rejected")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	broker := startMQTTBroker(t, addr)
+
+	p = &MQTTPublisher{PriceTopic: defaultMQTTPriceTopic, TriggerTopic: defaultMQTTTriggerTopic, QoS: 1, Retain: true}
+	p.Connect(paho.NewClientOptions().AddBroker("tcp://" + addr).SetClientID("pricepulse-test").
+		SetConnectRetryInterval(100 * time.Millisecond).SetMaxReconnectInterval(200 * time.Millisecond))
+	defer p.Close()
+
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	p.PublishPrice("bitcoin", "usd", 68000, at)
+	// Subscribing afterwards still gets the price, as a retained message.
+	for deadline := time.Now().Add(10 * time.Second); len(broker.Topics.Messages("pricepulse/prices/bitcoin/usd")) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the price to be retained")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	pk := waitForMQTT(t, broker, "pricepulse/prices/+/usd")
+	var price MQTTPrice
+	if err := json.Unmarshal(pk.Payload, &price); err != nil || pk.TopicName != "pricepulse/prices/bitcoin/usd" || price.Price != 68000 || !price.Timestamp.Equal(at) {
+		t.Errorf("unexpected price message on %s: %s", pk.TopicName, pk.Payload)
+	}
+	if !pk.FixedHeader.Retain {
+		t.Error("expected the price to be retained")
+	}
+
+	// Restart the broker; the publisher reconnects and delivers what it published
+	// while the connection was down.
+	broker.Close()
+	time.Sleep(200 * time.Millisecond)
+	p.Handle(context.Background(), SignalTriggered{TriggerID: "t1", SignalID: "s1", Email: "private@example.com", AssetID: "bitcoin", Currency: "usd", ChangePercent: -5.2})
+	broker = startMQTTBroker(t, addr)
+	defer broker.Close()
+	pk = waitForMQTT(t, broker, "pricepulse/triggers/#")
+	var trigger MQTTTrigger
+	if err := json.Unmarshal(pk.Payload, &trigger); err != nil || trigger.TriggerID != "t1" || trigger.ChangePercent != -5.2 {
+		t.Errorf("unexpected trigger message %s", pk.Payload)
+	}
+	if strings.Contains(string(pk.Payload), "private@example.com") {
+		t.Error("expected trigger messages not to include the owner's email")
+	}
+}
+
+// Unit Test for EventBus and the NATS sink
+func TestEventBus(t *testing.T) {
+	var none *EventBus
+	none.Publish(context.Background(), PriceCollected{})
+
+	bus := NewEventBus()
+	var got []string
+	bus.Subscribe("*", func(ctx context.Context, e Event) { got = append(got, "all:"+e.EventType()) })
+	bus.Subscribe(EventSignalTriggered, func(ctx context.Context, e Event) {
+		got = append(got, "triggered:"+e.(SignalTriggered).TriggerID)
+	})
+	bus.Publish(context.Background(), SignalTriggered{TriggerID: "t1"})
+	bus.Publish(context.Background(), PriceCollected{AssetID: "bitcoin"})
+	if want := []string{"triggered:t1", "all:signal.triggered", "all:price.collected"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	created := newSignalCreated("s1", Signal{Email: "a@example.com", AssetID: "bitcoin", ChangeThresholdPercentage: 5, Direction: "down", Status: "active"})
+	if created.Currency != defaultCurrency || len(created.Channels) != 1 || created.Channels[0] != "email" {
+		t.Errorf("unexpected signal.created event %+v", created)
+	}
+
+	ns, err := natsserver.NewServer(&natsserver.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatalf("Failed to create NATS server: %v", err)
+	}
+	go ns.Start()
+	defer ns.Shutdown()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("NATS server did not start")
+	}
+
+	t.Setenv("NATS_URL", ns.ClientURL())
+	t.Setenv("NATS_SUBJECT_PREFIX", "test.events.")
+	sink, err := NewNATSSinkFromEnv()
+	if err != nil {
+		t.Fatalf("NewNATSSinkFromEnv failed: %v", err)
+	}
+	defer sink.Close()
+	consumer, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("Failed to connect consumer: %v", err)
+	}
+	defer consumer.Close()
+	sub, err := consumer.SubscribeSync("test.events.>")
+	if err != nil {
+		t.Fatalf("Failed to subscribe: %v", err)
+	}
+	consumer.Flush()
+
+	bus = NewEventBus()
+	bus.Subscribe("*", sink.Handle)
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	bus.Publish(context.Background(), NotificationDelivered{TriggerID: "t1", SignalID: "s1", Channel: "slack", Attempts: 2, DeliveredAt: at})
+	sink.Conn.Flush()
+
+	msg, err := sub.NextMsg(5 * time.Second)
+	if err != nil {
+		t.Fatalf("expected an event on NATS: %v", err)
+	}
+	var envelope struct {
+		Version string                `json:"version"`
+		Type    string                `json:"type"`
+		ID      string                `json:"id"`
+		Data    NotificationDelivered `json:"data"`
+	}
+	if err := json.Unmarshal(msg.Data, &envelope); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if msg.Subject != "test.events.notification.delivered" || envelope.Version != eventPayloadVersion || envelope.Type != EventNotificationDelivered || envelope.ID == "" {
+		t.Errorf("unexpected envelope on %s: %s", msg.Subject, msg.Data)
+	}
+	if envelope.Data.Channel != "slack" || envelope.Data.Attempts != 2 || !envelope.Data.DeliveredAt.Equal(at) {
+		t.Errorf("unexpected event data %+v", envelope.Data)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+)
+
+// Default MQTT topics. {asset} and {currency} are replaced per message.
+const (
+	defaultMQTTPriceTopic   = "pricepulse/prices/{asset}/{currency}"
+	defaultMQTTTriggerTopic = "pricepulse/triggers/{asset}"
+)
+
+// mqttPublishTimeout bounds how long a publish is tracked before it is logged as
+// still pending; the client keeps retrying it while reconnecting.
+const mqttPublishTimeout = 30 * time.Second
+
+// MQTTPrice is the payload published for each collected price.
+type MQTTPrice struct {
+	AssetID   string    `json:"assetId"`
+	Currency  string    `json:"currency"`
+	Price     float64   `json:"price"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MQTTTrigger is the payload published when a signal fires. It leaves out the
+// owner's email, as MQTT topics are often readable by every device on a network.
+type MQTTTrigger struct {
+	TriggerID     string    `json:"triggerId"`
+	SignalID      string    `json:"signalId"`
+	AssetID       string    `json:"assetId"`
+	Currency      string    `json:"currency"`
+	Baseline      float64   `json:"baseline"`
+	Price         float64   `json:"price"`
+	ChangePercent float64   `json:"changePercent"`
+	Threshold     float64   `json:"threshold"`
+	TriggeredAt   time.Time `json:"triggeredAt"`
+}
+
+// MQTTPublisher publishes prices and trigger events to an MQTT broker. A nil
+// *MQTTPublisher publishes nothing.
+type MQTTPublisher struct {
+	Client       paho.Client
+	PriceTopic   string
+	TriggerTopic string
+	QoS          byte
+	// Retain keeps the last message on each topic at the broker, so that a
+	// dashboard shows the current value as soon as it subscribes.
+	Retain bool
+}
+
+// NewMQTTPublisherFromEnv configures a publisher from MQTT_* environment variables,
+// returning nil when MQTT_BROKER_URL is not set.
+func NewMQTTPublisherFromEnv() (*MQTTPublisher, error) {
+	broker := os.Getenv("MQTT_BROKER_URL")
+	if broker == "" {
+		return nil, nil
+	}
+	qos := 1
+	if v := os.Getenv("MQTT_QOS"); v != "" {
+		var err error
+		if qos, err = strconv.Atoi(v); err != nil || qos < 0 || qos > 2 {
+			return nil, fmt.Errorf("MQTT_QOS must be 0, 1 or 2")
+		}
+	}
+	retain := true
+	if v := os.Getenv("MQTT_RETAIN"); v != "" {
+		var err error
+		if retain, err = strconv.ParseBool(v); err != nil {
+			return nil, fmt.Errorf("MQTT_RETAIN must be true or false")
+		}
+	}
+	clientID := os.Getenv("MQTT_CLIENT_ID")
+	if clientID == "" {
+		clientID = "pricepulse"
+	}
+	priceTopic := os.Getenv("MQTT_PRICE_TOPIC")
+	if priceTopic == "" {
+		priceTopic = defaultMQTTPriceTopic
+	}
+	triggerTopic := os.Getenv("MQTT_TRIGGER_TOPIC")
+	if triggerTopic == "" {
+		triggerTopic = defaultMQTTTriggerTopic
+	}
+	opts := paho.NewClientOptions().
+		AddBroker(broker).
+		SetClientID(clientID).
+		SetUsername(os.Getenv("MQTT_USERNAME")).
+		SetPassword(os.Getenv("MQTT_PASSWORD")).
+		SetConnectRetryInterval(5 * time.Second).
+		SetMaxReconnectInterval(time.Minute)
+	p := &MQTTPublisher{
+		PriceTopic:   priceTopic,
+		TriggerTopic: triggerTopic,
+		QoS:          byte(qos),
+		Retain:       retain,
+	}
+	p.Connect(opts)
+	return p, nil
+}
+
+// Connect creates the client and starts connecting in the background. The
+// connection is re-established whenever it drops, and QoS 1 and 2 messages
+// published meanwhile are kept in the session and sent once it is back.
+func (p *MQTTPublisher) Connect(opts *paho.ClientOptions) {
+	opts.SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetCleanSession(false).
+		SetOnConnectHandler(func(paho.Client) {
+			log.Println("Connected to MQTT broker")
+		}).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			log.Printf("ERROR in MQTTPublisher: Lost connection to MQTT broker, reconnecting: %v", err)
+		})
+	p.Client = paho.NewClient(opts)
+	// With ConnectRetry the token only completes once connected, so don't wait.
+	p.Client.Connect()
+}
+
+// Close disconnects from the broker, giving queued messages a moment to go out.
+func (p *MQTTPublisher) Close() {
+	if p == nil || p.Client == nil {
+		return
+	}
+	p.Client.Disconnect(250)
+}
+
+// mqttTopicSegment makes a value safe to use as one topic level.
+func mqttTopicSegment(s string) string {
+	return strings.NewReplacer("/", "_", "+", "_", "#", "_").Replace(s)
+}
+
+// topic expands a topic template for an asset and currency.
+func (p *MQTTPublisher) topic(template, assetID, currency string) string {
+	return strings.NewReplacer("{asset}", mqttTopicSegment(assetID), "{currency}", mqttTopicSegment(currency)).Replace(template)
+}
+
+// publish sends a JSON payload without blocking the caller; failures are logged.
+func (p *MQTTPublisher) publish(topic string, payload interface{}) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("ERROR in MQTTPublisher: Failed to encode message for %s: %v", topic, err)
+		return
+	}
+	token := p.Client.Publish(topic, p.QoS, p.Retain, body)
+	go func() {
+		if !token.WaitTimeout(mqttPublishTimeout) {
+			log.Printf("MQTT message to %s is still pending", topic)
+			return
+		}
+		if err := token.Error(); err != nil {
+			log.Printf("ERROR in MQTTPublisher: Failed to publish to %s: %v", topic, err)
+		}
+	}()
+}
+
+// PublishPrice publishes a collected price to the price topic.
+func (p *MQTTPublisher) PublishPrice(assetID, currency string, price float64, at time.Time) {
+	if p == nil {
+		return
+	}
+	p.publish(p.topic(p.PriceTopic, assetID, currency), MQTTPrice{
+		AssetID:   assetID,
+		Currency:  currency,
+		Price:     price,
+		Timestamp: at,
+	})
+}
+
+// PublishTrigger publishes a trigger event to the trigger topic.
+func (p *MQTTPublisher) PublishTrigger(event SignalTriggered) {
+	if p == nil {
+		return
+	}
+	p.publish(p.topic(p.TriggerTopic, event.AssetID, event.Currency), MQTTTrigger{
+		TriggerID:     event.TriggerID,
+		SignalID:      event.SignalID,
+		AssetID:       event.AssetID,
+		Currency:      event.Currency,
+		Baseline:      event.Baseline,
+		Price:         event.Price,
+		ChangePercent: event.ChangePercent,
+		Threshold:     event.Threshold,
+		TriggeredAt:   event.TriggeredAt,
+	})
+}
+
+// Handle is an EventHandler that publishes collected prices and trigger events.
+func (p *MQTTPublisher) Handle(ctx context.Context, e Event) {
+	switch e := e.(type) {
+	case PriceCollected:
+		p.PublishPrice(e.AssetID, e.Currency, e.Price, e.Timestamp)
+	case SignalTriggered:
+		p.PublishTrigger(e)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// eventPayloadVersion is bumped whenever the envelope or an event changes incompatibly.
+const eventPayloadVersion = "1"
+
+// defaultNATSSubjectPrefix is prepended to the event type to form the subject, e.g.
+// "pricepulse.events.signal.triggered".
+const defaultNATSSubjectPrefix = "pricepulse.events"
+
+// EventEnvelope is the JSON message published for each event.
+type EventEnvelope struct {
+	Version    string    `json:"version"`
+	Type       string    `json:"type"`
+	ID         string    `json:"id"`
+	OccurredAt time.Time `json:"occurredAt"`
+	Data       Event     `json:"data"`
+}
+
+// newEventEnvelope wraps an event with a random ID for consumers to deduplicate on.
+func newEventEnvelope(e Event, now time.Time) EventEnvelope {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return EventEnvelope{
+		Version:    eventPayloadVersion,
+		Type:       e.EventType(),
+		ID:         hex.EncodeToString(id),
+		OccurredAt: now,
+		Data:       e,
+	}
+}
+
+// NATSSink publishes every bus event to NATS under SubjectPrefix.
+type NATSSink struct {
+	Conn          *nats.Conn
+	SubjectPrefix string
+}
+
+// NewNATSSinkFromEnv connects to NATS_URL, returning nil when it is not set. The
+// client keeps reconnecting for as long as the app runs and buffers events while
+// the server is unreachable.
+func NewNATSSinkFromEnv() (*NATSSink, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		return nil, nil
+	}
+	opts := []nats.Option{
+		nats.Name("pricepulse"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("ERROR in NATSSink: Disconnected from NATS, reconnecting: %v", err)
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Printf("Reconnected to NATS at %s", nc.ConnectedUrl())
+		}),
+	}
+	if creds := os.Getenv("NATS_CREDS_FILE"); creds != "" {
+		opts = append(opts, nats.UserCredentials(creds))
+	}
+	conn, err := nats.Connect(url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	prefix := os.Getenv("NATS_SUBJECT_PREFIX")
+	if prefix == "" {
+		prefix = defaultNATSSubjectPrefix
+	}
+	return &NATSSink{Conn: conn, SubjectPrefix: strings.TrimSuffix(prefix, ".")}, nil
+}
+
+// Handle publishes an event. It is an EventHandler; NATS buffers the message, so
+// it does not wait for the server.
+func (s *NATSSink) Handle(ctx context.Context, e Event) {
+	body, err := json.Marshal(newEventEnvelope(e, time.Now()))
+	if err != nil {
+		log.Printf("ERROR in NATSSink: Failed to encode %s event: %v", e.EventType(), err)
+		return
+	}
+	subject := s.SubjectPrefix + "." + e.EventType()
+	if err := s.Conn.Publish(subject, body); err != nil {
+		log.Printf("ERROR in NATSSink: Failed to publish to %s: %v", subject, err)
+	}
+}
+
+// Close flushes buffered events and closes the connection.
+func (s *NATSSink) Close() {
+	if s == nil {
+		return
+	}
+	if err := s.Conn.FlushTimeout(5 * time.Second); err != nil {
+		log.Printf("ERROR in NATSSink: Failed to flush events: %v", err)
+	}
+	s.Conn.Close()
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -9,32 +10,57 @@ import (
 	"github.com/sendgrid/sendgrid-go/helpers/mail"
 )
 
-func sendEmailNotification(toEmail, subject, assetID string, priceChange float64, newPrice float64) {
-	apiKey := os.Getenv("SENDGRID_API_KEY")
-	if apiKey == "" {
-		log.Println("SENDGRID_API_KEY not set. Skipping email notification.")
-		return
+// SendGridNotifier delivers alerts by email through the SendGrid API.
+type SendGridNotifier struct {
+	APIKey    string
+	FromEmail string
+	Templates *NotificationTemplates
+}
+
+// NewSendGridNotifierFromEnv configures SendGrid from SENDGRID_API_KEY and SENDGRID_FROM_EMAIL.
+func NewSendGridNotifierFromEnv() *SendGridNotifier {
+	return &SendGridNotifier{
+		APIKey:    os.Getenv("SENDGRID_API_KEY"),
+		FromEmail: os.Getenv("SENDGRID_FROM_EMAIL"),
+	}
+}
+
+// Notify sends the alert email to the signal's address.
+func (n *SendGridNotifier) Notify(ctx context.Context, alert Alert) error {
+	msg, err := alertEmail(n.Templates, alert)
+	if err != nil {
+		return err
 	}
+	return n.SendEmail(ctx, msg)
+}
 
-	from := mail.NewEmail("PricePulse", os.Getenv("SENDGRID_FROM_EMAIL"))
-	to := mail.NewEmail("Valued User", toEmail)
+// SendEmail sends one email through SendGrid.
+func (n *SendGridNotifier) SendEmail(ctx context.Context, msg EmailMessage) error {
+	if n.APIKey == "" {
+		log.Println("SENDGRID_API_KEY not set. Skipping email notification.")
+		return nil
+	}
 
-	plainTextContent := fmt.Sprintf(
-		"Alert for %s! It moved by %.2f%%. The new price is $%.2f.",
-		assetID, priceChange, newPrice,
-	)
-	htmlContent := fmt.Sprintf(
-		"<strong>Alert for %s!</strong> It moved by <strong>%.2f%%</strong>. The new price is <strong>$%.2f</strong>.",
-		assetID, priceChange, newPrice,
-	)
-	message := mail.NewSingleEmail(from, subject, to, plainTextContent, htmlContent)
-	client := sendgrid.NewSendClient(apiKey)
-	response, err := client.Send(message)
+	from := mail.NewEmail("PricePulse", n.FromEmail)
+	to := mail.NewEmail("Valued User", msg.To)
+	message := mail.NewSingleEmail(from, msg.Subject, to, msg.PlainText, msg.HTML)
+	for key, value := range msg.Headers {
+		message.SetHeader(key, value)
+	}
+	if msg.ReplyTo != "" {
+		message.SetReplyTo(mail.NewEmail("PricePulse", msg.ReplyTo))
+	}
+	for key, value := range msg.CustomArgs {
+		message.SetCustomArg(key, value)
+	}
+	client := sendgrid.NewSendClient(n.APIKey)
+	response, err := client.SendWithContext(ctx, message)
 	if err != nil {
-		log.Printf("Failed to send email: %v", err)
-	} else if response.StatusCode >= 400 {
-		log.Printf("SendGrid returned an error: %d - %s", response.StatusCode, response.Body)
-	} else {
-		log.Printf("Email sent successfully to %s!", toEmail)
+		return fmt.Errorf("failed to send email: %w", err)
+	}
+	if response.StatusCode >= 400 {
+		return &httpStatusError{response.StatusCode, fmt.Sprintf("SendGrid returned an error: %d - %s", response.StatusCode, response.Body)}
 	}
+	log.Printf("Email sent successfully to %s!", msg.To)
+	return nil
 }
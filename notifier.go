@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultChannel is used for signals that do not choose their delivery channels.
+const defaultChannel = "email"
+
+// Alert carries everything a delivery channel needs to tell a user a signal fired.
+type Alert struct {
+	SignalID string
+	// TriggerID identifies the trigger event, for acknowledge links. It is empty
+	// for alerts that were not recorded, such as previews.
+	TriggerID     string
+	Signal        Signal
+	Price         float64
+	ChangePercent float64
+	TriggeredAt   time.Time
+	// Delivered lists the destinations of a channel that fans out, such as webhook
+	// endpoint IDs, that already received the alert on an earlier attempt.
+	Delivered []string
+}
+
+// Notifier delivers an alert over one channel.
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// EmailMessage is one email to a user.
+type EmailMessage struct {
+	To        string
+	Subject   string
+	PlainText string
+	HTML      string
+	// Headers are extra headers such as List-Unsubscribe.
+	Headers map[string]string
+	// ReplyTo is the Reply-To address, if replies should not go to the sender.
+	ReplyTo string
+	// CustomArgs are echoed back by SendGrid's Event Webhook to identify the message.
+	CustomArgs map[string]string
+}
+
+// EmailNotifier is the email channel. Besides alerts it sends other mail to users,
+// such as digests.
+type EmailNotifier interface {
+	Notifier
+	SendEmail(ctx context.Context, msg EmailMessage) error
+}
+
+// alertEmail renders the email for an alert, with unsubscribe headers.
+func alertEmail(templates *NotificationTemplates, alert Alert) (EmailMessage, error) {
+	plainTextContent, htmlContent, err := templates.EmailBodies(alert)
+	if err != nil {
+		return EmailMessage{}, fmt.Errorf("failed to render email: %w", err)
+	}
+	return EmailMessage{
+		To:         alert.Signal.Email,
+		Subject:    templates.Subject(alert),
+		PlainText:  plainTextContent,
+		HTML:       htmlContent,
+		Headers:    unsubscribeHeaders(alert.Signal.Email),
+		ReplyTo:    inboundReplyAddress(alert.SignalID),
+		CustomArgs: map[string]string{"kind": "alert", "signal_id": alert.SignalID},
+	}, nil
+}
+
+// httpStatusError is a delivery failure where the service answered with an error
+// status. Its message may quote the response.
+type httpStatusError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *httpStatusError) Error() string { return e.Message }
+
+// partialDeliveryError is returned by a notifier that fans out when some
+// destinations received the alert and others failed. A retry skips Delivered.
+type partialDeliveryError struct {
+	Delivered []string
+	err       error
+}
+
+func (e *partialDeliveryError) Error() string { return e.err.Error() }
+func (e *partialDeliveryError) Unwrap() error { return e.err }
+
+// redactDeliveryError reduces a delivery error to what is stored and shown to users:
+// the status the service answered with, or the class of failure. The full error only
+// goes to the log, as transport errors quote the request URL, which holds the
+// Telegram bot token or the secret Slack and Discord webhook URL.
+func redactDeliveryError(err error) string {
+	var statusErr *httpStatusError
+	var smtpErr *textproto.Error
+	var urlErr *url.Error
+	var permErr *permanentError
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &statusErr):
+		return fmt.Sprintf("status %d", statusErr.StatusCode)
+	case errors.As(err, &smtpErr):
+		return fmt.Sprintf("SMTP status %d", smtpErr.Code)
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &urlErr) && urlErr.Timeout():
+		return "timeout"
+	case errors.As(err, &urlErr):
+		return "connection failed"
+	case errors.As(err, &permErr):
+		return "not deliverable"
+	default:
+		return "delivery failed"
+	}
+}
+
+// TargetValidator is implemented by notifiers whose channel needs a per-signal
+// destination, such as a Slack or Discord webhook URL stored in Signal.Targets.
+type TargetValidator interface {
+	ValidateTarget(target string) error
+}
+
+// NotifierFunc adapts a plain function to the Notifier interface.
+type NotifierFunc func(ctx context.Context, alert Alert) error
+
+// Notify calls f.
+func (f NotifierFunc) Notify(ctx context.Context, alert Alert) error {
+	return f(ctx, alert)
+}
+
+// NotifierRegistry maps channel names ("email", "webhook", ...) to notifiers and is
+// itself a Notifier that fans an alert out to every channel its signal selected.
+type NotifierRegistry struct {
+	mu       sync.RWMutex
+	channels map[string]Notifier
+}
+
+// NewNotifierRegistry creates an empty registry.
+func NewNotifierRegistry() *NotifierRegistry {
+	return &NotifierRegistry{channels: map[string]Notifier{}}
+}
+
+// Register adds or replaces the notifier for a channel.
+func (r *NotifierRegistry) Register(channel string, n Notifier) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.channels[channel] = n
+}
+
+// Get returns the notifier registered for a channel.
+func (r *NotifierRegistry) Get(channel string) (Notifier, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	n, ok := r.channels[channel]
+	return n, ok
+}
+
+// Channels returns the registered channel names in sorted order.
+func (r *NotifierRegistry) Channels() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.channels))
+	for name := range r.channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateChannels checks that every requested channel is registered and has a valid
+// destination in targets when it needs one. It returns the list with duplicates
+// removed, defaulting to email when none are given.
+func (r *NotifierRegistry) ValidateChannels(channels []string, targets map[string]string) ([]string, error) {
+	if len(channels) == 0 {
+		return []string{defaultChannel}, nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, c := range channels {
+		if seen[c] {
+			continue
+		}
+		n, ok := r.Get(c)
+		if !ok {
+			return nil, fmt.Errorf("unknown notification channel %q", c)
+		}
+		if v, ok := n.(TargetValidator); ok {
+			if err := v.ValidateTarget(targets[c]); err != nil {
+				return nil, fmt.Errorf("invalid %s target: %w", c, err)
+			}
+		}
+		seen[c] = true
+		out = append(out, c)
+	}
+	return out, nil
+}
+
+// Notify delivers the alert on each of the signal's channels. A failing channel does
+// not stop delivery on the others; all failures are returned together.
+func (r *NotifierRegistry) Notify(ctx context.Context, alert Alert) error {
+	var errs []error
+	for _, channel := range alert.Signal.channels() {
+		n, ok := r.Get(channel)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: channel not configured", channel))
+			continue
+		}
+		if err := n.Notify(ctx, alert); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", channel, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// validateChannels checks a signal's requested channels against the registry. Without
+// a registry only the default email channel is accepted.
+func (a *App) validateChannels(channels []string, targets map[string]string) ([]string, error) {
+	if a.channels == nil {
+		if len(channels) == 0 || (len(channels) == 1 && channels[0] == defaultChannel) {
+			return []string{defaultChannel}, nil
+		}
+		return nil, fmt.Errorf("no notification channels are configured")
+	}
+	return a.channels.ValidateChannels(channels, targets)
+}
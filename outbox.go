@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Outbox entry states.
+const (
+	outboxPending   = "pending"
+	outboxDelivered = "delivered"
+	outboxDead      = "dead"
+	// outboxCancelled entries were dropped because the user unsubscribed or their
+	// address was suspended.
+	outboxCancelled = "cancelled"
+)
+
+const (
+	defaultOutboxMaxAttempts = 5
+	outboxBaseDelay          = 30 * time.Second
+	outboxMaxDelay           = time.Hour
+	// outboxLease is how long a claimed entry is hidden from other workers while it
+	// is being delivered.
+	outboxLease = 2 * time.Minute
+	// outboxBatchSize caps the entries one worker run processes.
+	outboxBatchSize = 100
+)
+
+// OutboxEntry is one pending delivery of a triggered signal on one channel, stored
+// in notification_outbox so that a failed delivery can be retried or replayed.
+// Escalation is the step of the trigger's escalation policy the entry delivers, or 0
+// for the alert itself.
+type OutboxEntry struct {
+	ID            string    `firestore:"-" json:"id"`
+	SignalID      string    `firestore:"signalId" json:"signalId"`
+	TriggerID     string    `firestore:"triggerId" json:"triggerId,omitempty"`
+	Escalation    int       `firestore:"escalation" json:"escalation,omitempty"`
+	Channel       string    `firestore:"channel" json:"channel"`
+	Signal        Signal    `firestore:"signal" json:"signal"`
+	Price         float64   `firestore:"price" json:"price"`
+	ChangePercent float64   `firestore:"changePercent" json:"changePercent"`
+	TriggeredAt   time.Time `firestore:"triggeredAt" json:"triggeredAt"`
+	Status        string    `firestore:"status" json:"status"`
+	Attempts      int       `firestore:"attempts" json:"attempts"`
+	NextAttemptAt time.Time `firestore:"nextAttemptAt" json:"nextAttemptAt"`
+	LastError     string    `firestore:"lastError" json:"lastError,omitempty"`
+	// Delivered lists the destinations of a fan-out channel that already received
+	// the alert, so that retries and replays skip them.
+	Delivered []string  `firestore:"delivered" json:"delivered,omitempty"`
+	CreatedAt time.Time `firestore:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `firestore:"updatedAt" json:"updatedAt"`
+}
+
+// alert rebuilds the alert for this entry's channel only.
+func (e OutboxEntry) alert() Alert {
+	s := e.Signal
+	s.Channels = []string{e.Channel}
+	return Alert{SignalID: e.SignalID, TriggerID: e.TriggerID, Signal: s, Price: e.Price, ChangePercent: e.ChangePercent, TriggeredAt: e.TriggeredAt, Delivered: e.Delivered}
+}
+
+// outcomeKey is the key of this entry's delivery outcome on its trigger event.
+func (e OutboxEntry) outcomeKey() string {
+	if e.Escalation > 0 {
+		return fmt.Sprintf("%s (escalation %d)", e.Channel, e.Escalation)
+	}
+	return e.Channel
+}
+
+// newOutboxEntries creates one pending entry per channel of a triggered signal.
+func newOutboxEntries(alert Alert) []OutboxEntry {
+	var entries []OutboxEntry
+	for _, channel := range alert.Signal.channels() {
+		entries = append(entries, OutboxEntry{
+			SignalID:      alert.SignalID,
+			Channel:       channel,
+			Signal:        alert.Signal,
+			Price:         alert.Price,
+			ChangePercent: alert.ChangePercent,
+			TriggeredAt:   alert.TriggeredAt,
+			Status:        outboxPending,
+			NextAttemptAt: alert.TriggeredAt,
+			CreatedAt:     alert.TriggeredAt,
+			UpdatedAt:     alert.TriggeredAt,
+		})
+	}
+	return entries
+}
+
+// outboxMaxAttempts reads OUTBOX_MAX_ATTEMPTS, the deliveries tried before an entry
+// is moved to the dead-letter state.
+func outboxMaxAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("OUTBOX_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultOutboxMaxAttempts
+}
+
+// nextOutboxState decides what happens to an entry after a delivery attempt.
+// Permanent failures and the last allowed attempt go straight to dead-letter.
+func nextOutboxState(attempts, maxAttempts int, deliveryErr error, now time.Time) (string, time.Time) {
+	if deliveryErr == nil {
+		return outboxDelivered, time.Time{}
+	}
+	var perm *permanentError
+	if errors.As(deliveryErr, &perm) || attempts >= maxAttempts {
+		return outboxDead, time.Time{}
+	}
+	return outboxPending, now.Add(backoffDelay(attempts, outboxBaseDelay, outboxMaxDelay))
+}
+
+// claimOutboxEntry leases a due entry to this worker, so that concurrent workers do
+// not deliver it twice. It returns false when the entry is no longer due.
+func (a *App) claimOutboxEntry(ctx context.Context, ref *firestore.DocumentRef, now time.Time) (OutboxEntry, bool, error) {
+	var entry OutboxEntry
+	claimed := false
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = false
+		doc, err := tx.Get(ref)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&entry); err != nil {
+			return err
+		}
+		if entry.Status != outboxPending || entry.NextAttemptAt.After(now) {
+			return nil
+		}
+		entry.Attempts++
+		claimed = true
+		return tx.Update(ref, []firestore.Update{
+			{Path: "attempts", Value: entry.Attempts},
+			{Path: "nextAttemptAt", Value: now.Add(outboxLease)},
+			{Path: "updatedAt", Value: now},
+		})
+	})
+	entry.ID = ref.ID
+	return entry, claimed, err
+}
+
+// processOutbox delivers every due outbox entry once and records the outcome. It
+// returns the number of entries delivered and failed.
+func (a *App) processOutbox(ctx context.Context) (delivered, failed int, err error) {
+	now := time.Now()
+	iter := a.db.Collection("notification_outbox").
+		Where("status", "==", outboxPending).
+		Where("nextAttemptAt", "<=", now).
+		OrderBy("nextAttemptAt", firestore.Asc).
+		Limit(outboxBatchSize).
+		Documents(ctx)
+	defer iter.Stop()
+	maxAttempts := outboxMaxAttempts()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return delivered, failed, fmt.Errorf("failed to query outbox (check for missing index on 'status' and 'nextAttemptAt'): %w", err)
+		}
+		entry, ok, err := a.claimOutboxEntry(ctx, doc.Ref, now)
+		if err != nil {
+			log.Printf("ERROR in processOutbox: Failed to claim entry %s: %v", doc.Ref.ID, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if entry.Channel == "email" {
+			if prefs, err := a.getPreferences(ctx, entry.Signal.Email); err == nil && prefs.emailBlocked() {
+				doc.Ref.Update(ctx, []firestore.Update{{Path: "status", Value: outboxCancelled}, {Path: "updatedAt", Value: time.Now()}})
+				a.recordDeliveryOutcome(ctx, entry.TriggerID, entry.outcomeKey(), DeliveryOutcome{Status: outcomeSuppressed, Attempts: entry.Attempts - 1, UpdatedAt: time.Now()})
+				continue
+			}
+		}
+
+		deliveryErr := a.notifier.Notify(ctx, entry.alert())
+		state, next := nextOutboxState(entry.Attempts, maxAttempts, deliveryErr, time.Now())
+		updates := []firestore.Update{
+			{Path: "status", Value: state},
+			{Path: "nextAttemptAt", Value: next},
+			{Path: "updatedAt", Value: time.Now()},
+		}
+		outcome := DeliveryOutcome{Status: outboxOutcomes[state], Attempts: entry.Attempts, UpdatedAt: time.Now()}
+		if deliveryErr != nil {
+			failed++
+			outcome.LastError = redactDeliveryError(deliveryErr)
+			updates = append(updates, firestore.Update{Path: "lastError", Value: outcome.LastError})
+			var partial *partialDeliveryError
+			if errors.As(deliveryErr, &partial) {
+				updates = append(updates, firestore.Update{Path: "delivered", Value: append(entry.Delivered, partial.Delivered...)})
+			}
+			log.Printf("Delivery of signal %s on %s failed (attempt %d/%d, now %s): %v", entry.SignalID, entry.Channel, entry.Attempts, maxAttempts, state, deliveryErr)
+		} else {
+			delivered++
+			a.events.Publish(ctx, NotificationDelivered{
+				TriggerID:   entry.TriggerID,
+				SignalID:    entry.SignalID,
+				Email:       entry.Signal.Email,
+				Channel:     entry.Channel,
+				Escalation:  entry.Escalation,
+				Attempts:    entry.Attempts,
+				DeliveredAt: time.Now(),
+			})
+		}
+		if _, err := doc.Ref.Update(ctx, updates); err != nil {
+			log.Printf("ERROR in processOutbox: Failed to update entry %s: %v", doc.Ref.ID, err)
+		}
+		a.recordDeliveryOutcome(ctx, entry.TriggerID, entry.outcomeKey(), outcome)
+	}
+	return delivered, failed, nil
+}
+
+// deliverQueued delivers what a collection run just queued, plus any due
+// escalations, so that alerts go out immediately. Failures stay in the outbox for
+// the next run.
+func (a *App) deliverQueued(ctx context.Context, caller string) {
+	if _, err := a.processEscalations(ctx, time.Now()); err != nil {
+		log.Printf("ERROR in %s: %v", caller, err)
+	}
+	if _, _, err := a.processOutbox(ctx); err != nil {
+		log.Printf("ERROR in %s: %v", caller, err)
+	}
+}
+
+// processOutboxHandler runs the delivery worker; schedule it alongside /collect-data
+// so retries happen even when no new signals trigger.
+func (a *App) processOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	delivered, failed, err := a.processOutbox(context.Background())
+	if err != nil {
+		log.Printf("ERROR in processOutboxHandler: %v", err)
+		http.Error(w, "Failed to process notification outbox", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"delivered": delivered, "failed": failed})
+}
+
+// outboxAdminHandler serves GET /admin/outbox?status=dead to inspect entries,
+// POST /admin/outbox/{id}/replay to retry one entry and POST /admin/outbox/replay to
+// retry every dead entry.
+func (a *App) outboxAdminHandler(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := context.Background()
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/outbox"), "/")
+
+	if path == "" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		state := r.URL.Query().Get("status")
+		if state == "" {
+			state = outboxDead
+		}
+		iter := a.db.Collection("notification_outbox").Where("status", "==", state).Limit(500).Documents(ctx)
+		defer iter.Stop()
+		entries := []OutboxEntry{}
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				http.Error(w, "Failed to retrieve outbox entries", http.StatusInternalServerError)
+				return
+			}
+			var e OutboxEntry
+			doc.DataTo(&e)
+			e.ID = doc.Ref.ID
+			entries = append(entries, e)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Only dead entries are replayed: resetting a delivered or cancelled entry would
+	// send its alert again. Each reset is conditional on the entry being unchanged
+	// since it was read as dead.
+	var docs []*firestore.DocumentSnapshot
+	if path == "replay" {
+		var err error
+		docs, err = a.db.Collection("notification_outbox").Where("status", "==", outboxDead).Limit(500).Documents(ctx).GetAll()
+		if err != nil {
+			http.Error(w, "Failed to retrieve outbox entries", http.StatusInternalServerError)
+			return
+		}
+	} else if id, ok := strings.CutSuffix(path, "/replay"); ok && !strings.Contains(id, "/") {
+		doc, err := a.db.Collection("notification_outbox").Doc(id).Get(ctx)
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, "Outbox entry not found", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Failed to retrieve outbox entry", http.StatusInternalServerError)
+			return
+		}
+		if state, _ := doc.Data()["status"].(string); state != outboxDead {
+			http.Error(w, fmt.Sprintf("Only dead entries can be replayed; this one is %s", state), http.StatusConflict)
+			return
+		}
+		docs = append(docs, doc)
+	} else {
+		http.NotFound(w, r)
+		return
+	}
+
+	now := time.Now()
+	replayed := 0
+	for _, doc := range docs {
+		_, err := doc.Ref.Update(ctx, []firestore.Update{
+			{Path: "status", Value: outboxPending},
+			{Path: "attempts", Value: 0},
+			{Path: "nextAttemptAt", Value: now},
+			{Path: "updatedAt", Value: now},
+		}, firestore.LastUpdateTime(doc.UpdateTime))
+		if status.Code(err) == codes.FailedPrecondition {
+			log.Printf("Outbox entry %s changed while being replayed; skipping it", doc.Ref.ID)
+			continue
+		}
+		if err != nil {
+			log.Printf("ERROR in outboxAdminHandler: Failed to replay entry %s: %v", doc.Ref.ID, err)
+			http.Error(w, "Failed to replay outbox entry", http.StatusInternalServerError)
+			return
+		}
+		replayed++
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"replayed": replayed})
+}
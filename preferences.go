@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	// Embed the time zone database so user time zones resolve in minimal containers.
+	_ "time/tzdata"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Email delivery modes. Anything but immediate collects email alerts into a digest.
+const (
+	deliveryImmediate = "immediate"
+	deliveryHourly    = "hourly"
+	deliveryDaily     = "daily"
+	deliveryWeekly    = "weekly"
+)
+
+// digestPeriods maps each digest delivery mode to the time between digests.
+var digestPeriods = map[string]time.Duration{
+	deliveryHourly: time.Hour,
+	deliveryDaily:  24 * time.Hour,
+	deliveryWeekly: 7 * 24 * time.Hour,
+}
+
+// What happens to a non-critical alert during quiet hours.
+const (
+	quietHold = "hold"
+	quietDrop = "drop"
+)
+
+// UserPreferences holds a user's notification settings, stored in the preferences
+// collection under their email address.
+type UserPreferences struct {
+	Email        string    `firestore:"email" json:"email"`
+	Delivery     string    `firestore:"delivery" json:"delivery"`
+	LastDigestAt time.Time `firestore:"lastDigestAt" json:"lastDigestAt,omitempty"`
+	// Paused stops all of the user's signals from triggering.
+	Paused bool `firestore:"paused" json:"paused"`
+	// EmailUnsubscribed stops alert and digest emails; other channels still deliver.
+	EmailUnsubscribed bool `firestore:"emailUnsubscribed" json:"emailUnsubscribed"`
+	// EmailSuspended is set when the address hard-bounces or reports an email as spam.
+	// It stops email like EmailUnsubscribed until the user resubscribes.
+	EmailSuspended       bool      `firestore:"emailSuspended" json:"emailSuspended"`
+	EmailSuspendedReason string    `firestore:"emailSuspendedReason" json:"emailSuspendedReason,omitempty"`
+	EmailSuspendedAt     time.Time `firestore:"emailSuspendedAt" json:"emailSuspendedAt,omitempty"`
+	// EmailVerified is set once the user follows the link in the confirmation email;
+	// until then their email signals stay pending_verification.
+	EmailVerified      bool      `firestore:"emailVerified" json:"emailVerified"`
+	VerificationSentAt time.Time `firestore:"verificationSentAt" json:"-"`
+	// TimeZone is an IANA zone name such as "Europe/Berlin"; quiet hours use it.
+	TimeZone string `firestore:"timeZone" json:"timeZone,omitempty"`
+	// QuietStart and QuietEnd are "HH:MM" local times; the window may wrap midnight.
+	QuietStart string `firestore:"quietStart" json:"quietStart,omitempty"`
+	QuietEnd   string `firestore:"quietEnd" json:"quietEnd,omitempty"`
+	QuietMode  string `firestore:"quietMode" json:"quietMode,omitempty"`
+	// MaxPerHour and MaxPerDay cap alerts sent to the user; 0 means no limit.
+	MaxPerHour int `firestore:"maxPerHour" json:"maxPerHour,omitempty"`
+	MaxPerDay  int `firestore:"maxPerDay" json:"maxPerDay,omitempty"`
+	// RecentAlerts records when alerts were sent in the last day, for the rate limits.
+	RecentAlerts []time.Time `firestore:"recentAlerts" json:"-"`
+	UpdatedAt    time.Time   `firestore:"updatedAt" json:"updatedAt"`
+}
+
+// delivery returns the email delivery mode, defaulting to immediate.
+func (p UserPreferences) delivery() string {
+	if p.Delivery == "" {
+		return deliveryImmediate
+	}
+	return p.Delivery
+}
+
+// wantsDigest reports whether email alerts should be held for a digest.
+func (p UserPreferences) wantsDigest() bool {
+	return p.delivery() != deliveryImmediate
+}
+
+// emailBlocked reports whether no email at all may be sent to the user.
+func (p UserPreferences) emailBlocked() bool {
+	return p.EmailUnsubscribed || p.EmailSuspended
+}
+
+// location returns the user's time zone, defaulting to UTC.
+func (p UserPreferences) location() *time.Location {
+	if loc, err := time.LoadLocation(p.TimeZone); err == nil {
+		return loc
+	}
+	return time.UTC
+}
+
+// parseClock parses an "HH:MM" time of day into minutes after midnight.
+func parseClock(s string) (int, error) {
+	h, m, ok := strings.Cut(s, ":")
+	hour, err1 := strconv.Atoi(h)
+	minute, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || hour < 0 || hour > 23 || minute < 0 || minute > 59 {
+		return 0, fmt.Errorf("%q is not a time of day (HH:MM)", s)
+	}
+	return hour*60 + minute, nil
+}
+
+// quietUntil reports whether now falls in the user's quiet hours and, if so, when
+// they end.
+func (p UserPreferences) quietUntil(now time.Time) (time.Time, bool) {
+	start, err1 := parseClock(p.QuietStart)
+	end, err2 := parseClock(p.QuietEnd)
+	if err1 != nil || err2 != nil || start == end {
+		return time.Time{}, false
+	}
+	local := now.In(p.location())
+	minute := local.Hour()*60 + local.Minute()
+	var quiet bool
+	if start < end {
+		quiet = minute >= start && minute < end
+	} else {
+		quiet = minute >= start || minute < end
+	}
+	if !quiet {
+		return time.Time{}, false
+	}
+	until := time.Date(local.Year(), local.Month(), local.Day(), end/60, end%60, 0, 0, local.Location())
+	if !until.After(local) {
+		until = until.AddDate(0, 0, 1)
+	}
+	return until, true
+}
+
+// Ways a triggered alert can be handled, decided by planDelivery.
+const (
+	planDeliver = "deliver"
+	planHold    = "hold"
+	planDrop    = "drop"
+	planFold    = "fold"
+)
+
+// planDelivery applies quiet hours and rate limits to a new alert. Critical alerts
+// always go out now. Non-critical ones are held until quiet hours end or dropped,
+// per QuietMode, and alerts over a rate limit are folded into a summary. It returns
+// the plan, the time to deliver at for planHold, and the updated recent-alert log.
+func planDelivery(p UserPreferences, critical bool, now time.Time) (string, time.Time, []time.Time) {
+	var recent []time.Time
+	lastHour := 0
+	for _, t := range p.RecentAlerts {
+		if now.Sub(t) < 24*time.Hour {
+			recent = append(recent, t)
+			if now.Sub(t) < time.Hour {
+				lastHour++
+			}
+		}
+	}
+	if critical {
+		return planDeliver, now, append(recent, now)
+	}
+
+	at := now
+	plan := planDeliver
+	if until, quiet := p.quietUntil(now); quiet {
+		if p.QuietMode == quietDrop {
+			return planDrop, time.Time{}, recent
+		}
+		plan, at = planHold, until
+	}
+	if (p.MaxPerHour > 0 && lastHour >= p.MaxPerHour) || (p.MaxPerDay > 0 && len(recent) >= p.MaxPerDay) {
+		return planFold, time.Time{}, recent
+	}
+	return plan, at, append(recent, now)
+}
+
+// validate checks the settings a user can edit.
+func (p UserPreferences) validate() error {
+	if err := validateDelivery(p.Delivery); err != nil {
+		return err
+	}
+	if p.TimeZone != "" {
+		if _, err := time.LoadLocation(p.TimeZone); err != nil {
+			return fmt.Errorf("unknown time zone %q", p.TimeZone)
+		}
+	}
+	if (p.QuietStart == "") != (p.QuietEnd == "") {
+		return fmt.Errorf("quiet hours need both a start and an end")
+	}
+	if p.QuietStart != "" {
+		if _, err := parseClock(p.QuietStart); err != nil {
+			return err
+		}
+		if _, err := parseClock(p.QuietEnd); err != nil {
+			return err
+		}
+	}
+	if p.QuietMode != "" && p.QuietMode != quietHold && p.QuietMode != quietDrop {
+		return fmt.Errorf("quietMode must be hold or drop")
+	}
+	if p.MaxPerHour < 0 || p.MaxPerDay < 0 {
+		return fmt.Errorf("rate limits cannot be negative")
+	}
+	return nil
+}
+
+// validateDelivery checks a delivery mode.
+func validateDelivery(delivery string) error {
+	if delivery == deliveryImmediate {
+		return nil
+	}
+	if _, ok := digestPeriods[delivery]; !ok {
+		return fmt.Errorf("delivery must be one of immediate, hourly, daily or weekly")
+	}
+	return nil
+}
+
+// getPreferences loads a user's preferences, returning the defaults if none are saved.
+func (a *App) getPreferences(ctx context.Context, email string) (UserPreferences, error) {
+	doc, err := a.db.Collection("preferences").Doc(email).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return UserPreferences{Email: email, Delivery: deliveryImmediate}, nil
+	}
+	if err != nil {
+		return UserPreferences{}, err
+	}
+	var p UserPreferences
+	if err := doc.DataTo(&p); err != nil {
+		return UserPreferences{}, err
+	}
+	p.Email = email
+	return p, nil
+}
+
+// preferencesHandler returns a user's preferences on GET /preferences and updates
+// them from the form on the signals page on POST. Both need proof that the caller
+// owns the address, checked by requestEmail, as the settings can silence all alerts.
+func (a *App) preferencesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	switch r.Method {
+	case http.MethodGet:
+		email, ok := requestEmail(r, r.URL.Query().Get("email"))
+		if !ok {
+			http.Error(w, "Open your preferences from the link in any of our emails", http.StatusUnauthorized)
+			return
+		}
+		prefs, err := a.getPreferences(ctx, email)
+		if err != nil {
+			http.Error(w, "Failed to retrieve preferences", http.StatusInternalServerError)
+			return
+		}
+		prefs.Delivery = prefs.delivery()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(prefs)
+
+	case http.MethodPost:
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		email, ok := requestEmail(r, strings.TrimSpace(r.FormValue("email")))
+		if !ok {
+			http.Error(w, "Open your preferences from the link in any of our emails", http.StatusUnauthorized)
+			return
+		}
+		prefs := UserPreferences{
+			Delivery:   r.FormValue("delivery"),
+			TimeZone:   strings.TrimSpace(r.FormValue("timeZone")),
+			QuietStart: r.FormValue("quietStart"),
+			QuietEnd:   r.FormValue("quietEnd"),
+			QuietMode:  r.FormValue("quietMode"),
+		}
+		for field, dst := range map[string]*int{"maxPerHour": &prefs.MaxPerHour, "maxPerDay": &prefs.MaxPerDay} {
+			if v := r.FormValue(field); v != "" {
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					http.Error(w, field+" must be a whole number", http.StatusBadRequest)
+					return
+				}
+				*dst = n
+			}
+		}
+		if err := prefs.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, err := a.db.Collection("preferences").Doc(email).Set(ctx, map[string]interface{}{
+			"email":      email,
+			"delivery":   prefs.Delivery,
+			"timeZone":   prefs.TimeZone,
+			"quietStart": prefs.QuietStart,
+			"quietEnd":   prefs.QuietEnd,
+			"quietMode":  prefs.QuietMode,
+			"maxPerHour": prefs.MaxPerHour,
+			"maxPerDay":  prefs.MaxPerDay,
+			"updatedAt":  time.Now(),
+		}, firestore.MergeAll)
+		if err != nil {
+			log.Printf("ERROR in preferencesHandler: Failed to save preferences for %s: %v", email, err)
+			http.Error(w, "Failed to save preferences", http.StatusInternalServerError)
+			return
+		}
+		target := "/signals/" + url.PathEscape(email)
+		if token := r.URL.Query().Get("token"); token != "" {
+			target += "?token=" + url.QueryEscape(token)
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Headers of a signed SendGrid Event Webhook request.
+const (
+	sendGridSignatureHeader = "X-Twilio-Email-Event-Webhook-Signature"
+	sendGridTimestampHeader = "X-Twilio-Email-Event-Webhook-Timestamp"
+)
+
+// sendGridSignatureMaxAge bounds the age of a signed batch, to prevent replays.
+const sendGridSignatureMaxAge = 5 * time.Minute
+
+// emailEventRank orders the delivery events recorded per message; a message's status
+// only moves to an event of equal or higher rank, so late "delivered" events do not
+// hide a spam report.
+var emailEventRank = map[string]int{
+	"processed":  0,
+	"deferred":   1,
+	"delivered":  2,
+	"dropped":    3,
+	"bounce":     3,
+	"spamreport": 4,
+}
+
+// SendGridEvent is one entry of an Event Webhook batch. SignalID and Kind are the
+// custom args attached to the message when it was sent.
+type SendGridEvent struct {
+	Email     string `json:"email"`
+	Event     string `json:"event"`
+	Timestamp int64  `json:"timestamp"`
+	MessageID string `json:"sg_message_id"`
+	EventID   string `json:"sg_event_id"`
+	Reason    string `json:"reason"`
+	// Type distinguishes hard bounces ("bounce") from blocks ("blocked").
+	Type     string `json:"type"`
+	SignalID string `json:"signal_id"`
+	Kind     string `json:"kind"`
+}
+
+// messageID returns the X-Message-Id the event belongs to. sg_message_id adds a
+// suffix per recipient and filter.
+func (e SendGridEvent) messageID() string {
+	id, _, _ := strings.Cut(e.MessageID, ".")
+	return id
+}
+
+// suspensionReason reports why an event should stop all email to its address, or ""
+// if it should not. Hard bounces and spam complaints suspend; blocks and deferrals
+// are temporary. SendGrid also drops mail to addresses already on its bounce or
+// spam suppression lists.
+func (e SendGridEvent) suspensionReason() string {
+	switch e.Event {
+	case "bounce":
+		if e.Type != "blocked" {
+			return "hard bounce: " + e.Reason
+		}
+	case "spamreport":
+		return "spam complaint"
+	case "dropped":
+		if e.Reason == "Bounced Address" || e.Reason == "Spam Reporting Address" {
+			return "dropped: " + e.Reason
+		}
+	}
+	return ""
+}
+
+// sendGridWebhookKey parses SENDGRID_WEBHOOK_PUBLIC_KEY, the base64 ECDSA public key
+// shown in SendGrid's signed Event Webhook settings.
+func sendGridWebhookKey() (*ecdsa.PublicKey, error) {
+	raw := os.Getenv("SENDGRID_WEBHOOK_PUBLIC_KEY")
+	if raw == "" {
+		return nil, errors.New("SENDGRID_WEBHOOK_PUBLIC_KEY is not set")
+	}
+	der, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, fmt.Errorf("SENDGRID_WEBHOOK_PUBLIC_KEY is not base64: %w", err)
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("SENDGRID_WEBHOOK_PUBLIC_KEY is not a public key: %w", err)
+	}
+	ecKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("SENDGRID_WEBHOOK_PUBLIC_KEY is not an ECDSA key")
+	}
+	return ecKey, nil
+}
+
+// verifySendGridSignature checks SendGrid's ECDSA signature over timestamp+body and
+// that the timestamp is recent, so a captured batch cannot be replayed.
+func verifySendGridSignature(key *ecdsa.PublicKey, signature, timestamp string, body []byte, now time.Time) bool {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > sendGridSignatureMaxAge || age < -sendGridSignatureMaxAge {
+		return false
+	}
+	digest := sha256.Sum256(append([]byte(timestamp), body...))
+	return ecdsa.VerifyASN1(key, digest[:], sig)
+}
+
+// recordEmailEvent updates the delivery record of the event's message in
+// email_messages and suspends the address on a hard bounce or complaint.
+func (a *App) recordEmailEvent(ctx context.Context, e SendGridEvent) error {
+	if rank, tracked := emailEventRank[e.Event]; tracked && e.messageID() != "" {
+		ref := a.db.Collection("email_messages").Doc(e.messageID())
+		at := time.Unix(e.Timestamp, 0)
+		err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			update := map[string]interface{}{
+				"email":     e.Email,
+				"events":    map[string]interface{}{e.Event: at},
+				"updatedAt": time.Now(),
+			}
+			doc, err := tx.Get(ref)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			current := -1
+			if err == nil {
+				if s, ok := doc.Data()["status"].(string); ok {
+					current = emailEventRank[s]
+				}
+			}
+			if rank >= current {
+				update["status"] = e.Event
+				update["reason"] = e.Reason
+			}
+			if e.SignalID != "" {
+				update["signalId"] = e.SignalID
+			}
+			if e.Kind != "" {
+				update["kind"] = e.Kind
+			}
+			return tx.Set(ref, update, firestore.MergeAll)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if reason := e.suspensionReason(); reason != "" && e.Email != "" {
+		_, err := a.db.Collection("preferences").Doc(e.Email).Set(ctx, map[string]interface{}{
+			"email":                e.Email,
+			"emailSuspended":       true,
+			"emailSuspendedReason": reason,
+			"emailSuspendedAt":     time.Now(),
+		}, firestore.MergeAll)
+		if err != nil {
+			return err
+		}
+		log.Printf("Suspended email delivery to %s (%s)", e.Email, reason)
+	}
+	return nil
+}
+
+// sendGridEventsHandler consumes signed SendGrid Event Webhook batches. A failure
+// returns 500 so SendGrid retries the batch; recording an event twice is harmless.
+func (a *App) sendGridEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	key, err := sendGridWebhookKey()
+	if err != nil {
+		log.Printf("ERROR in sendGridEventsHandler: %v", err)
+		http.Error(w, "Event webhook is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 5<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if !verifySendGridSignature(key, r.Header.Get(sendGridSignatureHeader), r.Header.Get(sendGridTimestampHeader), body, time.Now()) {
+		http.Error(w, "Invalid signature", http.StatusForbidden)
+		return
+	}
+	var events []SendGridEvent
+	if err := json.Unmarshal(body, &events); err != nil {
+		http.Error(w, "Body must be a JSON array of events", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	for _, e := range events {
+		if err := a.recordEmailEvent(ctx, e); err != nil {
+			log.Printf("ERROR in sendGridEventsHandler: Failed to record %s event %s: %v", e.Event, e.EventID, err)
+			http.Error(w, "Failed to record events", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"recorded": len(events)})
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// slackLinkCodeTTL is how long a "Connect Slack" link code stays valid.
+const slackLinkCodeTTL = 15 * time.Minute
+
+// slackSignatureMaxAge bounds the age of a signed request, to prevent replays.
+const slackSignatureMaxAge = 5 * time.Minute
+
+const slackHelp = "*PricePulse commands*\n" +
+	"`/pricepulse alert <asset> <percent>% [up|down] [currency]` - create an alert, e.g. `/pricepulse alert eth 3% up`\n" +
+	"`/pricepulse list` - show your alerts\n" +
+	"`/pricepulse pause <id>` / `resume <id>` / `delete <id>` - change an alert\n" +
+	"`/pricepulse webhook <url>` - deliver alerts you create here to a Slack incoming webhook instead of email\n" +
+	"`/pricepulse link <code>` - connect your PricePulse account, with a code from your PricePulse preferences\n" +
+	"`/pricepulse unlink` - disconnect your Slack user"
+
+// SlackLink connects a Slack workspace user to a PricePulse user. Doc ID is
+// "<team ID>:<user ID>".
+type SlackLink struct {
+	Email  string `firestore:"email"`
+	TeamID string `firestore:"teamId"`
+	UserID string `firestore:"userId"`
+	// WebhookURL, if set, receives alerts created with /pricepulse alert.
+	WebhookURL string    `firestore:"webhookUrl"`
+	LinkedAt   time.Time `firestore:"linkedAt"`
+}
+
+// slackLinkID is the slack_links document ID of a workspace user.
+func slackLinkID(teamID, userID string) string {
+	return teamID + ":" + userID
+}
+
+// verifySlackSignature checks the X-Slack-Signature of a request: "v0=" and the
+// hex HMAC-SHA256 of "v0:<timestamp>:<body>" keyed with the app's signing secret.
+func verifySlackSignature(secret, timestamp, signature string, body []byte, now time.Time) bool {
+	if secret == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackSignatureMaxAge || age < -slackSignatureMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "v0:%s:", timestamp)
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return subtle.ConstantTimeCompare([]byte(signature), []byte(expected)) == 1
+}
+
+// slackEphemeral builds a slash-command response only the invoking user sees.
+// It links to the signals page when the user is known.
+func slackEphemeral(text, email string) map[string]interface{} {
+	blocks := []interface{}{
+		map[string]interface{}{
+			"type": "section",
+			"text": map[string]string{"type": "mrkdwn", "text": text},
+		},
+	}
+	if email != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "actions",
+			"elements": []interface{}{
+				map[string]interface{}{
+					"type": "button",
+					"text": map[string]string{"type": "plain_text", "text": "View your signals"},
+					"url":  signalsPageURL(email),
+				},
+			},
+		})
+	}
+	return map[string]interface{}{
+		"response_type": "ephemeral",
+		"text":          text,
+		"blocks":        blocks,
+	}
+}
+
+// slackCommandsHandler receives /pricepulse slash commands. Requests must carry a
+// valid signature from SLACK_SIGNING_SECRET.
+func (a *App) slackCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+	if !verifySlackSignature(os.Getenv("SLACK_SIGNING_SECRET"), r.Header.Get("X-Slack-Request-Timestamp"), r.Header.Get("X-Slack-Signature"), body, time.Now()) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		return
+	}
+
+	text, email := a.handleSlackCommand(context.Background(), form.Get("team_id"), form.Get("user_id"), form.Get("text"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slackEphemeral(text, email))
+}
+
+// handleSlackCommand runs one slash command and returns the reply text and the
+// linked PricePulse user, if any.
+func (a *App) handleSlackCommand(ctx context.Context, teamID, userID, text string) (string, string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || strings.EqualFold(fields[0], "help") {
+		return slackHelp, ""
+	}
+	command, args := strings.ToLower(fields[0]), fields[1:]
+	if command == "link" {
+		if len(args) != 1 {
+			return "usage: `/pricepulse link <code>`", ""
+		}
+		return a.linkSlackUser(ctx, teamID, userID, args[0])
+	}
+
+	ref := a.db.Collection("slack_links").Doc(slackLinkID(teamID, userID))
+	doc, err := ref.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "Your Slack user is not linked yet. Press \"Connect Slack\" on the preferences page linked from any PricePulse email and run the command it shows.", ""
+	}
+	if err != nil {
+		log.Printf("ERROR in handleSlackCommand: Failed to look up %s/%s: %v", teamID, userID, err)
+		return "Something went wrong, please try again.", ""
+	}
+	var link SlackLink
+	doc.DataTo(&link)
+	email := link.Email
+
+	switch command {
+	case "alert":
+		signal, err := parseAlertArgs(args)
+		if err != nil {
+			return err.Error(), email
+		}
+		signal.UserID = email
+		signal.Email = email
+		if link.WebhookURL != "" {
+			signal.Channels = []string{"slack"}
+			signal.Targets = map[string]string{"slack": link.WebhookURL}
+		}
+		id, err := a.createSignal(ctx, signal)
+		var inErr *inputError
+		if errors.As(err, &inErr) {
+			return err.Error(), email
+		}
+		if err != nil {
+			return "Could not create the alert, please try again.", email
+		}
+		via := "by email"
+		if link.WebhookURL != "" {
+			via = "in Slack"
+		}
+		return fmt.Sprintf(":white_check_mark: Alert created (`%s`): we'll tell you %s when *%s* moves %s.", id, via, signal.AssetID, signal.thresholdLabel()), email
+
+	case "list":
+		lines, err := a.signalSummaries(ctx, email)
+		if err != nil {
+			return "Could not load your alerts, please try again.", email
+		}
+		if len(lines) == 0 {
+			return "You have no alerts. Create one with `/pricepulse alert bitcoin 5%`", email
+		}
+		return "*Your alerts*\n" + strings.Join(lines, "\n"), email
+
+	case "pause", "resume", "delete":
+		if len(args) != 1 {
+			return fmt.Sprintf("usage: `/pricepulse %s <id>`", command), email
+		}
+		return a.updateSignalCommand(ctx, email, command, args[0]), email
+
+	case "webhook":
+		if len(args) != 1 {
+			return "usage: `/pricepulse webhook <incoming webhook URL>`", email
+		}
+		if err := (&SlackNotifier{}).ValidateTarget(args[0]); err != nil {
+			return "The webhook URL " + err.Error() + ".", email
+		}
+		if _, err := ref.Update(ctx, []firestore.Update{{Path: "webhookUrl", Value: args[0]}}); err != nil {
+			return "Could not save the webhook, please try again.", email
+		}
+		return "Alerts you create here will be posted to that webhook.", email
+
+	case "unlink":
+		if _, err := ref.Delete(ctx); err != nil {
+			return "Could not unlink your Slack user, please try again.", email
+		}
+		return "Your Slack user is no longer linked to " + email + ".", ""
+	}
+	return "Unknown command.\n\n" + slackHelp, email
+}
+
+// linkSlackUser redeems a link code from the preference center for a workspace user.
+func (a *App) linkSlackUser(ctx context.Context, teamID, userID, code string) (string, string) {
+	codeRef := a.db.Collection("slack_link_codes").Doc(code)
+	var email string
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(codeRef)
+		if err != nil {
+			return err
+		}
+		expiresAt, _ := doc.Data()["expiresAt"].(time.Time)
+		if time.Now().After(expiresAt) {
+			return status.Error(codes.NotFound, "link code expired")
+		}
+		email, _ = doc.Data()["email"].(string)
+		if err := tx.Delete(codeRef); err != nil {
+			return err
+		}
+		return tx.Set(a.db.Collection("slack_links").Doc(slackLinkID(teamID, userID)), SlackLink{
+			Email:    email,
+			TeamID:   teamID,
+			UserID:   userID,
+			LinkedAt: time.Now(),
+		})
+	})
+	if status.Code(err) == codes.NotFound {
+		return "This code has expired. Press \"Connect Slack\" on your preferences page again.", ""
+	}
+	if err != nil {
+		log.Printf("ERROR in linkSlackUser: %v", err)
+		return "Could not link your Slack user, please try again.", ""
+	}
+	return ":link: Your Slack user is now linked to " + email + ".\n\n" + slackHelp, email
+}
+
+// slackLinkHandler issues a one-time link code for the caller's address, proven by
+// requestEmail, and shows the slash command that completes the link.
+func (a *App) slackLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if os.Getenv("SLACK_SIGNING_SECRET") == "" {
+		http.Error(w, "Slack commands are not configured", http.StatusServiceUnavailable)
+		return
+	}
+	email, ok := requestEmail(r, r.URL.Query().Get("email"))
+	if !ok {
+		http.Error(w, "Open this link from the preferences page linked in any PricePulse email", http.StatusUnauthorized)
+		return
+	}
+	code, err := randomCode(24)
+	if err != nil {
+		http.Error(w, "Could not create link code", http.StatusInternalServerError)
+		return
+	}
+	_, err = a.db.Collection("slack_link_codes").Doc(code).Set(context.Background(), map[string]interface{}{
+		"email":     email,
+		"expiresAt": time.Now().Add(slackLinkCodeTTL),
+	})
+	if err != nil {
+		http.Error(w, "Could not create link code", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "To connect Slack to %s, run this command in your workspace within %d minutes:\n\n/pricepulse link %s\n", email, int(slackLinkCodeTTL.Minutes()), code)
+}
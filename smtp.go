@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SMTP connection security modes.
+const (
+	smtpSecurityStartTLS = "starttls"
+	smtpSecurityTLS      = "tls"
+	smtpSecurityNone     = "none"
+)
+
+// SMTPNotifier delivers alert emails through any SMTP server, for self-hosted
+// deployments without a SendGrid account.
+type SMTPNotifier struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	// Security is "starttls" (default), "tls" for implicit TLS, or "none".
+	Security string
+	// TLSConfig overrides the TLS settings, mainly so tests can trust a local sink.
+	TLSConfig *tls.Config
+	Templates *NotificationTemplates
+}
+
+// NewSMTPNotifierFromEnv configures SMTP from the SMTP_* environment variables.
+func NewSMTPNotifierFromEnv() *SMTPNotifier {
+	n := &SMTPNotifier{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     os.Getenv("SMTP_PORT"),
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     os.Getenv("SMTP_FROM"),
+		Security: strings.ToLower(os.Getenv("SMTP_SECURITY")),
+	}
+	if n.Security == "" {
+		n.Security = smtpSecurityStartTLS
+	}
+	if n.Port == "" {
+		n.Port = "587"
+		if n.Security == smtpSecurityTLS {
+			n.Port = "465"
+		}
+	}
+	return n
+}
+
+// newEmailNotifierFromEnv picks the email channel implementation. EMAIL_PROVIDER
+// selects one explicitly; otherwise SendGrid is used when it has an API key and
+// SMTP when SMTP_HOST is set.
+func newEmailNotifierFromEnv(templates *NotificationTemplates) EmailNotifier {
+	useSMTP := os.Getenv("SENDGRID_API_KEY") == "" && os.Getenv("SMTP_HOST") != ""
+	switch strings.ToLower(os.Getenv("EMAIL_PROVIDER")) {
+	case "smtp":
+		useSMTP = true
+	case "sendgrid":
+		useSMTP = false
+	}
+	if useSMTP {
+		n := NewSMTPNotifierFromEnv()
+		n.Templates = templates
+		return n
+	}
+	n := NewSendGridNotifierFromEnv()
+	n.Templates = templates
+	return n
+}
+
+// Notify sends the alert email to the signal's address.
+func (n *SMTPNotifier) Notify(ctx context.Context, alert Alert) error {
+	msg, err := alertEmail(n.Templates, alert)
+	if err != nil {
+		return err
+	}
+	return n.SendEmail(ctx, msg)
+}
+
+// SendEmail sends one email through the SMTP server.
+func (n *SMTPNotifier) SendEmail(ctx context.Context, msg EmailMessage) error {
+	raw, err := buildAlertMessage(n.From, msg)
+	if err != nil {
+		return err
+	}
+	if err := n.send(ctx, msg.To, raw); err != nil {
+		return fmt.Errorf("failed to send email via SMTP: %w", err)
+	}
+	log.Printf("Email sent successfully to %s!", msg.To)
+	return nil
+}
+
+// send delivers a raw message to one recipient.
+func (n *SMTPNotifier) send(ctx context.Context, to string, msg []byte) error {
+	tlsConfig := n.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{ServerName: n.Host}
+	}
+
+	addr := net.JoinHostPort(n.Host, n.Port)
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if n.Security == smtpSecurityTLS {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+
+	c, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if n.Security == smtpSecurityStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server %s does not support STARTTLS", addr)
+		}
+		if err := c.StartTLS(tlsConfig); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host)); err != nil {
+			return err
+		}
+	}
+
+	from, err := mail.ParseAddress(n.From)
+	if err != nil {
+		return fmt.Errorf("invalid From address %q: %w", n.From, err)
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// buildAlertMessage assembles a multipart/alternative MIME message with plain-text
+// and HTML parts.
+func buildAlertMessage(from string, email EmailMessage) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, part := range []struct{ contentType, content string }{
+		{"text/plain; charset=UTF-8", email.PlainText},
+		{"text/html; charset=UTF-8", email.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(pw)
+		if _, err := qp.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	domain := "pricepulse.local"
+	if addr, err := mail.ParseAddress(from); err == nil {
+		if _, d, ok := strings.Cut(addr.Address, "@"); ok {
+			domain = d
+		}
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", (&mail.Address{Name: "PricePulse", Address: addressOnly(from)}).String())
+	fmt.Fprintf(&msg, "To: %s\r\n", email.To)
+	if email.ReplyTo != "" {
+		fmt.Fprintf(&msg, "Reply-To: %s\r\n", email.ReplyTo)
+	}
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("UTF-8", email.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), domain)
+	keys := make([]string, 0, len(email.Headers))
+	for key := range email.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&msg, "%s: %s\r\n", textproto.CanonicalMIMEHeaderKey(key), email.Headers[key])
+	}
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// addressOnly strips any display name from an address.
+func addressOnly(s string) string {
+	if addr, err := mail.ParseAddress(s); err == nil {
+		return addr.Address
+	}
+	return s
+}
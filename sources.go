@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// minPollIntervalSeconds matches the Cloud Scheduler cadence that drives /collect-sources.
+const minPollIntervalSeconds = 60
+
+// sourceNamePattern restricts series names to the same shape as CoinGecko coin IDs,
+// so a custom source can be referenced anywhere an asset ID is accepted. Names the
+// asset catalog knows are rejected by sourceNameTaken.
+var sourceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// CustomSource is an arbitrary HTTP/JSON endpoint polled into price_history as a named series.
+type CustomSource struct {
+	Name                string            `firestore:"name" json:"name"`
+	URL                 string            `firestore:"url" json:"url"`
+	Headers             map[string]string `firestore:"headers" json:"headers,omitempty"`
+	ValuePath           string            `firestore:"valuePath" json:"valuePath"`
+	PollIntervalSeconds int               `firestore:"pollIntervalSeconds" json:"pollIntervalSeconds"`
+	Currency            string            `firestore:"currency" json:"currency"`
+	CreatedBy           string            `firestore:"createdBy" json:"createdBy,omitempty"`
+	CreatedAt           time.Time         `firestore:"createdAt" json:"createdAt"`
+	LastPolledAt        time.Time         `firestore:"lastPolledAt" json:"lastPolledAt"`
+	LastValue           float64           `firestore:"lastValue" json:"lastValue"`
+	LastError           string            `firestore:"lastError" json:"lastError,omitempty"`
+}
+
+// validate checks a source definition before it is stored.
+func (s *CustomSource) validate() error {
+	if !sourceNamePattern.MatchString(s.Name) {
+		return fmt.Errorf("name must be lowercase letters, digits, '-' or '_'")
+	}
+	if !strings.HasPrefix(s.URL, "http://") && !strings.HasPrefix(s.URL, "https://") {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	if s.ValuePath == "" {
+		return fmt.Errorf("valuePath is required")
+	}
+	currency, err := normalizeCurrency(s.Currency)
+	if err != nil {
+		return err
+	}
+	s.Currency = currency
+	if s.PollIntervalSeconds == 0 {
+		s.PollIntervalSeconds = minPollIntervalSeconds
+	}
+	if s.PollIntervalSeconds < minPollIntervalSeconds {
+		return fmt.Errorf("pollIntervalSeconds must be at least %d", minPollIntervalSeconds)
+	}
+	return nil
+}
+
+// currency returns the unit the source's values are quoted in.
+func (s *CustomSource) currency() string {
+	if s.Currency == "" {
+		return defaultCurrency
+	}
+	return s.Currency
+}
+
+// isDue reports whether the source should be polled again at the given time.
+func (s *CustomSource) isDue(now time.Time) bool {
+	return now.Sub(s.LastPolledAt) >= time.Duration(s.PollIntervalSeconds)*time.Second
+}
+
+// sourceNameTaken reports whether the asset catalog resolves name to a coin. A custom
+// source of that name would shadow the coin's price for every signal on it.
+func (a *App) sourceNameTaken(name string) bool {
+	if a.catalog == nil {
+		return false
+	}
+	_, err := a.catalog.Resolve(name)
+	var unknown *UnknownAssetError
+	return err == nil || (errors.As(err, &unknown) && unknown.Ambiguous)
+}
+
+// fetchCustomSourceValue requests the source URL and extracts the numeric value at its ValuePath.
+func fetchCustomSourceValue(src CustomSource) (float64, error) {
+	req, err := http.NewRequest(http.MethodGet, src.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range src.Headers {
+		req.Header.Set(k, v)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return 0, fmt.Errorf("source returned status %d", resp.StatusCode)
+	}
+
+	var data interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return 0, err
+	}
+	return extractJSONPath(data, src.ValuePath)
+}
+
+// extractJSONPath walks a decoded JSON document using a dotted path such as
+// "data.0.value" or "data[0].value" and returns the number found there.
+// Numeric strings are accepted since many APIs quote their decimals.
+func extractJSONPath(data interface{}, path string) (float64, error) {
+	path = strings.NewReplacer("[", ".", "]", "").Replace(strings.TrimPrefix(path, "$."))
+	current := data
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			continue
+		}
+		switch node := current.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return 0, fmt.Errorf("key %q not found", key)
+			}
+			current = next
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(node) {
+				return 0, fmt.Errorf("invalid array index %q", key)
+			}
+			current = node[idx]
+		default:
+			return 0, fmt.Errorf("cannot descend into %q", key)
+		}
+	}
+
+	switch v := current.(type) {
+	case float64:
+		return v, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(v), 64)
+	default:
+		return 0, fmt.Errorf("value at %q is not a number", path)
+	}
+}
+
+// getCustomSource loads a custom source by name, returning nil if none exists.
+func (a *App) getCustomSource(ctx context.Context, name string) (*CustomSource, error) {
+	doc, err := a.db.Collection("custom_sources").Doc(name).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var src CustomSource
+	if err := doc.DataTo(&src); err != nil {
+		return nil, err
+	}
+	return &src, nil
+}
+
+// fetchCurrentPrice returns the latest value for an asset ID in a quote currency,
+// reading from a custom source when one is registered under that name and from
+// CoinGecko otherwise. A custom source only quotes in its own currency.
+func (a *App) fetchCurrentPrice(ctx context.Context, assetID, currency string) (float64, error) {
+	src, err := a.getCustomSource(ctx, assetID)
+	if err != nil {
+		return 0, err
+	}
+	if src != nil {
+		if src.currency() != currency {
+			return 0, fmt.Errorf("source %q is quoted in %s, not %s", assetID, src.currency(), currency)
+		}
+		return fetchCustomSourceValue(*src)
+	}
+
+	priceData, err := a.priceFetcher(assetID, coinGeckoSimplePriceURL([]string{currency}))
+	if err != nil {
+		return 0, err
+	}
+	currentPrice, ok := priceData[assetID][currency].(float64)
+	if !ok {
+		return 0, fmt.Errorf("no %s price for %q in response", currency, assetID)
+	}
+	return currentPrice, nil
+}
+
+// sourcesHandler lists (GET) or registers (POST) custom data sources. Registering a
+// source makes the server fetch an arbitrary URL, so it is limited to admins.
+func (a *App) sourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := context.Background()
+	switch r.Method {
+	case http.MethodGet:
+		var sources []CustomSource
+		iter := a.db.Collection("custom_sources").Documents(ctx)
+		defer iter.Stop()
+		for {
+			doc, err := iter.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				http.Error(w, "Failed to retrieve sources", http.StatusInternalServerError)
+				return
+			}
+			var src CustomSource
+			doc.DataTo(&src)
+			// Header values typically carry credentials; only expose their names.
+			for k := range src.Headers {
+				src.Headers[k] = "***"
+			}
+			sources = append(sources, src)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sources)
+
+	case http.MethodPost:
+		var src CustomSource
+		if err := json.NewDecoder(r.Body).Decode(&src); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := src.validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if a.sourceNameTaken(src.Name) {
+			http.Error(w, "This name is already used by an asset in the catalog", http.StatusConflict)
+			return
+		}
+		value, err := fetchCustomSourceValue(src)
+		if err != nil {
+			http.Error(w, "Could not read a value from the source: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		src.CreatedAt = time.Now()
+		src.LastValue = value
+		src.LastError = ""
+		src.LastPolledAt = time.Time{}
+		_, err = a.db.Collection("custom_sources").Doc(src.Name).Create(ctx, src)
+		if status.Code(err) == codes.AlreadyExists {
+			http.Error(w, "A source with this name already exists", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to create source", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "source created", "name": src.Name, "value": value})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// deleteSourceHandler removes a custom source. Existing price_history points are kept.
+func (a *App) deleteSourceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/sources/")
+	if name == "" {
+		http.Error(w, "Source name is required", http.StatusBadRequest)
+		return
+	}
+	if _, err := a.db.Collection("custom_sources").Doc(name).Delete(context.Background()); err != nil {
+		http.Error(w, "Failed to delete source", http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"status": "source deleted"})
+}
+
+// collectSourcesHandler polls every custom source whose interval has elapsed,
+// records the value in price_history, checks signals on that series and delivers the
+// resulting alerts.
+func (a *App) collectSourcesHandler(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	ctx := context.Background()
+	now := time.Now()
+	polled := map[string]float64{}
+	failed := map[string]string{}
+
+	iter := a.db.Collection("custom_sources").Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			log.Printf("ERROR in collectSourcesHandler: Failed to iterate sources: %v", err)
+			http.Error(w, "Failed to query sources", http.StatusInternalServerError)
+			return
+		}
+		var src CustomSource
+		doc.DataTo(&src)
+		if !src.isDue(now) {
+			continue
+		}
+
+		value, err := fetchCustomSourceValue(src)
+		if err != nil {
+			log.Printf("ERROR in collectSourcesHandler: Failed to poll source %s: %v", src.Name, err)
+			failed[src.Name] = err.Error()
+			doc.Ref.Update(ctx, []firestore.Update{{Path: "lastPolledAt", Value: now}, {Path: "lastError", Value: err.Error()}})
+			continue
+		}
+		_, _, err = a.db.Collection("price_history").Add(ctx, map[string]interface{}{"assetId": src.Name, "price": value, "currency": src.currency(), "timestamp": now})
+		if err != nil {
+			log.Printf("ERROR in collectSourcesHandler: Failed to add document to price_history: %v", err)
+			failed[src.Name] = "failed to write to database"
+			continue
+		}
+		doc.Ref.Update(ctx, []firestore.Update{{Path: "lastPolledAt", Value: now}, {Path: "lastValue", Value: value}, {Path: "lastError", Value: ""}})
+		a.events.Publish(ctx, PriceCollected{AssetID: src.Name, Currency: src.currency(), Price: value, Source: "custom", Timestamp: now})
+		if err := a.evaluateSignals(ctx, src.Name, map[string]float64{src.currency(): value}); err != nil {
+			log.Printf("ERROR in collectSourcesHandler: %v", err)
+		}
+		polled[src.Name] = value
+	}
+	if len(polled) > 0 {
+		a.deliverQueued(ctx, "collectSourcesHandler")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "sources collected", "polled": polled, "failed": failed})
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// telegramLinkCodeTTL is how long a "Connect Telegram" deep link stays valid.
+const telegramLinkCodeTTL = 15 * time.Minute
+
+const telegramHelp = `PricePulse commands:
+/alert <asset> [up|down] <percent>% [currency] - create an alert, e.g. /alert bitcoin down 5%
+/list - show your alerts
+/pause <id> - pause an alert
+/resume <id> - resume a paused alert
+/delete <id> - delete an alert
+/unlink - disconnect this chat from your account`
+
+// TelegramBot is a minimal Telegram Bot API client.
+type TelegramBot struct {
+	Token    string
+	Username string
+	// APIBase is https://api.telegram.org in production and a fake server in tests.
+	APIBase string
+	// WebhookSecret must match the X-Telegram-Bot-Api-Secret-Token header of updates.
+	WebhookSecret string
+	Client        *http.Client
+}
+
+// NewTelegramBotFromEnv configures the bot from TELEGRAM_* environment variables,
+// returning nil when TELEGRAM_BOT_TOKEN is not set.
+func NewTelegramBotFromEnv() *TelegramBot {
+	token := os.Getenv("TELEGRAM_BOT_TOKEN")
+	if token == "" {
+		return nil
+	}
+	apiBase := os.Getenv("TELEGRAM_API_BASE")
+	if apiBase == "" {
+		apiBase = "https://api.telegram.org"
+	}
+	return &TelegramBot{
+		Token:         token,
+		Username:      os.Getenv("TELEGRAM_BOT_USERNAME"),
+		APIBase:       strings.TrimRight(apiBase, "/"),
+		WebhookSecret: os.Getenv("TELEGRAM_WEBHOOK_SECRET"),
+		Client:        &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// call invokes a Bot API method with JSON parameters.
+func (b *TelegramBot) call(ctx context.Context, method string, params interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/bot%s/%s", b.APIBase, b.Token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return &httpStatusError{resp.StatusCode, fmt.Sprintf("telegram %s: status %d", method, resp.StatusCode)}
+	}
+	if !result.OK {
+		return &httpStatusError{resp.StatusCode, fmt.Sprintf("telegram %s: %s", method, result.Description)}
+	}
+	return nil
+}
+
+// SendMessage posts a plain-text message to a chat.
+func (b *TelegramBot) SendMessage(ctx context.Context, chatID int64, text string) error {
+	return b.call(ctx, "sendMessage", map[string]interface{}{
+		"chat_id":                  chatID,
+		"text":                     text,
+		"disable_web_page_preview": true,
+	})
+}
+
+// TelegramNotifier delivers alerts to the Telegram chat stored in Signal.Targets.
+type TelegramNotifier struct {
+	Bot       *TelegramBot
+	Templates *NotificationTemplates
+}
+
+// ValidateTarget checks that the target is a Telegram chat ID.
+func (n *TelegramNotifier) ValidateTarget(target string) error {
+	if _, err := strconv.ParseInt(target, 10, 64); err != nil {
+		return fmt.Errorf("must be a Telegram chat ID")
+	}
+	return nil
+}
+
+// Notify sends the alert to the signal's chat.
+func (n *TelegramNotifier) Notify(ctx context.Context, alert Alert) error {
+	chatID, err := strconv.ParseInt(alert.Signal.Targets["telegram"], 10, 64)
+	if err != nil {
+		return fmt.Errorf("signal has no Telegram chat")
+	}
+	text, err := n.Templates.Render("telegram.txt", alert)
+	if err != nil {
+		return fmt.Errorf("failed to render Telegram message: %w", err)
+	}
+	return n.Bot.SendMessage(ctx, chatID, text)
+}
+
+// telegramUpdate is the subset of a Bot API Update the bot handles.
+type telegramUpdate struct {
+	UpdateID int64 `json:"update_id"`
+	Message  *struct {
+		Text string `json:"text"`
+		Chat struct {
+			ID int64 `json:"id"`
+		} `json:"chat"`
+		From struct {
+			Username string `json:"username"`
+		} `json:"from"`
+	} `json:"message"`
+}
+
+// parseAlertArgs parses "bitcoin down 5% eur" into a signal's asset, direction,
+// threshold and currency. The direction and currency are optional, and the
+// direction may also follow the percentage ("eth 3% up").
+func parseAlertArgs(args []string) (Signal, error) {
+	usage := fmt.Errorf("usage: <asset> [up|down] <percent>%% [currency]")
+	if len(args) < 2 {
+		return Signal{}, usage
+	}
+	signal := Signal{AssetID: args[0]}
+	for _, arg := range args[1:] {
+		switch d := strings.ToLower(arg); {
+		case (d == "up" || d == "down") && signal.Direction == "":
+			signal.Direction = d
+		case signal.ChangeThresholdPercentage == 0:
+			threshold, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64)
+			if err != nil || threshold <= 0 {
+				return Signal{}, fmt.Errorf("%q is not a valid percentage", arg)
+			}
+			signal.ChangeThresholdPercentage = threshold
+		case signal.QuoteCurrency == "":
+			signal.QuoteCurrency = arg
+		default:
+			return Signal{}, usage
+		}
+	}
+	if signal.ChangeThresholdPercentage == 0 {
+		return Signal{}, usage
+	}
+	return signal, nil
+}
+
+// telegramWebhookHandler receives Bot API updates and replies to commands.
+func (a *App) telegramWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if a.telegram == nil {
+		http.Error(w, "Telegram bot is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if a.telegram.WebhookSecret == "" || subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token")), []byte(a.telegram.WebhookSecret)) != 1 {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	var update telegramUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Always acknowledge so Telegram does not redeliver updates we cannot handle.
+	w.WriteHeader(http.StatusOK)
+	if update.Message == nil || !strings.HasPrefix(update.Message.Text, "/") {
+		return
+	}
+
+	ctx := context.Background()
+	chatID := update.Message.Chat.ID
+	reply := a.handleTelegramCommand(ctx, chatID, update.Message.Text)
+	if err := a.telegram.SendMessage(ctx, chatID, reply); err != nil {
+		log.Printf("ERROR in telegramWebhookHandler: Failed to reply to chat %d: %v", chatID, err)
+	}
+}
+
+// handleTelegramCommand runs one bot command and returns the reply text.
+func (a *App) handleTelegramCommand(ctx context.Context, chatID int64, text string) string {
+	fields := strings.Fields(text)
+	command, _, _ := strings.Cut(strings.ToLower(fields[0]), "@")
+	args := fields[1:]
+
+	switch command {
+	case "/start":
+		if len(args) == 1 {
+			return a.linkTelegramChat(ctx, chatID, args[0])
+		}
+		return "Welcome to PricePulse! Open the preferences page linked from any PricePulse email and press \"Connect Telegram\" to link this chat.\n\n" + telegramHelp
+	case "/help":
+		return telegramHelp
+	}
+
+	email, err := a.telegramLinkedEmail(ctx, chatID)
+	if err != nil {
+		log.Printf("ERROR in handleTelegramCommand: Failed to look up chat %d: %v", chatID, err)
+		return "Something went wrong, please try again."
+	}
+	if email == "" {
+		return "This chat is not linked yet. Open the preferences page linked from any PricePulse email and press \"Connect Telegram\"."
+	}
+
+	switch command {
+	case "/alert":
+		signal, err := parseAlertArgs(args)
+		if err != nil {
+			return err.Error()
+		}
+		signal.UserID = email
+		signal.Email = email
+		signal.Channels = []string{"telegram"}
+		signal.Targets = map[string]string{"telegram": strconv.FormatInt(chatID, 10)}
+		id, err := a.createSignal(ctx, signal)
+		var inErr *inputError
+		if errors.As(err, &inErr) {
+			return err.Error()
+		}
+		if err != nil {
+			return "Could not create the alert, please try again."
+		}
+		return fmt.Sprintf("✅ Alert created (%s): I'll tell you when %s moves %s.", id, signal.AssetID, signal.thresholdLabel())
+
+	case "/list":
+		return a.telegramListSignals(ctx, email)
+
+	case "/pause", "/resume", "/delete":
+		if len(args) != 1 {
+			return fmt.Sprintf("usage: %s <id>", command)
+		}
+		return a.updateSignalCommand(ctx, email, strings.TrimPrefix(command, "/"), args[0])
+
+	case "/unlink":
+		if _, err := a.db.Collection("telegram_links").Doc(strconv.FormatInt(chatID, 10)).Delete(ctx); err != nil {
+			return "Could not unlink this chat, please try again."
+		}
+		return "This chat is no longer linked to " + email + "."
+	}
+	return "Unknown command.\n\n" + telegramHelp
+}
+
+// telegramLinkedEmail returns the PricePulse user linked to a chat, or "" if none.
+func (a *App) telegramLinkedEmail(ctx context.Context, chatID int64) (string, error) {
+	doc, err := a.db.Collection("telegram_links").Doc(strconv.FormatInt(chatID, 10)).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	email, _ := doc.Data()["email"].(string)
+	return email, nil
+}
+
+// usesTelegram reports whether a signal notifies, or escalates to, Telegram.
+func usesTelegram(signal Signal) bool {
+	if slices.Contains(signal.Channels, "telegram") {
+		return true
+	}
+	for _, step := range signal.Escalation {
+		if step.Channel == "telegram" {
+			return true
+		}
+	}
+	return false
+}
+
+// telegramUnauthorizedMessage answers a Telegram signal created without proof of ownership.
+const telegramUnauthorizedMessage = "Create Telegram alerts in the bot with /alert, or from your signals page opened from the preference center"
+
+// authorizeTelegram prepares a signal created over HTTP for the telegram channel.
+// Chat IDs supplied by the caller are dropped, so that fillTelegramTarget uses the
+// chat linked to the signal's address, and using that chat needs proof from
+// requestEmail that the caller owns the address. Only the bot, which knows the chat
+// it talks to, sets a chat ID itself.
+func authorizeTelegram(r *http.Request, signal *Signal) bool {
+	delete(signal.Targets, "telegram")
+	if !usesTelegram(*signal) {
+		return true
+	}
+	_, ok := requestEmail(r, signal.Email)
+	return ok
+}
+
+// fillTelegramTarget fills in the chat linked to the signal's email when Telegram is
+// used without a chat ID, as from the API and the web form.
+func (a *App) fillTelegramTarget(ctx context.Context, signal *Signal) error {
+	if !usesTelegram(*signal) || signal.Targets["telegram"] != "" || a.db == nil {
+		return nil
+	}
+	iter := a.db.Collection("telegram_links").Where("email", "==", signal.Email).Limit(1).Documents(ctx)
+	defer iter.Stop()
+	doc, err := iter.Next()
+	if err == iterator.Done {
+		return &inputError{errors.New("connect Telegram from your email preferences before choosing the telegram channel")}
+	}
+	if err != nil {
+		return err
+	}
+	if signal.Targets == nil {
+		signal.Targets = map[string]string{}
+	}
+	signal.Targets["telegram"] = doc.Ref.ID
+	return nil
+}
+
+// linkTelegramChat consumes a one-time link code and links the chat to its user.
+func (a *App) linkTelegramChat(ctx context.Context, chatID int64, code string) string {
+	codeRef := a.db.Collection("telegram_link_codes").Doc(code)
+	var email string
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(codeRef)
+		if err != nil {
+			return err
+		}
+		expiresAt, _ := doc.Data()["expiresAt"].(time.Time)
+		if time.Now().After(expiresAt) {
+			return status.Error(codes.NotFound, "link code expired")
+		}
+		email, _ = doc.Data()["email"].(string)
+		if err := tx.Delete(codeRef); err != nil {
+			return err
+		}
+		return tx.Set(a.db.Collection("telegram_links").Doc(strconv.FormatInt(chatID, 10)), map[string]interface{}{
+			"email":    email,
+			"chatId":   chatID,
+			"linkedAt": time.Now(),
+		})
+	})
+	if status.Code(err) == codes.NotFound {
+		return "This link has expired. Press \"Connect Telegram\" on your preferences page again."
+	}
+	if err != nil {
+		log.Printf("ERROR in linkTelegramChat: %v", err)
+		return "Could not link this chat, please try again."
+	}
+	return "🔗 This chat is now linked to " + email + ".\n\n" + telegramHelp
+}
+
+// telegramListSignals lists a user's active and paused signals.
+func (a *App) telegramListSignals(ctx context.Context, email string) string {
+	lines, err := a.signalSummaries(ctx, email)
+	if err != nil {
+		return "Could not load your alerts, please try again."
+	}
+	if len(lines) == 0 {
+		return "You have no alerts. Create one with /alert bitcoin 5%"
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signalSummaries describes each of the user's active and paused signals on one line.
+func (a *App) signalSummaries(ctx context.Context, email string) ([]string, error) {
+	iter := a.db.Collection("signals").Where("email", "==", email).Where("status", "in", []string{"active", "paused"}).Documents(ctx)
+	defer iter.Stop()
+	var lines []string
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s Signal
+		doc.DataTo(&s)
+		lines = append(lines, fmt.Sprintf("%s: %s %s from %s [%s]", doc.Ref.ID, s.AssetID, s.thresholdLabel(), formatPrice(s.PriceAtCreation, s.quoteCurrency()), s.Status))
+	}
+}
+
+// updateSignalCommand pauses, resumes or deletes one of the user's signals from a
+// chat command and returns the reply text.
+func (a *App) updateSignalCommand(ctx context.Context, email, command, id string) string {
+	var err error
+	switch command {
+	case "pause", "resume":
+		err = a.setSignalPaused(ctx, email, id, command == "pause")
+	case "delete":
+		ref := a.db.Collection("signals").Doc(id)
+		doc, getErr := ref.Get(ctx)
+		if getErr != nil || doc.Data()["email"] != email {
+			err = errSignalNotFound
+		} else {
+			_, err = ref.Delete(ctx)
+		}
+	}
+	switch {
+	case errors.Is(err, errSignalNotFound):
+		return "No alert with ID " + id + "."
+	case errors.Is(err, errSignalState) && command == "pause":
+		return "That alert is not active."
+	case errors.Is(err, errSignalState):
+		return "That alert is not paused."
+	case err != nil:
+		return "Could not update the alert, please try again."
+	}
+	return fmt.Sprintf("Done: %s %s.", command, id)
+}
+
+// telegramLinkHandler issues a one-time link code for the caller's address, proven
+// by requestEmail, and redirects to the bot's deep link, where /start <code>
+// completes the link.
+func (a *App) telegramLinkHandler(w http.ResponseWriter, r *http.Request) {
+	if a.telegram == nil || a.telegram.Username == "" {
+		http.Error(w, "Telegram bot is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	email, ok := requestEmail(r, r.URL.Query().Get("email"))
+	if !ok {
+		http.Error(w, "Open this link from the preferences page linked in any PricePulse email", http.StatusUnauthorized)
+		return
+	}
+	code, err := randomCode(24)
+	if err != nil {
+		http.Error(w, "Could not create link code", http.StatusInternalServerError)
+		return
+	}
+	_, err = a.db.Collection("telegram_link_codes").Doc(code).Set(context.Background(), map[string]interface{}{
+		"email":     email,
+		"expiresAt": time.Now().Add(telegramLinkCodeTTL),
+	})
+	if err != nil {
+		http.Error(w, "Could not create link code", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "https://t.me/"+url.PathEscape(a.telegram.Username)+"?start="+code, http.StatusSeeOther)
+}
+
+// randomCode returns n random characters from [A-Za-z0-9], the alphabet Telegram
+// allows in deep-link start parameters.
+func randomCode(n int) (string, error) {
+	const alphabet = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, n)
+	for i := range b {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = alphabet[idx.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// notificationTemplateNames lists the notification templates. Names ending in .html
+// are rendered with html/template so values are escaped; the rest are plain text.
+var notificationTemplateNames = []string{
+	"subject.txt", "email.txt", "email.html", "telegram.txt", "slack.txt", "discord.txt", "webpush.txt",
+	"digest_subject.txt", "digest.txt", "digest.html",
+	"verify_subject.txt", "verify.txt", "verify.html",
+}
+
+// isDigestTemplate reports whether a template renders DigestData rather than
+// NotificationData.
+func isDigestTemplate(name string) bool {
+	return strings.HasPrefix(name, "digest")
+}
+
+// isVerificationTemplate reports whether a template renders VerificationData.
+func isVerificationTemplate(name string) bool {
+	return strings.HasPrefix(name, "verify")
+}
+
+// NotificationData is the data model every notification template is rendered with.
+// Prices are preformatted in the signal's quote currency.
+type NotificationData struct {
+	SignalID      string
+	Email         string
+	AssetID       string
+	Currency      string
+	Price         string
+	Baseline      string
+	Change        string
+	ChangePercent float64
+	Direction     string
+	Threshold     float64
+	TriggeredAt   time.Time
+	SignalsURL    string
+	// PreferencesURL and UnsubscribeURL carry the user's signed token.
+	PreferencesURL string
+	UnsubscribeURL string
+	// AckURL acknowledges the trigger and stops its escalation. It is empty when
+	// the alert has no trigger event.
+	AckURL string
+	// ReplyEnabled is set when replies to alert emails are read as commands.
+	ReplyEnabled bool
+	// Subject is the rendered subject.txt, for use in the other templates.
+	Subject string
+}
+
+// newNotificationData builds the template data for an alert.
+func newNotificationData(alert Alert) NotificationData {
+	currency := alert.Signal.quoteCurrency()
+	var ack string
+	if alert.TriggerID != "" {
+		ack = ackURL(alert.TriggerID, ackRecipient(alert))
+	}
+	direction := "up"
+	if alert.ChangePercent < 0 {
+		direction = "down"
+	}
+	return NotificationData{
+		SignalID:       alert.SignalID,
+		Email:          alert.Signal.Email,
+		AssetID:        alert.Signal.AssetID,
+		Currency:       strings.ToUpper(currency),
+		Price:          formatPrice(alert.Price, currency),
+		Baseline:       formatPrice(alert.Signal.PriceAtCreation, currency),
+		Change:         formatChange(alert.ChangePercent),
+		ChangePercent:  alert.ChangePercent,
+		Direction:      direction,
+		Threshold:      alert.Signal.ChangeThresholdPercentage,
+		TriggeredAt:    alert.TriggeredAt,
+		SignalsURL:     signalsPageURL(alert.Signal.Email),
+		PreferencesURL: preferenceCenterURL(alert.Signal.Email),
+		UnsubscribeURL: unsubscribeURL(alert.Signal.Email),
+		AckURL:         ack,
+		ReplyEnabled:   inboundReplyAddress(alert.SignalID) != "",
+	}
+}
+
+// executor is the part of text/template and html/template a NotificationTemplates uses.
+type executor interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// NotificationTemplates renders notification subjects and bodies. A nil
+// *NotificationTemplates renders the embedded defaults.
+type NotificationTemplates struct {
+	templates map[string]executor
+}
+
+var (
+	defaultTemplatesOnce sync.Once
+	defaultTemplates     *NotificationTemplates
+)
+
+// defaultNotificationTemplates returns the templates embedded in the binary.
+func defaultNotificationTemplates() *NotificationTemplates {
+	defaultTemplatesOnce.Do(func() {
+		t, err := LoadNotificationTemplates("")
+		if err != nil {
+			panic("invalid embedded notification template: " + err.Error())
+		}
+		defaultTemplates = t
+	})
+	return defaultTemplates
+}
+
+// LoadNotificationTemplates parses the embedded default templates, replacing any that
+// have a file of the same name in dir (NOTIFICATION_TEMPLATES_DIR). An empty dir
+// uses only the defaults.
+func LoadNotificationTemplates(dir string) (*NotificationTemplates, error) {
+	t := &NotificationTemplates{templates: map[string]executor{}}
+	for _, name := range notificationTemplateNames {
+		src, err := fs.ReadFile(templatesFS, "templates/notifications/"+name)
+		if err != nil {
+			return nil, err
+		}
+		if dir != "" {
+			override, err := os.ReadFile(filepath.Join(dir, name))
+			if err == nil {
+				src = override
+			} else if !errors.Is(err, fs.ErrNotExist) {
+				return nil, err
+			}
+		}
+		tmpl, err := parseNotificationTemplate(name, string(src))
+		if err != nil {
+			return nil, err
+		}
+		t.templates[name] = tmpl
+	}
+	return t, nil
+}
+
+// parseNotificationTemplate parses src with the engine matching name's extension.
+func parseNotificationTemplate(name, src string) (executor, error) {
+	if strings.HasSuffix(name, ".html") {
+		return htmltemplate.New(name).Option("missingkey=error").Parse(src)
+	}
+	return template.New(name).Option("missingkey=error").Parse(src)
+}
+
+// execute renders the named template with data.
+func (t *NotificationTemplates) execute(name string, data interface{}) (string, error) {
+	if t == nil {
+		t = defaultNotificationTemplates()
+	}
+	tmpl, ok := t.templates[name]
+	if !ok {
+		return "", errors.New("unknown notification template " + strconv.Quote(name))
+	}
+	return executeNotificationTemplate(tmpl, data)
+}
+
+// Render renders one template for an alert.
+func (t *NotificationTemplates) Render(name string, alert Alert) (string, error) {
+	data := newNotificationData(alert)
+	if name != "subject.txt" {
+		subject, err := t.execute("subject.txt", data)
+		if err != nil {
+			return "", err
+		}
+		data.Subject = subject
+	}
+	return t.execute(name, data)
+}
+
+// RenderDigest renders the subject and bodies of a digest email.
+func (t *NotificationTemplates) RenderDigest(data DigestData) (subject, plainTextContent, htmlContent string, err error) {
+	if subject, err = t.execute("digest_subject.txt", data); err != nil {
+		return "", "", "", err
+	}
+	data.Subject = subject
+	if plainTextContent, err = t.execute("digest.txt", data); err != nil {
+		return "", "", "", err
+	}
+	if htmlContent, err = t.execute("digest.html", data); err != nil {
+		return "", "", "", err
+	}
+	return subject, plainTextContent, htmlContent, nil
+}
+
+// RenderVerification renders the subject and bodies of an address confirmation email.
+func (t *NotificationTemplates) RenderVerification(data VerificationData) (subject, plainTextContent, htmlContent string, err error) {
+	if subject, err = t.execute("verify_subject.txt", data); err != nil {
+		return "", "", "", err
+	}
+	if plainTextContent, err = t.execute("verify.txt", data); err != nil {
+		return "", "", "", err
+	}
+	if htmlContent, err = t.execute("verify.html", data); err != nil {
+		return "", "", "", err
+	}
+	return subject, plainTextContent, htmlContent, nil
+}
+
+// executeNotificationTemplate runs a parsed template, trimming surrounding whitespace
+// so template files may end with a newline.
+func executeNotificationTemplate(tmpl executor, data interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// Subject renders the subject line, falling back to a fixed one if the template fails.
+func (t *NotificationTemplates) Subject(alert Alert) string {
+	subject, err := t.Render("subject.txt", alert)
+	if err != nil || subject == "" {
+		return "Price Alert for " + alert.Signal.AssetID
+	}
+	return subject
+}
+
+// EmailBodies renders the plain-text and HTML bodies of an alert email.
+func (t *NotificationTemplates) EmailBodies(alert Alert) (plainTextContent, htmlContent string, err error) {
+	if plainTextContent, err = t.Render("email.txt", alert); err != nil {
+		return "", "", err
+	}
+	if htmlContent, err = t.Render("email.html", alert); err != nil {
+		return "", "", err
+	}
+	return plainTextContent, htmlContent, nil
+}
+
+// sampleAlert is the trigger rendered by the template preview endpoint.
+func sampleAlert() Alert {
+	return Alert{
+		SignalID: "sample-signal",
+		Signal: Signal{
+			Email:                     "you@example.com",
+			AssetID:                   "bitcoin",
+			ChangeThresholdPercentage: 5,
+			PriceAtCreation:           60000,
+			QuoteCurrency:             defaultCurrency,
+		},
+		Price:         63000,
+		ChangePercent: 5,
+		TriggeredAt:   time.Now(),
+	}
+}
+
+// templatePreviewHandler renders a notification template against sample trigger
+// data. GET /admin/templates/preview?name=email.html renders the active template;
+// POST with a template as the request body renders that draft instead. The assetId,
+// currency, price and baseline query parameters adjust the sample.
+func (a *App) templatePreviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !bearerAuthorized(r, "ADMIN_API_KEYS") {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	name := q.Get("name")
+	known := false
+	for _, n := range notificationTemplateNames {
+		known = known || n == name
+	}
+	if !known {
+		http.Error(w, "name must be one of "+strings.Join(notificationTemplateNames, ", "), http.StatusBadRequest)
+		return
+	}
+
+	alert := sampleAlert()
+	if v := q.Get("assetId"); v != "" {
+		alert.Signal.AssetID = v
+	}
+	if v := q.Get("currency"); v != "" {
+		currency, err := normalizeCurrency(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		alert.Signal.QuoteCurrency = currency
+	}
+	for param, field := range map[string]*float64{"price": &alert.Price, "baseline": &alert.Signal.PriceAtCreation} {
+		if v := q.Get(param); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f <= 0 {
+				http.Error(w, param+" must be a positive number", http.StatusBadRequest)
+				return
+			}
+			*field = f
+		}
+	}
+	alert.ChangePercent = (alert.Price - alert.Signal.PriceAtCreation) / alert.Signal.PriceAtCreation * 100
+
+	var data interface{}
+	if isVerificationTemplate(name) {
+		data = sampleVerification(alert.Signal.Email)
+	} else if isDigestTemplate(name) {
+		digest := sampleDigest(alert)
+		digest.Subject, _ = a.templates.execute("digest_subject.txt", digest)
+		data = digest
+	} else {
+		n := newNotificationData(alert)
+		n.Subject = a.templates.Subject(alert)
+		data = n
+	}
+
+	var rendered string
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		rendered, err = a.templates.execute(name, data)
+	case http.MethodPost:
+		src, readErr := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if readErr != nil {
+			http.Error(w, readErr.Error(), http.StatusBadRequest)
+			return
+		}
+		var tmpl executor
+		if tmpl, err = parseNotificationTemplate(name, string(src)); err == nil {
+			rendered, err = executeNotificationTemplate(tmpl, data)
+		}
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Template error: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if strings.HasSuffix(name, ".html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	io.WriteString(w, rendered)
+}
@@ -0,0 +1,32 @@
+// PricePulse service worker: shows Web Push alerts as native notifications.
+
+self.addEventListener('push', (event) => {
+    let data = {};
+    try {
+        data = event.data ? event.data.json() : {};
+    } catch (e) {
+        data = { title: 'PricePulse', body: event.data.text() };
+    }
+    const actions = data.ackUrl ? [{ action: 'ack', title: 'Acknowledge' }] : [];
+    event.waitUntil(self.registration.showNotification(data.title || 'PricePulse alert', {
+        body: data.body,
+        tag: data.tag,
+        renotify: true,
+        actions: actions,
+        data: { url: data.url || '/', ackUrl: data.ackUrl },
+    }));
+});
+
+self.addEventListener('notificationclick', (event) => {
+    event.notification.close();
+    const data = event.notification.data || {};
+    const target = event.action === 'ack' && data.ackUrl ? data.ackUrl : data.url;
+    event.waitUntil(clients.matchAll({ type: 'window', includeUncontrolled: true }).then((windows) => {
+        for (const w of windows) {
+            if (w.url === target && 'focus' in w) {
+                return w.focus();
+            }
+        }
+        return clients.openWindow(target);
+    }));
+});
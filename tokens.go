@@ -0,0 +1,89 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	emailLinkSecretOnce sync.Once
+	emailLinkSecretKey  []byte
+)
+
+// emailLinkSecret returns the key that signs the links in emails, from
+// EMAIL_LINK_SECRET or, for deployments configured before it was renamed,
+// UNSUBSCRIBE_SECRET. Without one a random key is used, so links stop working when
+// the process restarts.
+func emailLinkSecret() []byte {
+	emailLinkSecretOnce.Do(func() {
+		for _, name := range []string{"EMAIL_LINK_SECRET", "UNSUBSCRIBE_SECRET"} {
+			if s := os.Getenv(name); s != "" {
+				emailLinkSecretKey = []byte(s)
+				return
+			}
+		}
+		log.Println("EMAIL_LINK_SECRET not set. Links in emails will stop working after a restart.")
+		emailLinkSecretKey = make([]byte, 32)
+		rand.Read(emailLinkSecretKey)
+	})
+	return emailLinkSecretKey
+}
+
+// signToken returns base64url(payload) "." base64url(HMAC-SHA256(purpose:payload)).
+// The purpose keeps a token issued for one action from being replayed for another.
+func signToken(purpose, payload string) string {
+	mac := hmac.New(sha256.New, emailLinkSecret())
+	mac.Write([]byte(purpose + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a token signed for purpose and returns its payload.
+func verifyToken(purpose, token string) (string, error) {
+	encodedPayload, encodedMAC, ok := strings.Cut(token, ".")
+	payload, err1 := base64.RawURLEncoding.DecodeString(encodedPayload)
+	got, err2 := base64.RawURLEncoding.DecodeString(encodedMAC)
+	if !ok || err1 != nil || err2 != nil || len(payload) == 0 {
+		return "", errors.New("malformed token")
+	}
+	mac := hmac.New(sha256.New, emailLinkSecret())
+	mac.Write([]byte(purpose + ":" + string(payload)))
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return "", errors.New("invalid token")
+	}
+	return string(payload), nil
+}
+
+// signExpiringToken signs subject for purpose with an expiry, for links that grant
+// more than unsubscribing and so must stop working after a while.
+func signExpiringToken(purpose, subject string, expiresAt time.Time) string {
+	return signToken(purpose, subject+"|"+strconv.FormatInt(expiresAt.Unix(), 10))
+}
+
+// verifyExpiringToken checks a token from signExpiringToken and returns its subject.
+func verifyExpiringToken(purpose, token string, now time.Time) (string, error) {
+	payload, err := verifyToken(purpose, token)
+	if err != nil {
+		return "", err
+	}
+	i := strings.LastIndex(payload, "|")
+	if i < 0 {
+		return "", errors.New("malformed token")
+	}
+	expiry, err := strconv.ParseInt(payload[i+1:], 10, 64)
+	if err != nil {
+		return "", errors.New("malformed token")
+	}
+	if now.After(time.Unix(expiry, 0)) {
+		return "", errors.New("token expired")
+	}
+	return payload[:i], nil
+}
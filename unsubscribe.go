@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// preferenceTokenTTL is how long a preference-center link stays valid. The link
+// proves ownership of the address for account actions such as reading webhook
+// secrets or linking chat apps, so unlike the unsubscribe link it expires. Every
+// email carries a fresh one.
+const preferenceTokenTTL = 7 * 24 * time.Hour
+
+// signUnsubscribeToken returns a token that lets its holder unsubscribe email. It
+// does not expire, as it is embedded in every email and in the List-Unsubscribe header.
+func signUnsubscribeToken(email string) string {
+	return signToken("unsubscribe", email)
+}
+
+// verifyUnsubscribeToken checks a token and returns the email address it was issued for.
+func verifyUnsubscribeToken(token string) (string, error) {
+	return verifyToken("unsubscribe", token)
+}
+
+// signPreferenceToken returns a token that lets its holder manage email's
+// notification settings until expiresAt.
+func signPreferenceToken(email string, expiresAt time.Time) string {
+	return signExpiringToken("preferences", email, expiresAt)
+}
+
+// verifyPreferenceToken checks a preference token and returns its email address.
+func verifyPreferenceToken(token string, now time.Time) (string, error) {
+	return verifyExpiringToken("preferences", token, now)
+}
+
+// unsubscribeURL is the RFC 8058 one-click unsubscribe endpoint for an address.
+func unsubscribeURL(email string) string {
+	return publicBaseURL() + "/unsubscribe?token=" + url.QueryEscape(signUnsubscribeToken(email))
+}
+
+// preferenceCenterURL links to the page where a user pauses signals or stops email.
+func preferenceCenterURL(email string) string {
+	return publicBaseURL() + "/email-preferences?token=" + url.QueryEscape(signPreferenceToken(email, time.Now().Add(preferenceTokenTTL)))
+}
+
+// unsubscribeHeaders returns the List-Unsubscribe headers sent with every email.
+func unsubscribeHeaders(email string) map[string]string {
+	return map[string]string{
+		"List-Unsubscribe":      "<" + unsubscribeURL(email) + ">",
+		"List-Unsubscribe-Post": "List-Unsubscribe=One-Click",
+	}
+}
+
+// setEmailUnsubscribed stops or resumes all email to an address. Resubscribing also
+// lifts a suspension after a bounce or complaint, as the user asked for email again.
+func (a *App) setEmailUnsubscribed(ctx context.Context, email string, unsubscribed bool) error {
+	update := map[string]interface{}{
+		"email":             email,
+		"emailUnsubscribed": unsubscribed,
+		"updatedAt":         time.Now(),
+	}
+	if !unsubscribed {
+		update["emailSuspended"] = false
+		update["emailSuspendedReason"] = ""
+	}
+	_, err := a.db.Collection("preferences").Doc(email).Set(ctx, update, firestore.MergeAll)
+	return err
+}
+
+// setAllPaused pauses or resumes every signal of an address on every channel.
+func (a *App) setAllPaused(ctx context.Context, email string, paused bool) error {
+	_, err := a.db.Collection("preferences").Doc(email).Set(ctx, map[string]interface{}{
+		"email":     email,
+		"paused":    paused,
+		"updatedAt": time.Now(),
+	}, firestore.MergeAll)
+	return err
+}
+
+// unsubscribeHandler implements one-click unsubscribe (RFC 8058): mail providers
+// POST List-Unsubscribe=One-Click to the URL from the List-Unsubscribe header. A GET
+// from a browser shows a button that POSTs, so that link scanners cannot
+// unsubscribe anyone.
+func (a *App) unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	email, err := verifyUnsubscribeToken(token)
+	if err != nil {
+		http.Error(w, "Invalid or expired unsubscribe link", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		tmpl, err := template.ParseFS(templatesFS, "templates/unsubscribe.html")
+		if err != nil {
+			http.Error(w, "Could not parse unsubscribe template", http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]string{"Email": email, "Token": token})
+	case http.MethodPost:
+		if err := a.setEmailUnsubscribed(context.Background(), email, true); err != nil {
+			log.Printf("ERROR in unsubscribeHandler: Failed to unsubscribe %s: %v", email, err)
+			http.Error(w, "Failed to unsubscribe", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Unsubscribed %s from email alerts", email)
+		w.Write([]byte("You have been unsubscribed from PricePulse emails."))
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Errors from setSignalPaused.
+var (
+	errSignalNotFound = errors.New("signal not found")
+	errSignalState    = errors.New("signal is not in the expected state")
+)
+
+// setSignalPaused pauses an active signal or resumes a paused one, after checking
+// that it belongs to email.
+func (a *App) setSignalPaused(ctx context.Context, email, id string, paused bool) error {
+	from, to := "paused", "active"
+	if paused {
+		from, to = "active", "paused"
+	}
+	ref := a.db.Collection("signals").Doc(id)
+	return a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return errSignalNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var s Signal
+		doc.DataTo(&s)
+		if s.Email != email {
+			return errSignalNotFound
+		}
+		if s.Status != from {
+			return errSignalState
+		}
+		return tx.Update(ref, []firestore.Update{{Path: "status", Value: to}})
+	})
+}
+
+// preferenceCenterSignal is one row of the preference center.
+type preferenceCenterSignal struct {
+	ID     string
+	Signal Signal
+}
+
+// emailPreferencesHandler is the preference center reached from every email. GET
+// shows the user's signals and email settings; POST applies one action: pause_all,
+// resume_all, unsubscribe, resubscribe, or pause/resume with a signal ID.
+func (a *App) emailPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	email, err := verifyPreferenceToken(token, time.Now())
+	if err != nil {
+		http.Error(w, "Invalid or expired preferences link. Use the link in a recent email from us.", http.StatusForbidden)
+		return
+	}
+	ctx := context.Background()
+
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Failed to parse form", http.StatusBadRequest)
+			return
+		}
+		switch action := r.FormValue("action"); action {
+		case "pause_all", "resume_all":
+			err = a.setAllPaused(ctx, email, action == "pause_all")
+		case "unsubscribe", "resubscribe":
+			err = a.setEmailUnsubscribed(ctx, email, action == "unsubscribe")
+		case "pause", "resume":
+			err = a.setSignalPaused(ctx, email, r.FormValue("signal"), action == "pause")
+			if errors.Is(err, errSignalNotFound) || errors.Is(err, errSignalState) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		default:
+			http.Error(w, fmt.Sprintf("Unknown action %q", action), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("ERROR in emailPreferencesHandler: Failed to update preferences for %s: %v", email, err)
+			http.Error(w, "Failed to update preferences", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/email-preferences?token="+url.QueryEscape(token), http.StatusSeeOther)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	prefs, err := a.getPreferences(ctx, email)
+	if err != nil {
+		http.Error(w, "Failed to retrieve preferences", http.StatusInternalServerError)
+		return
+	}
+	var signals []preferenceCenterSignal
+	iter := a.db.Collection("signals").Where("email", "==", email).Where("status", "in", []string{"active", "paused"}).Documents(ctx)
+	defer iter.Stop()
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Failed to retrieve signals", http.StatusInternalServerError)
+			return
+		}
+		var s Signal
+		doc.DataTo(&s)
+		s.QuoteCurrency = s.quoteCurrency()
+		signals = append(signals, preferenceCenterSignal{ID: doc.Ref.ID, Signal: s})
+	}
+
+	tmpl, err := template.New("email_preferences.html").Funcs(template.FuncMap{"formatPrice": formatPrice}).ParseFS(templatesFS, "templates/email_preferences.html")
+	if err != nil {
+		http.Error(w, "Could not parse preferences template", http.StatusInternalServerError)
+		return
+	}
+	tmpl.Execute(w, map[string]interface{}{
+		"Email":       email,
+		"Token":       token,
+		"Preferences": prefs,
+		"Signals":     signals,
+		// The "Connect Telegram" link only works when the bot has a public username.
+		"TelegramEnabled": a.telegram != nil && a.telegram.Username != "",
+		"SlackEnabled":    os.Getenv("SLACK_SIGNING_SECRET") != "",
+	})
+}
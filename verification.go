@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// statusPendingVerification marks a signal whose email recipient has not confirmed
+// their address yet. It becomes active when they follow the link in the
+// confirmation email.
+const statusPendingVerification = "pending_verification"
+
+// verificationTTL is how long a confirmation link stays valid. A new one is sent
+// only after the previous one has expired, so each address gets a single message.
+const verificationTTL = 7 * 24 * time.Hour
+
+// VerificationData is the data model of the verify_* templates.
+type VerificationData struct {
+	Email     string
+	VerifyURL string
+	ExpiresAt time.Time
+}
+
+// signVerificationToken returns a token confirming email that expires at expiresAt.
+func signVerificationToken(email string, expiresAt time.Time) string {
+	return signExpiringToken("verify", email, expiresAt)
+}
+
+// verifyVerificationToken checks a confirmation token and returns its email address.
+func verifyVerificationToken(token string, now time.Time) (string, error) {
+	return verifyExpiringToken("verify", token, now)
+}
+
+// verificationURL is the confirmation link sent to an unverified address.
+func verificationURL(email string, expiresAt time.Time) string {
+	return publicBaseURL() + "/verify?token=" + url.QueryEscape(signVerificationToken(email, expiresAt))
+}
+
+// sampleVerification is the message rendered by the template preview endpoint.
+func sampleVerification(email string) VerificationData {
+	expiresAt := time.Now().Add(verificationTTL)
+	return VerificationData{Email: email, VerifyURL: verificationURL(email, expiresAt), ExpiresAt: expiresAt}
+}
+
+// usesEmail reports whether a signal delivers to its owner's email address.
+func usesEmail(s Signal) bool {
+	for _, c := range s.channels() {
+		if c == "email" {
+			return true
+		}
+	}
+	return false
+}
+
+// ensureVerificationSent emails a confirmation link to an unverified address, unless
+// one that is still valid was already sent. Claiming the send in a transaction keeps
+// concurrent signal creations from mailing the user twice.
+func (a *App) ensureVerificationSent(ctx context.Context, email string) error {
+	if a.mailer == nil {
+		return nil
+	}
+	ref := a.db.Collection("preferences").Doc(email)
+	now := time.Now()
+	send := false
+	err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		send = false
+		var prefs UserPreferences
+		doc, err := tx.Get(ref)
+		if err == nil {
+			doc.DataTo(&prefs)
+		} else if status.Code(err) != codes.NotFound {
+			return err
+		}
+		if prefs.EmailVerified || prefs.EmailSuspended || now.Sub(prefs.VerificationSentAt) < verificationTTL {
+			return nil
+		}
+		send = true
+		return tx.Set(ref, map[string]interface{}{"email": email, "verificationSentAt": now}, firestore.MergeAll)
+	})
+	if err != nil || !send {
+		return err
+	}
+
+	data := VerificationData{Email: email, VerifyURL: verificationURL(email, now.Add(verificationTTL)), ExpiresAt: now.Add(verificationTTL)}
+	subject, plainTextContent, htmlContent, err := a.templates.RenderVerification(data)
+	if err == nil {
+		err = a.mailer.SendEmail(ctx, EmailMessage{To: email, Subject: subject, PlainText: plainTextContent, HTML: htmlContent, CustomArgs: map[string]string{"kind": "verification"}})
+	}
+	if err != nil {
+		// Forget the send so the next signal or collection run tries again.
+		ref.Update(ctx, []firestore.Update{{Path: "verificationSentAt", Value: time.Time{}}})
+		return fmt.Errorf("failed to send confirmation email to %s: %w", email, err)
+	}
+	log.Printf("Sent confirmation email to %s", email)
+	return nil
+}
+
+// holdForVerification moves an active signal of an unverified user to
+// pending_verification and makes sure they have a confirmation link.
+func (a *App) holdForVerification(ctx context.Context, ref *firestore.DocumentRef, email string) {
+	if _, err := ref.Update(ctx, []firestore.Update{{Path: "status", Value: statusPendingVerification}}); err != nil {
+		log.Printf("Failed to hold signal %s for verification: %v", ref.ID, err)
+		return
+	}
+	log.Printf("Signal %s is waiting for %s to confirm their email address", ref.ID, email)
+	if err := a.ensureVerificationSent(ctx, email); err != nil {
+		log.Printf("ERROR in holdForVerification: %v", err)
+	}
+}
+
+// activatePendingSignals activates a newly verified user's pending signals. Their
+// baseline is reset to the current price, since the price may have moved while the
+// confirmation email sat unread.
+func (a *App) activatePendingSignals(ctx context.Context, email string) (int, error) {
+	iter := a.db.Collection("signals").Where("email", "==", email).Where("status", "==", statusPendingVerification).Documents(ctx)
+	defer iter.Stop()
+	activated := 0
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return activated, err
+		}
+		var s Signal
+		doc.DataTo(&s)
+		updates := []firestore.Update{{Path: "status", Value: "active"}}
+		if price, err := a.fetchCurrentPrice(ctx, s.AssetID, s.quoteCurrency()); err == nil {
+			updates = append(updates, firestore.Update{Path: "priceAtCreation", Value: price})
+		} else {
+			log.Printf("Keeping the original baseline of signal %s: %v", doc.Ref.ID, err)
+		}
+		if _, err := doc.Ref.Update(ctx, updates); err != nil {
+			return activated, err
+		}
+		activated++
+	}
+	return activated, nil
+}
+
+// verifyEmailHandler serves the link in the confirmation email. GET shows a button,
+// so that link scanners cannot confirm addresses; POST confirms the address,
+// activates the user's pending signals and shows their signals page.
+func (a *App) verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	email, err := verifyVerificationToken(token, time.Now())
+	if err != nil {
+		http.Error(w, "Invalid or expired confirmation link", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodGet {
+		tmpl, err := template.ParseFS(templatesFS, "templates/verify_email.html")
+		if err != nil {
+			http.Error(w, "Could not parse confirmation template", http.StatusInternalServerError)
+			return
+		}
+		tmpl.Execute(w, map[string]string{"Email": email, "Token": token})
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := context.Background()
+	_, err = a.db.Collection("preferences").Doc(email).Set(ctx, map[string]interface{}{
+		"email":         email,
+		"emailVerified": true,
+		"updatedAt":     time.Now(),
+	}, firestore.MergeAll)
+	if err != nil {
+		log.Printf("ERROR in verifyEmailHandler: Failed to mark %s verified: %v", email, err)
+		http.Error(w, "Failed to confirm email address", http.StatusInternalServerError)
+		return
+	}
+	activated, err := a.activatePendingSignals(ctx, email)
+	if err != nil {
+		log.Printf("ERROR in verifyEmailHandler: Failed to activate signals for %s: %v", email, err)
+		http.Error(w, "Failed to activate signals", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Verified %s and activated %d signal(s)", email, activated)
+	// Following the emailed link proved ownership, so the signals page may show the settings.
+	token = signPreferenceToken(email, time.Now().Add(preferenceTokenTTL))
+	http.Redirect(w, r, "/signals/"+url.PathEscape(email)+"?token="+url.QueryEscape(token), http.StatusSeeOther)
+}
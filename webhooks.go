@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// webhookPayloadVersion is bumped whenever the payload shape changes incompatibly.
+const webhookPayloadVersion = "1"
+
+// webhookSecretOverlap is how long a rotated-out secret keeps signing deliveries so
+// receivers can switch over without rejecting events.
+const webhookSecretOverlap = 24 * time.Hour
+
+// Webhook delivery headers.
+const (
+	webhookTimestampHeader = "PricePulse-Timestamp"
+	webhookSignatureHeader = "PricePulse-Signature"
+	webhookEventIDHeader   = "PricePulse-Event-Id"
+	webhookVersionHeader   = "PricePulse-Webhook-Version"
+)
+
+// WebhookSecret is one signing secret of a webhook endpoint.
+type WebhookSecret struct {
+	Secret    string    `firestore:"secret"`
+	CreatedAt time.Time `firestore:"createdAt"`
+	// ExpiresAt is zero for the current secret and set once it has been rotated out.
+	ExpiresAt time.Time `firestore:"expiresAt"`
+}
+
+// WebhookEndpoint is a user-registered URL that receives trigger events.
+type WebhookEndpoint struct {
+	ID        string          `firestore:"-" json:"id"`
+	Email     string          `firestore:"email" json:"email"`
+	URL       string          `firestore:"url" json:"url"`
+	Secrets   []WebhookSecret `firestore:"secrets" json:"-"`
+	CreatedAt time.Time       `firestore:"createdAt" json:"createdAt"`
+}
+
+// activeSecrets returns the secrets that should sign a delivery at the given time.
+func (e WebhookEndpoint) activeSecrets(now time.Time) []string {
+	var secrets []string
+	for _, s := range e.Secrets {
+		if s.ExpiresAt.IsZero() || now.Before(s.ExpiresAt) {
+			secrets = append(secrets, s.Secret)
+		}
+	}
+	return secrets
+}
+
+// WebhookPayload is the versioned JSON body posted for a triggered signal.
+type WebhookPayload struct {
+	Version       string             `json:"version"`
+	Type          string             `json:"type"`
+	EventID       string             `json:"eventId"`
+	Signal        WebhookSignalBlock `json:"signal"`
+	AssetID       string             `json:"assetId"`
+	Currency      string             `json:"currency"`
+	BaselinePrice float64            `json:"baselinePrice"`
+	CurrentPrice  float64            `json:"currentPrice"`
+	ChangePercent float64            `json:"changePercent"`
+	TriggeredAt   time.Time          `json:"triggeredAt"`
+}
+
+// WebhookSignalBlock describes the signal that fired.
+type WebhookSignalBlock struct {
+	ID                        string    `json:"id"`
+	AssetID                   string    `json:"assetId"`
+	ChangeThresholdPercentage float64   `json:"changeThresholdPercentage"`
+	CreatedAt                 time.Time `json:"createdAt"`
+}
+
+// newWebhookPayload builds the trigger event for an alert.
+func newWebhookPayload(alert Alert) WebhookPayload {
+	return WebhookPayload{
+		Version: webhookPayloadVersion,
+		Type:    "signal.triggered",
+		EventID: fmt.Sprintf("%s-%d", alert.SignalID, alert.TriggeredAt.UnixMilli()),
+		Signal: WebhookSignalBlock{
+			ID:                        alert.SignalID,
+			AssetID:                   alert.Signal.AssetID,
+			ChangeThresholdPercentage: alert.Signal.ChangeThresholdPercentage,
+			CreatedAt:                 alert.Signal.CreatedAt,
+		},
+		AssetID:       alert.Signal.AssetID,
+		Currency:      alert.Signal.quoteCurrency(),
+		BaselinePrice: alert.Signal.PriceAtCreation,
+		CurrentPrice:  alert.Price,
+		ChangePercent: alert.ChangePercent,
+		TriggeredAt:   alert.TriggeredAt,
+	}
+}
+
+// signWebhook returns the signature header value for a body sent at timestamp. Each
+// secret contributes one "v1=<hex HMAC-SHA256 of "timestamp.body">" entry.
+func signWebhook(secrets []string, timestamp int64, body []byte) string {
+	sigs := make([]string, 0, len(secrets))
+	for _, secret := range secrets {
+		mac := hmac.New(sha256.New, []byte(secret))
+		fmt.Fprintf(mac, "%d.", timestamp)
+		mac.Write(body)
+		sigs = append(sigs, "v1="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	return strings.Join(sigs, ",")
+}
+
+// newWebhookSecret generates a random signing secret.
+func newWebhookSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return "whsec_" + hex.EncodeToString(b)
+}
+
+// validateWebhookURL checks that raw is an absolute http(s) URL whose host is not
+// obviously internal. Hostnames are checked again when dialling, by
+// dialPublicOnly, since they may resolve differently later.
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return fmt.Errorf("url must be an http or https URL")
+	}
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return fmt.Errorf("url must not point to a private or loopback address")
+	}
+	if ip, err := netip.ParseAddr(host); err == nil && !publicAddr(ip) {
+		return fmt.Errorf("url must not point to a private or loopback address")
+	}
+	return nil
+}
+
+// publicAddr reports whether ip is a globally routable unicast address: not
+// loopback, private, link-local (which includes cloud metadata servers),
+// carrier-grade NAT or unspecified.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is not
+// covered by netip.Addr.IsPrivate.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// dialPublicOnly is a net.Dialer Control function that refuses connections to
+// non-public addresses, whatever the hostname resolved to.
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(addrPort.Addr()) {
+		return &permanentError{fmt.Errorf("refusing to connect to non-public address %s", addrPort.Addr())}
+	}
+	return nil
+}
+
+// newPublicOnlyClient returns an HTTP client that can only reach public addresses,
+// for requests to user-supplied URLs. It ignores proxy settings, which would
+// otherwise bypass the check.
+func newPublicOnlyClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = (&net.Dialer{Timeout: timeout, Control: dialPublicOnly}).DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// permanentError marks a delivery failure that retrying cannot fix.
+type permanentError struct{ err error }
+
+func (e *permanentError) Error() string { return e.err.Error() }
+func (e *permanentError) Unwrap() error { return e.err }
+
+// WebhookNotifier posts signed trigger events to every webhook endpoint registered
+// for the signal owner's email, retrying transient failures with exponential backoff
+// up to MaxAttempts times. Under the outbox, which retries on its own, MaxAttempts
+// is 1.
+type WebhookNotifier struct {
+	// Endpoints returns the endpoints registered for an email address.
+	Endpoints   func(ctx context.Context, email string) ([]WebhookEndpoint, error)
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	// Sleep waits between attempts; tests replace it to run instantly.
+	Sleep func(ctx context.Context, d time.Duration) error
+}
+
+// NewWebhookNotifier creates a webhook notifier reading endpoints from Firestore.
+func NewWebhookNotifier(db *firestore.Client) *WebhookNotifier {
+	return &WebhookNotifier{
+		Endpoints: func(ctx context.Context, email string) ([]WebhookEndpoint, error) {
+			return listWebhookEndpoints(ctx, db, email)
+		},
+		Client:      newPublicOnlyClient(10 * time.Second),
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    30 * time.Second,
+		Sleep:       sleepContext,
+	}
+}
+
+// sleepContext waits for d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// backoffDelay returns the wait before retry number attempt (1-based).
+func backoffDelay(attempt int, base, maxDelay time.Duration) time.Duration {
+	d := base << (attempt - 1)
+	if d <= 0 || d > maxDelay {
+		return maxDelay
+	}
+	return d
+}
+
+// Notify delivers the alert to each of the owner's endpoints that did not receive it
+// on an earlier attempt. If only some succeed, it returns a partialDeliveryError
+// naming them.
+func (n *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	endpoints, err := n.Endpoints(ctx, alert.Signal.Email)
+	if err != nil {
+		return fmt.Errorf("failed to load webhook endpoints: %w", err)
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no webhook endpoints registered for %s", alert.Signal.Email)
+	}
+	payload := newWebhookPayload(alert)
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	var delivered []string
+	for _, endpoint := range endpoints {
+		if slices.Contains(alert.Delivered, endpoint.ID) {
+			continue
+		}
+		if err := n.deliver(ctx, endpoint, payload.EventID, body); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", endpoint.URL, err))
+			continue
+		}
+		delivered = append(delivered, endpoint.ID)
+	}
+	err = errors.Join(errs...)
+	if err != nil && len(delivered) > 0 {
+		return &partialDeliveryError{Delivered: delivered, err: err}
+	}
+	return err
+}
+
+// deliver posts body to one endpoint, retrying on network errors, 429 and 5xx.
+func (n *WebhookNotifier) deliver(ctx context.Context, endpoint WebhookEndpoint, eventID string, body []byte) error {
+	var lastErr error
+	for attempt := 1; attempt <= n.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := n.Sleep(ctx, backoffDelay(attempt-1, n.BaseDelay, n.MaxDelay)); err != nil {
+				return err
+			}
+		}
+		lastErr = n.post(ctx, endpoint, eventID, body)
+		if lastErr == nil {
+			return nil
+		}
+		var perm *permanentError
+		if errors.As(lastErr, &perm) {
+			return lastErr
+		}
+		log.Printf("Webhook delivery to %s failed (attempt %d/%d): %v", endpoint.URL, attempt, n.MaxAttempts, lastErr)
+	}
+	if n.MaxAttempts == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("giving up after %d attempts: %w", n.MaxAttempts, lastErr)
+}
+
+// post makes a single signed delivery attempt. The signature is recomputed per
+// attempt so the timestamp stays fresh for the receiver's replay window.
+func (n *WebhookNotifier) post(ctx context.Context, endpoint WebhookEndpoint, eventID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PricePulse-Webhooks/"+webhookPayloadVersion)
+	req.Header.Set(webhookEventIDHeader, eventID)
+	req.Header.Set(webhookVersionHeader, webhookPayloadVersion)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(now.Unix(), 10))
+	req.Header.Set(webhookSignatureHeader, signWebhook(endpoint.activeSecrets(now), now.Unix(), body))
+
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &httpStatusError{resp.StatusCode, fmt.Sprintf("endpoint returned status %d", resp.StatusCode)}
+	default:
+		return &permanentError{&httpStatusError{resp.StatusCode, fmt.Sprintf("endpoint returned status %d", resp.StatusCode)}}
+	}
+}
+
+// listWebhookEndpoints returns the endpoints registered for an email address.
+func listWebhookEndpoints(ctx context.Context, db *firestore.Client, email string) ([]WebhookEndpoint, error) {
+	iter := db.Collection("webhooks").Where("email", "==", email).Documents(ctx)
+	defer iter.Stop()
+	var endpoints []WebhookEndpoint
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e WebhookEndpoint
+		doc.DataTo(&e)
+		e.ID = doc.Ref.ID
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, nil
+}
+
+// webhooksHandler lists (GET) or registers (POST) the webhook endpoints of the
+// caller's address, proven by requestEmail. The signing secret is only ever returned
+// on creation and rotation.
+func (a *App) webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	switch r.Method {
+	case http.MethodGet:
+		email, ok := requestEmail(r, r.URL.Query().Get("email"))
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		endpoints, err := listWebhookEndpoints(ctx, a.db, email)
+		if err != nil {
+			http.Error(w, "Failed to retrieve webhooks", http.StatusInternalServerError)
+			return
+		}
+		if endpoints == nil {
+			endpoints = []WebhookEndpoint{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(endpoints)
+
+	case http.MethodPost:
+		var data struct {
+			Email string `json:"email"`
+			URL   string `json:"url"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		email, ok := requestEmail(r, data.Email)
+		if !ok {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err := validateWebhookURL(data.URL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		now := time.Now()
+		secret := newWebhookSecret()
+		endpoint := WebhookEndpoint{
+			Email:     email,
+			URL:       data.URL,
+			Secrets:   []WebhookSecret{{Secret: secret, CreatedAt: now}},
+			CreatedAt: now,
+		}
+		ref, _, err := a.db.Collection("webhooks").Add(ctx, endpoint)
+		if err != nil {
+			http.Error(w, "Failed to create webhook", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "webhook created", "id": ref.ID, "secret": secret})
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// webhookHandler deletes an endpoint (DELETE /webhooks/{id}) or rotates its signing
+// secret (POST /webhooks/{id}/rotate) for the owner of its address. The previous
+// secret keeps signing for webhookSecretOverlap after a rotation.
+func (a *App) webhookHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/webhooks/"), "/")
+	if id == "" {
+		http.Error(w, "Webhook ID is required", http.StatusBadRequest)
+		return
+	}
+	ref := a.db.Collection("webhooks").Doc(id)
+	doc, err := ref.Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Failed to retrieve webhook", http.StatusInternalServerError)
+		return
+	}
+	email, _ := doc.Data()["email"].(string)
+	if _, ok := requestEmail(r, email); !ok || email == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodDelete && action == "":
+		if _, err := ref.Delete(ctx); err != nil {
+			http.Error(w, "Failed to delete webhook", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": "webhook deleted"})
+
+	case r.Method == http.MethodPost && action == "rotate":
+		secret := newWebhookSecret()
+		err := a.db.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+			doc, err := tx.Get(ref)
+			if err != nil {
+				return err
+			}
+			var endpoint WebhookEndpoint
+			doc.DataTo(&endpoint)
+			now := time.Now()
+			var secrets []WebhookSecret
+			for _, s := range endpoint.Secrets {
+				if s.ExpiresAt.IsZero() {
+					s.ExpiresAt = now.Add(webhookSecretOverlap)
+				}
+				if now.Before(s.ExpiresAt) {
+					secrets = append(secrets, s)
+				}
+			}
+			secrets = append(secrets, WebhookSecret{Secret: secret, CreatedAt: now})
+			return tx.Update(ref, []firestore.Update{{Path: "secrets", Value: secrets}})
+		})
+		if status.Code(err) == codes.NotFound {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Failed to rotate webhook secret", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"status": "secret rotated", "secret": secret, "previousSecretValidFor": webhookSecretOverlap.String()})
+
+	default:
+		http.Error(w, "Unsupported webhook operation", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// webPushRecordSize is the aes128gcm record size; a payload must fit in one record.
+	webPushRecordSize = 4096
+	// webPushMaxPayload is the largest payload whose encrypted message fits in the
+	// 4096 bytes push services must accept (RFC 8291, Section 4): 4096 less the
+	// 86-byte header (salt, record size, key length and key) and the record's
+	// delimiter and 16-byte GCM tag.
+	webPushMaxPayload = 3993
+	// webPushTTL is how long a push service keeps a message for an offline browser.
+	webPushTTL = 24 * time.Hour
+)
+
+// VAPIDKeys identify this server to push services (RFC 8292). Browsers subscribe
+// with the public key, and every push request is signed with the private key.
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+	// Public is the uncompressed P-256 public key, base64url-encoded as browsers
+	// expect it for applicationServerKey.
+	Public string
+}
+
+// GenerateVAPIDKeys creates a new key pair, returning it and the base64url private
+// key to put in VAPID_PRIVATE_KEY.
+func GenerateVAPIDKeys() (*VAPIDKeys, string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(key.Bytes())
+	keys, err := ParseVAPIDPrivateKey(encoded)
+	return keys, encoded, err
+}
+
+// ParseVAPIDPrivateKey loads a key pair from a base64url raw P-256 private key.
+func ParseVAPIDPrivateKey(encoded string) (*VAPIDKeys, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(encoded, "="))
+	if err != nil {
+		return nil, fmt.Errorf("VAPID private key is not base64url: %w", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+	pub := key.PublicKey().Bytes()
+	private := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(pub[1:33]), Y: new(big.Int).SetBytes(pub[33:])},
+		D:         new(big.Int).SetBytes(raw),
+	}
+	return &VAPIDKeys{private: private, Public: base64.RawURLEncoding.EncodeToString(pub)}, nil
+}
+
+// authorization returns the VAPID Authorization header for a push endpoint: an ES256
+// JWT for the endpoint's origin plus the public key.
+func (k *VAPIDKeys) authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return "vapid t=" + signingInput + "." + base64.RawURLEncoding.EncodeToString(sig) + ", k=" + k.Public, nil
+}
+
+// hkdf is HKDF-SHA-256 (RFC 5869) for outputs of at most one hash block.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}
+
+// encryptWebPush encrypts a push message for one subscription (RFC 8291) in the
+// aes128gcm content coding (RFC 8188). asKey and salt are fresh for every message;
+// they are parameters so tests can use the RFC's example values.
+func encryptWebPush(plaintext, uaPublic, authSecret []byte, asKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext) > webPushMaxPayload {
+		return nil, fmt.Errorf("push payload is %d bytes; the limit is %d", len(plaintext), webPushMaxPayload)
+	}
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	ecdhSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asKey.PublicKey().Bytes()
+
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := hkdf(authSecret, ecdhSecret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// A single record ends with the 0x02 last-record delimiter and no padding.
+	record := gcm.Seal(nil, nonce, append(slices.Clone(plaintext), 2), nil)
+
+	var buf bytes.Buffer
+	buf.Write(salt)
+	binary.Write(&buf, binary.BigEndian, uint32(webPushRecordSize))
+	buf.WriteByte(byte(len(asPublic)))
+	buf.Write(asPublic)
+	buf.Write(record)
+	return buf.Bytes(), nil
+}
+
+// PushSubscription is a browser's push subscription, stored in push_subscriptions
+// under a hash of its endpoint.
+type PushSubscription struct {
+	Email    string `firestore:"email" json:"email"`
+	Endpoint string `firestore:"endpoint" json:"endpoint"`
+	// P256dh and Auth are the browser's encryption key and authentication secret,
+	// base64url-encoded.
+	P256dh    string    `firestore:"p256dh" json:"-"`
+	Auth      string    `firestore:"auth" json:"-"`
+	CreatedAt time.Time `firestore:"createdAt" json:"createdAt"`
+}
+
+// pushSubscriptionID derives a document ID from an endpoint URL.
+func pushSubscriptionID(endpoint string) string {
+	sum := sha256.Sum256([]byte(endpoint))
+	return hex.EncodeToString(sum[:16])
+}
+
+// WebPushPayload is the JSON the service worker receives.
+type WebPushPayload struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	// AckURL lets the notification offer an Acknowledge action.
+	AckURL string `json:"ackUrl,omitempty"`
+	// Tag makes a newer alert for the same signal replace the older one.
+	Tag string `json:"tag"`
+}
+
+// WebPushNotifier is the webpush channel: it encrypts an alert for each browser
+// the signal owner subscribed and posts it to the browser's push service.
+type WebPushNotifier struct {
+	Keys *VAPIDKeys
+	// Subject is the contact URL or mailto: address push services see in the JWT.
+	Subject string
+	// Subscriptions returns the subscriptions of an email address, and Expired
+	// removes one the push service no longer knows.
+	Subscriptions func(ctx context.Context, email string) ([]PushSubscription, error)
+	Expired       func(ctx context.Context, sub PushSubscription)
+	Client        *http.Client
+	Templates     *NotificationTemplates
+}
+
+// NewWebPushNotifierFromEnv configures Web Push from VAPID_PRIVATE_KEY and
+// VAPID_SUBJECT. It returns nil when no key is set.
+func NewWebPushNotifierFromEnv(db *firestore.Client, templates *NotificationTemplates) (*WebPushNotifier, error) {
+	encoded := os.Getenv("VAPID_PRIVATE_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	keys, err := ParseVAPIDPrivateKey(encoded)
+	if err != nil {
+		return nil, err
+	}
+	subject := os.Getenv("VAPID_SUBJECT")
+	if subject == "" {
+		subject = publicBaseURL()
+	}
+	return &WebPushNotifier{
+		Keys:    keys,
+		Subject: subject,
+		Subscriptions: func(ctx context.Context, email string) ([]PushSubscription, error) {
+			return listPushSubscriptions(ctx, db, email)
+		},
+		Expired: func(ctx context.Context, sub PushSubscription) {
+			if _, err := db.Collection("push_subscriptions").Doc(pushSubscriptionID(sub.Endpoint)).Delete(ctx); err != nil {
+				log.Printf("Failed to delete expired push subscription: %v", err)
+			}
+		},
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		Templates: templates,
+	}, nil
+}
+
+// payload renders the notification for an alert.
+func (n *WebPushNotifier) payload(alert Alert) ([]byte, error) {
+	body, err := n.Templates.Render("webpush.txt", alert)
+	if err != nil {
+		return nil, err
+	}
+	data := newNotificationData(alert)
+	return json.Marshal(WebPushPayload{
+		Title:  n.Templates.Subject(alert),
+		Body:   body,
+		URL:    data.SignalsURL,
+		AckURL: data.AckURL,
+		Tag:    "signal-" + alert.SignalID,
+	})
+}
+
+// Notify pushes the alert to every browser the owner subscribed. Subscriptions the
+// push service reports as gone are removed.
+func (n *WebPushNotifier) Notify(ctx context.Context, alert Alert) error {
+	subs, err := n.Subscriptions(ctx, alert.Signal.Email)
+	if err != nil {
+		return fmt.Errorf("failed to load push subscriptions: %w", err)
+	}
+	if len(subs) == 0 {
+		return &permanentError{fmt.Errorf("no browsers subscribed to push for %s", alert.Signal.Email)}
+	}
+	payload, err := n.payload(alert)
+	if err != nil {
+		return fmt.Errorf("failed to render push notification: %w", err)
+	}
+	urgency := "normal"
+	if alert.Signal.Critical {
+		urgency = "high"
+	}
+	var errs []error
+	for _, sub := range subs {
+		err := n.send(ctx, sub, payload, urgency)
+		if errors.Is(err, errPushSubscriptionGone) {
+			log.Printf("Push subscription of %s expired; removing it", sub.Email)
+			if n.Expired != nil {
+				n.Expired(ctx, sub)
+			}
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// errPushSubscriptionGone is returned by send when the push service no longer knows
+// the subscription.
+var errPushSubscriptionGone = errors.New("push subscription expired")
+
+// send encrypts payload for one subscription and posts it to its push service.
+func (n *WebPushNotifier) send(ctx context.Context, sub PushSubscription, payload []byte, urgency string) error {
+	uaPublic, err1 := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.P256dh, "="))
+	authSecret, err2 := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Auth, "="))
+	if err1 != nil || err2 != nil {
+		return &permanentError{errors.New("subscription keys are not base64url")}
+	}
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	body, err := encryptWebPush(payload, uaPublic, authSecret, asKey, salt)
+	if err != nil {
+		return &permanentError{err}
+	}
+	authorization, err := n.Keys.authorization(sub.Endpoint, n.Subject, time.Now())
+	if err != nil {
+		return &permanentError{err}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return &permanentError{err}
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", urgency)
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errPushSubscriptionGone
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return &httpStatusError{resp.StatusCode, fmt.Sprintf("push service returned status %d", resp.StatusCode)}
+	default:
+		return &permanentError{&httpStatusError{resp.StatusCode, fmt.Sprintf("push service returned status %d", resp.StatusCode)}}
+	}
+}
+
+// listPushSubscriptions returns the push subscriptions of an email address.
+func listPushSubscriptions(ctx context.Context, db *firestore.Client, email string) ([]PushSubscription, error) {
+	iter := db.Collection("push_subscriptions").Where("email", "==", email).Documents(ctx)
+	defer iter.Stop()
+	var subs []PushSubscription
+	for {
+		doc, err := iter.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var s PushSubscription
+		doc.DataTo(&s)
+		subs = append(subs, s)
+	}
+	return subs, nil
+}
+
+// webPushServiceHosts are the push services of the major browsers: Chrome, Firefox,
+// Safari and Edge. A leading dot matches any subdomain. Subscriptions for other hosts
+// are rejected, as the server would POST to whatever endpoint it is given.
+var webPushServiceHosts = []string{
+	"fcm.googleapis.com",
+	"updates.push.services.mozilla.com",
+	"web.push.apple.com",
+	".notify.windows.com",
+}
+
+// isPushServiceEndpoint reports whether endpoint is an https URL on a known push service.
+func isPushServiceEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || (u.Port() != "" && u.Port() != "443") {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range webPushServiceHosts {
+		if host == allowed || (strings.HasPrefix(allowed, ".") && strings.HasSuffix(host, allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// pushSubscriptionRequest is the body of POST and DELETE /push/subscriptions: the
+// owner's email and the browser's PushSubscription.toJSON().
+type pushSubscriptionRequest struct {
+	Email        string `json:"email"`
+	Subscription struct {
+		Endpoint string `json:"endpoint"`
+		Keys     struct {
+			P256dh string `json:"p256dh"`
+			Auth   string `json:"auth"`
+		} `json:"keys"`
+	} `json:"subscription"`
+}
+
+// pushSubscriptionsHandler stores a browser's subscription on POST, for an address
+// the caller has proven to own with requestEmail, and removes it on DELETE.
+func (a *App) pushSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if a.webPush == nil {
+		http.Error(w, "Web Push is not configured", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Only POST and DELETE methods are allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req pushSubscriptionRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, 16<<10)).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !isPushServiceEndpoint(req.Subscription.Endpoint) {
+		http.Error(w, "subscription endpoint must be an https URL of a known push service", http.StatusBadRequest)
+		return
+	}
+	ctx := context.Background()
+
+	if r.Method == http.MethodDelete {
+		if _, err := a.db.Collection("push_subscriptions").Doc(pushSubscriptionID(req.Subscription.Endpoint)).Delete(ctx); err != nil {
+			log.Printf("ERROR in pushSubscriptionsHandler: Failed to delete subscription: %v", err)
+			http.Error(w, "Failed to delete subscription", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	email, ok := requestEmail(r, strings.TrimSpace(req.Email))
+	if !ok {
+		http.Error(w, "Enable browser notifications from the signals page linked in the preference center", http.StatusUnauthorized)
+		return
+	}
+	uaPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Subscription.Keys.P256dh, "="))
+	if err == nil {
+		_, err = ecdh.P256().NewPublicKey(uaPublic)
+	}
+	authSecret, authErr := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Subscription.Keys.Auth, "="))
+	if err != nil || authErr != nil || len(authSecret) != 16 {
+		http.Error(w, "subscription keys must be a P-256 p256dh key and a 16-byte auth secret", http.StatusBadRequest)
+		return
+	}
+	sub := PushSubscription{
+		Email:     email,
+		Endpoint:  req.Subscription.Endpoint,
+		P256dh:    req.Subscription.Keys.P256dh,
+		Auth:      req.Subscription.Keys.Auth,
+		CreatedAt: time.Now(),
+	}
+	if _, err := a.db.Collection("push_subscriptions").Doc(pushSubscriptionID(sub.Endpoint)).Set(ctx, sub); err != nil {
+		log.Printf("ERROR in pushSubscriptionsHandler: Failed to save subscription: %v", err)
+		http.Error(w, "Failed to save subscription", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"status": "subscribed"})
+}
+
+// vapidPublicKeyHandler returns the applicationServerKey browsers subscribe with.
+func (a *App) vapidPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if a.webPush == nil {
+		http.Error(w, "Web Push is not configured", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"publicKey": a.webPush.Keys.Public})
+}
+
+// serviceWorkerHandler serves the service worker that shows push notifications. It
+// must be served from the site root to control every page.
+func (a *App) serviceWorkerHandler(w http.ResponseWriter, r *http.Request) {
+	src, err := templatesFS.ReadFile("templates/sw.js")
+	if err != nil {
+		http.Error(w, "Service worker not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(src)
+}
+
+// requirePushSubscription rejects webpush signals of users with no subscribed browser.
+func (a *App) requirePushSubscription(ctx context.Context, signal Signal) error {
+	if !slices.Contains(signal.Channels, "webpush") || a.db == nil {
+		return nil
+	}
+	docs, err := a.db.Collection("push_subscriptions").Where("email", "==", signal.Email).Limit(1).Documents(ctx).GetAll()
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return &inputError{errors.New("enable browser notifications on your signals page before choosing the webpush channel")}
+	}
+	return nil
+}
+
+// printVAPIDKeys implements the vapid-keys subcommand.
+func printVAPIDKeys() error {
+	keys, private, err := GenerateVAPIDKeys()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("VAPID_PRIVATE_KEY=%s\n# Public key (served at /push/vapid-public-key): %s\n", private, keys.Public)
+	return nil
+}